@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createOverdueTable(stub shim.ChaincodeStubInterface) error {
+	// Overdue invoices and payment requests, with the late-payment interest
+	// accrued since the due date
+	err := stub.CreateTable("Overdue", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Entity", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "EntityId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "DueDate", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "LateRate", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "AccruedThrough", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Accrued", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Overdue table.")
+	}
+	return nil
+}
+
+// getOverdueRow returns the overdue record of an invoice or payment request,
+// or an empty row when it was never found overdue.
+func getOverdueRow(stub shim.ChaincodeStubInterface, entity string, id int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: entity}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow("Overdue", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving overdue %s [%d]: [%s]", entity, id, err)
+	}
+	return row, nil
+}
+
+// programLateRate returns the late-payment rate of a program, or zero when
+// there is no program.
+func programLateRate(stub shim.ChaincodeStubInterface, program int32) (int32, error) {
+	if program == 0 {
+		return 0, nil
+	}
+	programRow, err := getProgramRow(stub, program)
+	if err != nil {
+		return 0, err
+	}
+	return programRow.Columns[8].GetInt32(), nil
+}
+
+// lateInterest computes the simple interest on an amount paid the given
+// number of days late at an annual rate in basis points.
+func lateInterest(amount int64, rate int32, days int64) int64 {
+	return amount * int64(rate) * days / (365 * 10000)
+}
+
+// overdueTerms returns whether an invoice or payment request is still
+// outstanding, the amount late interest accrues on, its due date and the
+// current late-payment rate. Invoices accrue at the rate of the program of
+// their buyer covering the supplier, payment requests at the rate of the
+// program they were financed under.
+func overdueTerms(stub shim.ChaincodeStubInterface, entity string, id int32) (bool, int64, string, int32, error) {
+	if entity == documentEntityInvoice {
+		invoiceRow, err := getInvoiceRow(stub, id)
+		if err != nil {
+			return false, 0, "", 0, err
+		}
+		program, err := programCovering(stub, invoiceRow)
+		if err != nil {
+			return false, 0, "", 0, err
+		}
+		rate, err := programLateRate(stub, program)
+		if err != nil {
+			return false, 0, "", 0, err
+		}
+		status := invoiceRow.Columns[2].GetString_()
+		outstanding := status != "Paid" && status != "Cancelled"
+		amount, err := invoiceAmount(stub, invoiceRow)
+		if err != nil {
+			return false, 0, "", 0, err
+		}
+		return outstanding, amount, invoiceRow.Columns[5].GetString_(), rate, nil
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, id)
+	if err != nil {
+		return false, 0, "", 0, err
+	}
+	invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return false, 0, "", 0, err
+	}
+	faceValue, _, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return false, 0, "", 0, err
+	}
+	paymentProgram, err := getPaymentProgramRow(stub, id)
+	if err != nil {
+		return false, 0, "", 0, err
+	}
+	var rate int32
+	if len(paymentProgram.Columns) != 0 {
+		rate, err = programLateRate(stub, paymentProgram.Columns[1].GetInt32())
+		if err != nil {
+			return false, 0, "", 0, err
+		}
+	}
+	status := paymentRow.Columns[5].GetString_()
+	outstanding := status == "Assigned" || status == "Funded"
+	return outstanding, faceValue, invoiceRow.Columns[5].GetString_(), rate, nil
+}
+
+// accrueOverdue flags an invoice or payment request that is past its due
+// date at the transaction time and accrues simple late-payment interest from
+// the due date. The late-payment rate is recorded when the entity is first
+// found overdue and used from then on, so closing the program or removing
+// the supplier later does not change the interest owed. Accrual is
+// recomputed from the due date every time, so repeated calls are idempotent,
+// and stops once the entity is paid.
+func accrueOverdue(stub shim.ChaincodeStubInterface, entity string, id int32) error {
+	outstanding, amount, dueDateValue, rate, err := overdueTerms(stub, entity, id)
+	if err != nil {
+		return err
+	}
+	if !outstanding {
+		return nil
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	dueDate, err := parseDate(dueDateValue)
+	if err != nil {
+		return err
+	}
+	days := daysBetween(dueDate, now)
+	if days <= 0 {
+		return nil
+	}
+
+	current, err := getOverdueRow(stub, entity, id)
+	if err != nil {
+		return err
+	}
+	if len(current.Columns) != 0 {
+		rate = current.Columns[4].GetInt32()
+	}
+	accrued := lateInterest(amount, rate, days)
+
+	fmt.Printf("Overdue %s [%d]: %d days at %d bp, accrued [%d]\n", entity, id, days, rate, accrued)
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: entity}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+			&shim.Column{Value: &shim.Column_String_{String_: dueDateValue}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: rate}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: accrued}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("Overdue", row)
+	} else {
+		_, err = stub.ReplaceRow("Overdue", row)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed storing overdue %s [%d]: [%s]", entity, id, err)
+	}
+	return nil
+}
+
+// accrue flags overdue invoices or payment requests and accrues their
+// late-payment interest as of the transaction timestamp. Anyone can call it;
+// the first argument is the entity, invoice or payment, followed by the ids.
+func (t *AssetManagementChaincode) accrue(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accrue late interest...")
+
+	if len(args) < 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting entity and at least one id")
+	}
+
+	entity := args[0]
+	if entity != documentEntityInvoice && entity != documentEntityPayment {
+		return nil, fmt.Errorf("Unknown entity [%s]", entity)
+	}
+
+	for _, arg := range args[1:] {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			throwError := errors.New("Expecting integer value for id")
+			return errorJson("accrue", throwError), throwError
+		}
+		err = accrueOverdue(stub, entity, int32(id))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Accrue late interest...done!")
+
+	return nil, nil
+}
+
+// overdueJson renders the overdue record of an invoice or payment request,
+// or nothing when it was never found overdue.
+func overdueJson(stub shim.ChaincodeStubInterface, entity string, id int32) (string, error) {
+	row, err := getOverdueRow(stub, entity, id)
+	if err != nil || len(row.Columns) == 0 {
+		return "", err
+	}
+
+	return `,"overdue":{"due_date":"` + row.Columns[2].GetString_() +
+		`","late_rate":"` + strconv.Itoa(int(row.Columns[4].GetInt32())) +
+		`","accrued_through":"` + row.Columns[5].GetString_() +
+		`","accrued":"` + strconv.FormatInt(row.Columns[6].GetInt64(), 10) + `"}`, nil
+}
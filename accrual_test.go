@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccrueOverdue(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cc *AssetManagementChaincode, stub *testStub)
+		accrued int64
+	}{
+		{name: "program unchanged", accrued: 1643},
+		{
+			name: "program closed",
+			change: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "closeProgram", "2", encodeCert("buyer"))
+			},
+			accrued: 1643,
+		},
+		{
+			name: "supplier removed from the program",
+			change: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "updateProgramParticipant", "2", programSupplier, "3", "false", encodeCert("buyer"))
+			},
+			accrued: 1643,
+		},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+		stub.invoke(t, cc, "createProgram", "2", "4", "150000", "300", "100", "90", encodeCert("buyer"), "1000")
+		stub.invoke(t, cc, "updateProgramParticipant", "2", programSupplier, "3", "true", encodeCert("buyer"))
+		stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+
+		stub.now = time.Date(2026, 12, 15, 12, 0, 0, 0, time.UTC)
+		stub.invoke(t, cc, "accrue", documentEntityInvoice, "1")
+		checkAccrued(t, test.name+", after 30 days", stub, 821)
+
+		if test.change != nil {
+			test.change(cc, stub)
+		}
+		stub.now = time.Date(2027, 1, 14, 12, 0, 0, 0, time.UTC)
+		stub.invoke(t, cc, "accrue", documentEntityInvoice, "1")
+		checkAccrued(t, test.name+", after 60 days", stub, test.accrued)
+	}
+}
+
+// checkAccrued compares the late interest accrued on invoice 1 with the
+// expected amount.
+func checkAccrued(t *testing.T, name string, stub *testStub, accrued int64) {
+	stub.MockTransactionStart(name)
+	row, err := getOverdueRow(stub, documentEntityInvoice, 1)
+	stub.MockTransactionEnd(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row.Columns) == 0 {
+		t.Errorf("%s: invoice not flagged overdue", name)
+		return
+	}
+	if got := row.Columns[6].GetInt64(); got != accrued {
+		t.Errorf("%s: got accrued %d, want %d", name, got, accrued)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Amounts exchanged with external documents carry two decimals, which are
+// stored on the ledger as integer minor units (1000.50 is stored as 100050).
+const amountScale = 2
+
+// parseDecimal converts a decimal string with at most scale fraction digits
+// into an integer scaled by 10^scale.
+func parseDecimal(value string, scale int) (int64, error) {
+	value = strings.TrimSpace(value)
+
+	negative := strings.HasPrefix(value, "-")
+	digits := strings.TrimPrefix(strings.TrimPrefix(value, "-"), "+")
+
+	whole, fraction := digits, ""
+	if dot := strings.Index(digits, "."); dot >= 0 {
+		whole, fraction = digits[:dot], digits[dot+1:]
+	}
+	if whole == "" && fraction == "" {
+		return 0, fmt.Errorf("Invalid decimal value [%s]", value)
+	}
+	if len(fraction) > scale {
+		return 0, fmt.Errorf("Decimal value [%s] has more than %d fraction digits", value, scale)
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	scaled, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || strings.ContainsAny(whole+fraction, "+-") {
+		return 0, fmt.Errorf("Invalid decimal value [%s]", value)
+	}
+	if negative {
+		scaled = -scaled
+	}
+	return scaled, nil
+}
+
+// formatDecimal renders an integer scaled by 10^scale as a decimal string.
+func formatDecimal(value int64, scale int) string {
+	sign := ""
+	if value < 0 {
+		sign, value = "-", -value
+	}
+	digits := strconv.FormatInt(value, 10)
+	if scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createApprovalTables(stub shim.ChaincodeStubInterface) error {
+	// Policy tiers of a buyer. The tier with the highest threshold not above
+	// the invoice price applies; Roles is a comma separated list of approver
+	// roles that must each be among the approvers
+	err := stub.CreateTable("ApprovalPolicy", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Threshold", Type: shim.ColumnDefinition_INT64, Key: true},
+		&shim.ColumnDefinition{Name: "RequiredApprovers", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Roles", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating ApprovalPolicy table.")
+	}
+
+	// Fingerprints of the certificates allowed to approve invoices of a
+	// buyer, with their role
+	err = stub.CreateTable("BuyerApprover", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "ApproverCert", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "Role", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating BuyerApprover table.")
+	}
+
+	// Approvals recorded on an invoice, one per distinct approver identity
+	err = stub.CreateTable("InvoiceApproval", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "ApproverCert", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "Role", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Date", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating InvoiceApproval table.")
+	}
+
+	return nil
+}
+
+// approvalRoles splits the roles of a policy tier.
+func approvalRoles(roles string) []string {
+	var list []string
+	for _, role := range strings.Split(roles, ",") {
+		role = strings.TrimSpace(role)
+		if role != "" {
+			list = append(list, role)
+		}
+	}
+	return list
+}
+
+// getApprovalPolicy returns the policy tier applying to an invoice of a
+// buyer for the given price, or an empty row when the buyer's single
+// approval is enough.
+func getApprovalPolicy(stub shim.ChaincodeStubInterface, buyerId int32, price int64) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: buyerId}}
+	columns = append(columns, col1)
+
+	var policy shim.Row
+	rows, err := stub.GetRows("ApprovalPolicy", columns)
+	if err != nil {
+		return policy, fmt.Errorf("Failed retrieving approval policy of buyer [%d]: [%s]", buyerId, err)
+	}
+	for row := range rows {
+		threshold := row.Columns[1].GetInt64()
+		if threshold > price {
+			continue
+		}
+		if len(policy.Columns) == 0 || threshold > policy.Columns[1].GetInt64() {
+			policy = row
+		}
+	}
+	return policy, nil
+}
+
+// getBuyerApproverRow returns the approver of a buyer with a certificate
+// fingerprint, or an empty row.
+func getBuyerApproverRow(stub shim.ChaincodeStubInterface, buyerId int32, approver []byte) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: buyerId}}
+	col2 := shim.Column{Value: &shim.Column_Bytes{Bytes: approver}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow("BuyerApprover", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving approver of buyer [%d]: [%s]", buyerId, err)
+	}
+	return row, nil
+}
+
+func getInvoiceApprovals(stub shim.ChaincodeStubInterface, number int32) ([]shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("InvoiceApproval", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving approvals of invoice [%d]: [%s]", number, err)
+	}
+	var approvals []shim.Row
+	for row := range rows {
+		approvals = append(approvals, row)
+	}
+	return approvals, nil
+}
+
+// recordApproval records the approval of an invoice by one of the approvers
+// of its buyer, or by the buyer itself when the caller acts for it, under a
+// policy tier. It returns true once the approvals satisfy the tier: enough
+// distinct approvers and every role of the tier among them. Without a tier
+// the single approval is enough.
+func recordApproval(stub shim.ChaincodeStubInterface, invoiceRow shim.Row, policy shim.Row, approver []byte, actsForBuyer bool) (bool, error) {
+	number := invoiceRow.Columns[0].GetInt32()
+	buyerId := invoiceRow.Columns[7].GetInt32()
+
+	if invoiceRow.Columns[2].GetString_() != "Pending" {
+		return false, fmt.Errorf("Invoice [%d] is not pending approval", number)
+	}
+
+	identity := certFingerprint(approver)
+	registered, err := getBuyerApproverRow(stub, buyerId, identity)
+	if err != nil {
+		return false, err
+	}
+	role := ""
+	if len(registered.Columns) != 0 {
+		role = registered.Columns[2].GetString_()
+	} else if actsForBuyer {
+		// The buyer and its delegates count as a single approver
+		identity = identityOf(invoiceRow.Columns[9].GetBytes())
+	} else {
+		return false, errors.New("Caller is not allowed to do this operation")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return false, err
+	}
+	ok, err := stub.InsertRow("InvoiceApproval", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: number}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: identity}},
+			&shim.Column{Value: &shim.Column_String_{String_: role}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed recording approval of invoice [%d]: [%s]", number, err)
+	}
+	if !ok {
+		return false, fmt.Errorf("Invoice [%d] was already approved by this approver", number)
+	}
+	if len(policy.Columns) == 0 {
+		return true, nil
+	}
+
+	approvals, err := getInvoiceApprovals(stub, number)
+	if err != nil {
+		return false, err
+	}
+	covered := make(map[string]bool)
+	for _, approval := range approvals {
+		covered[approval.Columns[2].GetString_()] = true
+	}
+
+	required := int(policy.Columns[2].GetInt32())
+	if len(approvals) < required {
+		fmt.Printf("Invoice [%d] has %d of %d approvals\n", number, len(approvals), required)
+		return false, nil
+	}
+	for _, role := range approvalRoles(policy.Columns[3].GetString_()) {
+		if !covered[role] {
+			fmt.Printf("Invoice [%d] still needs an approval by role [%s]\n", number, role)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// approvalsJson renders the approvals recorded on an invoice, if any.
+func approvalsJson(stub shim.ChaincodeStubInterface, number int32) (string, error) {
+	approvals, err := getInvoiceApprovals(stub, number)
+	if err != nil || len(approvals) == 0 {
+		return "", err
+	}
+
+	entries := make(map[string]string)
+	var keys []string
+	for _, approval := range approvals {
+		approver := hex.EncodeToString(approval.Columns[1].GetBytes())
+		date := approval.Columns[3].GetString_()
+		entries[date+approver] = `{"approver":"` + approver +
+			`","role":` + jsonString(approval.Columns[2].GetString_()) +
+			`,"date":"` + date + `"}`
+		keys = append(keys, date+approver)
+	}
+	sort.Strings(keys)
+
+	jsonResp := `,"approvals":[`
+	for i, key := range keys {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += entries[key]
+	}
+	return jsonResp + `]`, nil
+}
+
+// setApprovalPolicy publishes a policy tier for invoices of a buyer priced
+// at or above a threshold, or removes it with zero required approvers.
+// Only the buyer or an administrator can call this function.
+func (t *AssetManagementChaincode) setApprovalPolicy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set approval policy...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	buyerId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("setApprovalPolicy", throwError), throwError
+	}
+	threshold, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || threshold < 0 {
+		throwError := errors.New("Expecting a non negative integer value for threshold")
+		return errorJson("setApprovalPolicy", throwError), throwError
+	}
+	required, err := strconv.Atoi(args[2])
+	if err != nil || required < 0 {
+		throwError := errors.New("Expecting a non negative integer value for required approvers")
+		return errorJson("setApprovalPolicy", throwError), throwError
+	}
+	roles := approvalRoles(args[3])
+	if required > 0 && len(roles) > required {
+		return nil, errors.New("More approver roles than required approvers")
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	err = requireParticipantAuthority(stub, int32(buyerId), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}}
+	col2 := shim.Column{Value: &shim.Column_Int64{Int64: threshold}}
+	columns = append(columns, col1, col2)
+
+	current, err := stub.GetRow("ApprovalPolicy", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving approval policy of buyer [%d]: [%s]", buyerId, err)
+	}
+
+	if required == 0 {
+		if len(current.Columns) == 0 {
+			return nil, fmt.Errorf("Buyer [%d] has no approval policy at threshold %d", buyerId, threshold)
+		}
+		err = stub.DeleteRow("ApprovalPolicy", columns)
+		if err != nil {
+			return nil, fmt.Errorf("Failed removing approval policy of buyer [%d]: [%s]", buyerId, err)
+		}
+		fmt.Println("Set approval policy...done!")
+		return nil, nil
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: threshold}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(required)}},
+			&shim.Column{Value: &shim.Column_String_{String_: strings.Join(roles, ",")}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("ApprovalPolicy", row)
+	} else {
+		_, err = stub.ReplaceRow("ApprovalPolicy", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing approval policy of buyer [%d]: [%s]", buyerId, err)
+	}
+
+	fmt.Println("Set approval policy...done!")
+
+	return nil, nil
+}
+
+// setApprover allows a certificate to approve invoices of a buyer with a
+// role, or revokes it with an empty role. Only the buyer or an administrator
+// can call this function.
+func (t *AssetManagementChaincode) setApprover(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set approver...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	buyerId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("setApprover", throwError), throwError
+	}
+	approver, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil || len(approver) == 0 {
+		return nil, errors.New("Failed decoding approver")
+	}
+	approver = certFingerprint(approver)
+	role := strings.TrimSpace(args[2])
+	if strings.Contains(role, ",") {
+		return nil, errors.New("Approver role cannot contain a comma")
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	err = requireParticipantAuthority(stub, int32(buyerId), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := getBuyerApproverRow(stub, int32(buyerId), approver)
+	if err != nil {
+		return nil, err
+	}
+
+	if role == "" {
+		if len(current.Columns) == 0 {
+			return nil, fmt.Errorf("Certificate is not an approver of buyer [%d]", buyerId)
+		}
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}}
+		col2 := shim.Column{Value: &shim.Column_Bytes{Bytes: approver}}
+		columns = append(columns, col1, col2)
+		err = stub.DeleteRow("BuyerApprover", columns)
+		if err != nil {
+			return nil, fmt.Errorf("Failed removing approver of buyer [%d]: [%s]", buyerId, err)
+		}
+		fmt.Println("Set approver...done!")
+		return nil, nil
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: approver}},
+			&shim.Column{Value: &shim.Column_String_{String_: role}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("BuyerApprover", row)
+	} else {
+		_, err = stub.ReplaceRow("BuyerApprover", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing approver of buyer [%d]: [%s]", buyerId, err)
+	}
+
+	fmt.Println("Set approver...done!")
+
+	return nil, nil
+}
+
+// approval_policy returns the policy tiers and the approvers of a buyer.
+func (t *AssetManagementChaincode) approval_policy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query approval policy...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	buyerId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("approval_policy", throwError), throwError
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("ApprovalPolicy", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving approval policy of buyer [%d]: [%s]", buyerId, err)
+	}
+	tiers := make(map[string]string)
+	var thresholds []string
+	for row := range rows {
+		// Zero padded so the thresholds sort numerically
+		key := fmt.Sprintf("%020d", row.Columns[1].GetInt64())
+		tiers[key] = `{"threshold":"` + strconv.FormatInt(row.Columns[1].GetInt64(), 10) +
+			`","required_approvers":"` + strconv.Itoa(int(row.Columns[2].GetInt32())) +
+			`","roles":` + jsonString(row.Columns[3].GetString_()) + `}`
+		thresholds = append(thresholds, key)
+	}
+	sort.Strings(thresholds)
+
+	rows, err = stub.GetRows("BuyerApprover", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving approvers of buyer [%d]: [%s]", buyerId, err)
+	}
+	approvers := make(map[string]string)
+	var certs []string
+	for row := range rows {
+		approver := hex.EncodeToString(row.Columns[1].GetBytes())
+		approvers[approver] = `{"approver":"` + approver +
+			`","role":` + jsonString(row.Columns[2].GetString_()) + `}`
+		certs = append(certs, approver)
+	}
+	sort.Strings(certs)
+
+	jsonResp := `{"buyer":"` + strconv.Itoa(buyerId) + `","tiers":[`
+	for i, key := range thresholds {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += tiers[key]
+	}
+	jsonResp += `],"approvers":[`
+	for i, cert := range certs {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += approvers[cert]
+	}
+	jsonResp += `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query approval policy...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestApproveInvoicePolicy(t *testing.T) {
+	type approval struct {
+		cert  string
+		fails bool
+	}
+	tests := []struct {
+		name      string
+		price     string
+		approvals []approval
+		status    string
+	}{
+		{
+			name:      "below the threshold",
+			price:     "40000",
+			approvals: []approval{{cert: "buyer"}},
+			status:    "Approved",
+		},
+		{
+			name:      "buyer alone above the threshold",
+			price:     "100000",
+			approvals: []approval{{cert: "buyer"}},
+			status:    "Pending",
+		},
+		{
+			name:      "buyer and the required role",
+			price:     "100000",
+			approvals: []approval{{cert: "buyer"}, {cert: "treasurer"}},
+			status:    "Approved",
+		},
+		{
+			name:      "two approvers without the required role",
+			price:     "100000",
+			approvals: []approval{{cert: "controller"}, {cert: "buyer"}},
+			status:    "Pending",
+		},
+		{
+			name:      "same approver twice",
+			price:     "100000",
+			approvals: []approval{{cert: "treasurer"}, {cert: "treasurer", fails: true}},
+			status:    "Pending",
+		},
+		{
+			name:      "approver not registered",
+			price:     "100000",
+			approvals: []approval{{cert: "clerk", fails: true}},
+			status:    "Pending",
+		},
+		{
+			name:      "approver revoked",
+			price:     "100000",
+			approvals: []approval{{cert: "buyer"}, {cert: "auditor", fails: true}},
+			status:    "Pending",
+		},
+		{
+			name:      "approver below the threshold",
+			price:     "40000",
+			approvals: []approval{{cert: "treasurer", fails: true}},
+			status:    "Pending",
+		},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+		stub.invoke(t, cc, "setApprovalPolicy", "4", "50000", "2", "treasury", encodeCert("buyer"))
+		stub.invoke(t, cc, "setApprover", "4", encodeCert("treasurer"), "treasury", encodeCert("buyer"))
+		stub.invoke(t, cc, "setApprover", "4", encodeCert("controller"), "finance", encodeCert("buyer"))
+		stub.invoke(t, cc, "setApprover", "4", encodeCert("auditor"), "treasury", encodeCert("buyer"))
+		stub.invoke(t, cc, "setApprover", "4", encodeCert("auditor"), "", encodeCert("admin"))
+		stub.invoke(t, cc, "createInvoice", "1", test.price, "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+
+		for _, approval := range test.approvals {
+			stub.MockTransactionStart(test.name)
+			_, err := cc.Invoke(stub, "approveInvoice", []string{"1", encodeCert(approval.cert)})
+			stub.MockTransactionEnd(test.name)
+			if approval.fails != (err != nil) {
+				t.Errorf("%s: approval by %s got error %v, want an error: %t", test.name, approval.cert, err, approval.fails)
+			}
+		}
+
+		invoiceRow, err := getInvoiceRow(stub, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := invoiceRow.Columns[2].GetString_(); status != test.status {
+			t.Errorf("%s: got invoice %s, want %s", test.name, status, test.status)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"strconv"
 	"errors"
 	"fmt"
 	"bytes"
+	"sort"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/crypto/primitives"
 //	"github.com/op/go-logging"
@@ -18,8 +20,8 @@ type AssetManagementChaincode struct {
 // The deploy transaction metadata is supposed to contain the administrator cert
 func (t *AssetManagementChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("Init Chaincode...")
-	if len(args) != 0 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	if len(args) != 0 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0 or 3")
 	}
 
 	// Create invoice table
@@ -52,6 +54,139 @@ func (t *AssetManagementChaincode) Init(stub shim.ChaincodeStubInterface, functi
 		return nil, errors.New("Failed creating PaymentRequest table.")
 	}
 
+	err = createInvoicePaymentTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createInvoiceLineTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createPurchaseOrderTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createRoleTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createDeliveryTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createDocumentTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createInvoiceCurrencyTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createBankAccountTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createReconciliationTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createDynamicDiscountTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createProgramTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createLimitTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createOverdueTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createRecourseTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createDisputeTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createReceivableTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createFractionTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createCashTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createNettingTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createFxTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createConfigTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createFreezeTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createApprovalTables(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createDelegationTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createParticipantCertTable(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional token chaincode settling funding and repayments
+	if len(args) == 3 {
+		err = setTokenChaincode(stub, args[0], args[1], args[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 
 	supplierRole, err := stub.GetCallerMetadata()
 	fmt.Printf("Assiger role is %v\n", string(supplierRole))
@@ -66,6 +201,17 @@ func (t *AssetManagementChaincode) Init(stub shim.ChaincodeStubInterface, functi
 
 	stub.PutState("supplierRole", supplierRole)
 
+	// The deployer administers the platform parameters
+	_, err = stub.InsertRow("Role", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: roleAdmin}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(supplierRole)}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed adding role [%s]: [%s]", roleAdmin, err)
+	}
+
 	fmt.Println("Init Chaincode...done")
 
 	return nil, nil
@@ -76,11 +222,259 @@ func errorJson(function string, errorMsg error) []byte {
 	return []byte(error);
 }
 
+// jsonString quotes a free-text value for embedding in a JSON response.
+func jsonString(value string) string {
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+type int32Slice []int32
+
+func (p int32Slice) Len() int           { return len(p) }
+func (p int32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// sortInt32s sorts ids read from table rows so results do not depend on
+// the iteration order of the ledger.
+func sortInt32s(values []int32) {
+	sort.Sort(int32Slice(values))
+}
+
+// getInvoiceRow fetches an invoice and fails if it does not exist.
+func getInvoiceRow(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("Invoice", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving invoice [%d]: [%s]", number, err)
+	}
+	if len(row.Columns) == 0 {
+		return row, fmt.Errorf("Invoice [%d] does not exist", number)
+	}
+	return row, nil
+}
+
+// getPaymentRequestRow fetches a payment request and fails if it does not exist.
+func getPaymentRequestRow(stub shim.ChaincodeStubInterface, payment int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentRequest", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving payment request [%d]: [%s]", payment, err)
+	}
+	if len(row.Columns) == 0 {
+		return row, fmt.Errorf("Payment request [%d] does not exist", payment)
+	}
+	return row, nil
+}
+
+func createInvoicePaymentTable(stub shim.ChaincodeStubInterface) error {
+	// Payment requests raised on each invoice
+	err := stub.CreateTable("InvoicePayment", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating InvoicePayment table.")
+	}
+
+	// Transaction time each payment request was created at
+	err = stub.CreateTable("PaymentRequestTime", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Created", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PaymentRequestTime table.")
+	}
+	return nil
+}
+
+// indexInvoicePayment indexes a new payment request under its invoice and
+// records the transaction time it was created at.
+func indexInvoicePayment(stub shim.ChaincodeStubInterface, number int32, payment int32) error {
+	_, err := stub.InsertRow("InvoicePayment", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: number}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed indexing payment request [%d] of invoice [%d]: [%s]", payment, number, err)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	_, err = stub.InsertRow("PaymentRequestTime", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: now.Unix()}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed recording creation of payment request [%d]: [%s]", payment, err)
+	}
+	return nil
+}
+
+// getInvoicePayments returns the ids of the payment requests raised on an
+// invoice, in ascending order.
+func getInvoicePayments(stub shim.ChaincodeStubInterface, number int32) ([]int32, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("InvoicePayment", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving payment requests of invoice [%d]: [%s]", number, err)
+	}
+
+	var payments []int32
+	for row := range rows {
+		payments = append(payments, row.Columns[1].GetInt32())
+	}
+	sortInt32s(payments)
+	return payments, nil
+}
+
+// livePaymentRequest returns a payment request of an invoice that is still
+// outstanding, or an empty row when every request was settled, cancelled,
+// written off or expired before being assigned.
+func livePaymentRequest(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	payments, err := getInvoicePayments(stub, number)
+	if err != nil {
+		return shim.Row{}, err
+	}
+	for _, payment := range payments {
+		paymentRow, err := getPaymentRequestRow(stub, payment)
+		if err != nil {
+			return shim.Row{}, err
+		}
+		live, err := isLivePaymentRequest(stub, paymentRow)
+		if err != nil {
+			return shim.Row{}, err
+		}
+		if live {
+			return paymentRow, nil
+		}
+	}
+	return shim.Row{}, nil
+}
+
+// isLivePaymentRequest tells whether a payment request is still outstanding:
+// assigned, funded, in recourse to the supplier, or pending and not expired.
+func isLivePaymentRequest(stub shim.ChaincodeStubInterface, paymentRow shim.Row) (bool, error) {
+	switch paymentRow.Columns[5].GetString_() {
+	case "Settled", "Cancelled", "Defaulted":
+		return false, nil
+	case "Pending":
+		invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+		if err != nil {
+			return false, err
+		}
+		expired, err := paymentExpired(stub, paymentRow.Columns[0].GetInt32(), invoiceRow)
+		return !expired, err
+	}
+	return true, nil
+}
+
+// setInvoiceStatus stores a new status on an invoice row read with getInvoiceRow.
+func setInvoiceStatus(stub shim.ChaincodeStubInterface, row shim.Row, status string) error {
+	row.Columns[2] = &shim.Column{Value: &shim.Column_String_{String_: status}}
+	_, err := stub.ReplaceRow("Invoice", row)
+	if err != nil {
+		return fmt.Errorf("Failed updating status of invoice [%d]: [%s]", row.Columns[0].GetInt32(), err)
+	}
+	return nil
+}
+
+// setPaymentRequestStatus stores a new status on a payment request row read
+// with getPaymentRequestRow.
+func setPaymentRequestStatus(stub shim.ChaincodeStubInterface, row shim.Row, status string) error {
+	row.Columns[5] = &shim.Column{Value: &shim.Column_String_{String_: status}}
+	_, err := stub.ReplaceRow("PaymentRequest", row)
+	if err != nil {
+		return fmt.Errorf("Failed updating status of payment request [%d]: [%s]", row.Columns[0].GetInt32(), err)
+	}
+	return nil
+}
+
+// paymentAmounts returns the face value of the invoice behind a payment
+// request and the payout to the supplier once the discount is applied. The
+// discount is the discount rate, a percentage of the face value, unless the
+// request was created by taking a dynamic discounting offer or under a
+// reverse factoring program.
+func paymentAmounts(stub shim.ChaincodeStubInterface, paymentRow shim.Row) (int64, int64, error) {
+	number := paymentRow.Columns[1].GetInt32()
+	invoiceRow, err := getInvoiceRow(stub, number)
+	if err != nil {
+		return 0, 0, err
+	}
+	faceValue, err := paymentFaceValue(stub, paymentRow.Columns[0].GetInt32(), invoiceRow)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dynamic, err := getDynamicDiscountRow(stub, number)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(dynamic.Columns) != 0 && dynamic.Columns[1].GetInt32() == paymentRow.Columns[0].GetInt32() {
+		return faceValue, faceValue - dynamic.Columns[4].GetInt64(), nil
+	}
+
+	program, err := getPaymentProgramRow(stub, paymentRow.Columns[0].GetInt32())
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(program.Columns) != 0 {
+		return faceValue, faceValue - program.Columns[3].GetInt64(), nil
+	}
+
+	discount := faceValue * int64(paymentRow.Columns[2].GetInt32()) / 100
+	return faceValue, faceValue - discount, nil
+}
+
+// insertInvoice stores a new pending invoice together with its line items.
+// The supplier and buyer are kept as certificate fingerprints.
+func insertInvoice(stub shim.ChaincodeStubInterface, number int32, price int32, deliveryDate string, paymentDate string,
+	supplierId int32, buyerId int32, supplier []byte, buyer []byte, lines []invoiceLine) error {
+	ok, err := stub.InsertRow("Invoice", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: number}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: price}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Pending"}},
+			&shim.Column{Value: &shim.Column_String_{String_: deliveryDate}},
+			&shim.Column{Value: &shim.Column_String_{String_: deliveryDate}},
+			&shim.Column{Value: &shim.Column_String_{String_: paymentDate}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: supplierId}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: buyerId}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(supplier)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(buyer)}}},
+	})
+
+	if !ok && err == nil {
+		return errors.New("Invoice with this number was already created.")
+	}
+	if err != nil {
+		return err
+	}
+
+	return insertInvoiceLines(stub, number, lines)
+}
+
 func (t *AssetManagementChaincode) createInvoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	fmt.Println("Create invoice...")
 
-	if len(args) != 7 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 7")
+	// Line items are optional and follow the invoice header as groups of
+	// description, sku, quantity, unitPrice, taxRate, taxAmount.
+	if len(args) < 7 || (len(args)-7)%invoiceLineArgs != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7, plus 6 per invoice line")
 	}
 
 	number, err := strconv.Atoi(args[0])
@@ -122,6 +516,17 @@ func (t *AssetManagementChaincode) createInvoice(stub shim.ChaincodeStubInterfac
 	}
 	fmt.Println("Buyer cert bytes = ", buyer)	
 
+	lines, err := parseInvoiceLines(args[7:])
+	if err != nil {
+		return errorJson("createInvoice", err), err
+	}
+	if len(lines) > 0 {
+		err = checkInvoiceLineTotals(lines, int32(price))
+		if err != nil {
+			return errorJson("createInvoice", err), err
+		}
+	}
+
 //************************************************************************
 	//Enable this when membersrvc conf available
 
@@ -149,25 +554,19 @@ func (t *AssetManagementChaincode) createInvoice(stub shim.ChaincodeStubInterfac
 	// }
 //***********************************************************************8	
 
+	// Only the supplier raises its invoices. Nothing on the ledger names its
+	// certificate yet, so it must be registered for the supplier id
+	err = requireParticipantCert(stub, int32(supplierId), nil, supplier)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create an invoice
 	fmt.Println("Creating new invoice, number: [%s] ,price: [%s], deliveryDate: [%s], supplier is [% x], buyer is [% x]",number,price,deliveryDate, supplier,buyer)
 
-	ok, err := stub.InsertRow("Invoice", shim.Row{
-		Columns: []*shim.Column{
-			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
-			&shim.Column{Value: &shim.Column_Int32{Int32: int32(price)}},
-			&shim.Column{Value: &shim.Column_String_{String_: "Pending"}},
-			&shim.Column{Value: &shim.Column_String_{String_: deliveryDate}},
-			&shim.Column{Value: &shim.Column_String_{String_: deliveryDate}},
-			&shim.Column{Value: &shim.Column_String_{String_: deliveryDate}},
-			&shim.Column{Value: &shim.Column_Int32{Int32: int32(supplierId)}},
-			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: supplier}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: buyer}}},
-	})
-
-	if !ok && err == nil {
-		return nil, errors.New("Invoice with this number was already created.")
+	err = insertInvoice(stub, int32(number), int32(price), deliveryDate, deliveryDate, int32(supplierId), int32(buyerId), supplier, buyer, lines)
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Println("Create invoice...done!")
@@ -212,11 +611,59 @@ func (t *AssetManagementChaincode) approveInvoice(stub shim.ChaincodeStubInterfa
 	if len(realBuyer) == 0 {
 		return nil, fmt.Errorf("Invalid real buyer. Nil")
 	}
+	// Only pending invoices can be approved, never cancelled or paid ones
+	if row.Columns[2].GetString_() != "Pending" {
+		return nil, fmt.Errorf("Invoice [%d] is %s", number, row.Columns[2].GetString_())
+	}
+
+	// High-value invoices may need several approvers under the buyer policy
+	policy, err := getApprovalPolicy(stub, row.Columns[7].GetInt32(), int64(row.Columns[1].GetInt32()))
+	if err != nil {
+		return nil, err
+	}
 
-	ok := bytes.Equal(buyer, realBuyer)
+	// A delegate of the buyer approves on its behalf
+	ok, err := actsFor(stub, row.Columns[7].GetInt32(), realBuyer, buyer, "approveInvoice", int64(row.Columns[1].GetInt32()))
+	if err != nil {
+		return nil, err
+	}
 
+	// Anyone else must be a registered approver under the buyer policy
 	if ok != true {
-		return nil, fmt.Errorf("Caller is not allowed to do this operation")	
+		if len(policy.Columns) == 0 {
+			return nil, fmt.Errorf("Caller is not allowed to do this operation")
+		}
+		approver, err := getBuyerApproverRow(stub, row.Columns[7].GetInt32(), certFingerprint(buyer))
+		if err != nil {
+			return nil, err
+		}
+		if len(approver.Columns) == 0 {
+			return nil, fmt.Errorf("Caller is not allowed to do this operation")
+		}
+	}
+
+	err = requireDelivery(stub, row)
+	if err != nil {
+		return nil, err
+	}
+
+	// Invoices raised against a purchase order need a clean three-way match
+	discrepancies, err := t.matchInvoice(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(discrepancies) > 0 {
+		return nil, fmt.Errorf("Invoice [%d] does not match its purchase order: %v", number, discrepancies)
+	}
+
+	// Record the approval and approve the invoice once the policy is met
+	approved, err := recordApproval(stub, row, policy, buyer, ok)
+	if err != nil {
+		return nil, err
+	}
+	if !approved {
+		fmt.Println("Approve invoice...partially approved!")
+		return nil, nil
 	}
 
 	// Approve an invoice
@@ -268,8 +715,8 @@ func (t *AssetManagementChaincode) createPaymentRequest(stub shim.ChaincodeStubI
 	// 	&shim.ColumnDefinition{Name: "PayerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
 
 
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	if len(args) != 5 && len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5 or 6")
 	}
 
 	payment, err := strconv.Atoi(args[0])
@@ -289,6 +736,14 @@ func (t *AssetManagementChaincode) createPaymentRequest(stub shim.ChaincodeStubI
 	}
 
 	requestDate := args[3]
+
+	recourse := false
+	if len(args) == 6 {
+		recourse, err = parseRecourse(args[5])
+		if err != nil {
+			return errorJson("createPaymentRequest", err), err
+		}
+	}
 	
 	fmt.Println("Payment request id = ", number)
     fmt.Println("Invoice number = ", number)	
@@ -316,11 +771,54 @@ func (t *AssetManagementChaincode) createPaymentRequest(stub shim.ChaincodeStubI
 		return nil, fmt.Errorf("Invalid real buyer. Nil")
 	}
 
-	ok := bytes.Equal(buyer, realBuyer)
+	// A delegate of the buyer requests payment on its behalf
+	ok, err := actsFor(stub, row.Columns[7].GetInt32(), realBuyer, buyer, "createPaymentRequest", int64(row.Columns[1].GetInt32()))
+	if err != nil {
+		return nil, err
+	}
 
 	if ok != true {
 		return nil, fmt.Errorf("Caller is not allowed to do this operation")	
 	}
+	buyer = identityOf(realBuyer)
+
+	err = requireDelivery(stub, row)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoDispute(stub, row)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotFrozen(stub, row)
+	if err != nil {
+		return nil, err
+	}
+
+	// Financing terms of invoices covered by a program come from the program
+	program, err := programCovering(stub, row)
+	if err != nil {
+		return nil, err
+	}
+	if program != 0 {
+		return nil, fmt.Errorf("Invoice [%d] is covered by program [%d], use createProgramPaymentRequest", number, program)
+	}
+
+	maxDiscountRate, err := configValue(stub, configMaxDiscountRate)
+	if err != nil {
+		return nil, err
+	}
+	if discountRate < 0 || int64(discountRate) > maxDiscountRate {
+		return nil, fmt.Errorf("Discount rate must be between 0 and %d", maxDiscountRate)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = checkTenor(stub, now, row.Columns[5].GetString_())
+	if err != nil {
+		return nil, err
+	}
 
 	// Create a payment request
 	fmt.Println("Creating new payment request, number: [%s] ,paymentID: [%s], discountRate: [%s], buyer is [% x]",number,payment,discountRate, buyer)
@@ -339,6 +837,15 @@ func (t *AssetManagementChaincode) createPaymentRequest(stub shim.ChaincodeStubI
 		return nil, errors.New("payment request with this id was already created.")
 	}
 
+	err = setPaymentRecourse(stub, int32(payment), recourse)
+	if err != nil {
+		return nil, err
+	}
+	err = indexInvoicePayment(stub, int32(number), int32(payment))
+	if err != nil {
+		return nil, err
+	}
+
 	//Update invoice request date
 
 	supplier := row.Columns[8].GetBytes()
@@ -421,9 +928,53 @@ func (t *AssetManagementChaincode) assignPaymentRequest(stub shim.ChaincodeStubI
 		return nil, fmt.Errorf("Payment request [%s] already has payer with id = [%s]",payment,oldPayerId)
 	}
 
+	// The payer becomes the funder of record, so its cert must be registered
+	// for the payer id
+	err = requireParticipantCert(stub, int32(payerId), nil, payer)
+	if err != nil {
+		return nil, err
+	}
+
 	invoice := row.Columns[1].GetInt32()
 	discountRate := row.Columns[2].GetInt32()
 
+	invoiceRow, err := getInvoiceRow(stub, invoice)
+	if err != nil {
+		return nil, err
+	}
+	err = requireDelivery(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoDispute(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotFrozen(stub, invoiceRow, int32(payerId))
+	if err != nil {
+		return nil, err
+	}
+	err = checkProgramFunder(stub, int32(payment), int32(payerId))
+	if err != nil {
+		return nil, err
+	}
+	err = requireRecourseConsent(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	err = checkAuctionWindow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	err = checkPaymentExpiry(stub, int32(payment), invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = takeExposure(stub, row, invoiceRow, int32(payerId))
+	if err != nil {
+		return nil, err
+	}
+
 	// Assign a payment request
 	fmt.Println("Assigning a payment request, paymentID: [%s], payerId: [%s], payer is [% x]",payment,payerId, payer)
 
@@ -436,7 +987,7 @@ func (t *AssetManagementChaincode) assignPaymentRequest(stub shim.ChaincodeStubI
 			&shim.Column{Value: &shim.Column_Int32{Int32: int32(invoice)}},
 			&shim.Column{Value: &shim.Column_Int32{Int32: int32(discountRate)}},
 			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payerId)}},
-			&shim.Column{Value: &shim.Column_Bytes{Bytes: payer}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(payer)}},
 			&shim.Column{Value: &shim.Column_String_{String_: "Assigned"}},
 			},
 		})
@@ -445,6 +996,12 @@ func (t *AssetManagementChaincode) assignPaymentRequest(stub shim.ChaincodeStubI
 		return errorJson("transfer", throwError), throwError
 	}
 
+	// The payer now holds a transferable claim on the buyer payment
+	err = mintReceivable(stub, int32(payment), invoice, int32(payerId), certFingerprint(payer))
+	if err != nil {
+		return nil, err
+	}
+
 	fmt.Println("Create payment request...done!")
 
 	return nil, err
@@ -519,6 +1076,14 @@ func (t *AssetManagementChaincode) isCaller(stub shim.ChaincodeStubInterface, ce
 // An asset is any string to identify it. An owner is representated by one of his ECert/TCert.
 func (t *AssetManagementChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
+	// Only unpause gets through while the platform is paused
+	if function != "unpause" {
+		err := requireNotPaused(stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Handle different functions
 	if function == "createInvoice" {
 		// Assign ownership
@@ -532,6 +1097,100 @@ func (t *AssetManagementChaincode) Invoke(stub shim.ChaincodeStubInterface, func
 	} else if function == "assignPaymentRequest" {
 		// Transfer ownership
 		return t.assignPaymentRequest(stub, args)
+	} else if function == "createPurchaseOrder" {
+		return t.createPurchaseOrder(stub, args)
+	} else if function == "createGoodsReceipt" {
+		return t.createGoodsReceipt(stub, args)
+	} else if function == "createInvoiceForOrder" {
+		return t.createInvoiceForOrder(stub, args)
+	} else if function == "addRole" {
+		return t.addRole(stub, args)
+	} else if function == "removeRole" {
+		return t.removeRole(stub, args)
+	} else if function == "setDeliveryPolicy" {
+		return t.setDeliveryPolicy(stub, args)
+	} else if function == "postProofOfDelivery" {
+		return t.postProofOfDelivery(stub, args)
+	} else if function == "attachDocument" {
+		return t.attachDocument(stub, args)
+	} else if function == "createInvoiceFromUBL" {
+		return t.createInvoiceFromUBL(stub, args)
+	} else if function == "registerBankAccount" {
+		return t.registerBankAccount(stub, args)
+	} else if function == "reconcileStatement" {
+		return t.reconcileStatement(stub, args)
+	} else if function == "publishDiscountOffer" {
+		return t.publishDiscountOffer(stub, args)
+	} else if function == "requestEarlyPayment" {
+		return t.requestEarlyPayment(stub, args)
+	} else if function == "createProgram" {
+		return t.createProgram(stub, args)
+	} else if function == "updateProgramParticipant" {
+		return t.updateProgramParticipant(stub, args)
+	} else if function == "closeProgram" {
+		return t.closeProgram(stub, args)
+	} else if function == "createProgramPaymentRequest" {
+		return t.createProgramPaymentRequest(stub, args)
+	} else if function == "setCreditLimit" {
+		return t.setCreditLimit(stub, args)
+	} else if function == "accrue" || function == "markOverdue" {
+		return t.accrue(stub, args)
+	} else if function == "declareDefault" {
+		return t.declareDefault(stub, args)
+	} else if function == "acceptRecourse" {
+		return t.acceptRecourse(stub, args)
+	} else if function == "raiseDispute" {
+		return t.raiseDispute(stub, args)
+	} else if function == "resolveDispute" {
+		return t.resolveDispute(stub, args)
+	} else if function == "transferReceivable" {
+		return t.transferReceivable(stub, args)
+	} else if function == "splitReceivable" {
+		return t.splitReceivable(stub, args)
+	} else if function == "transferUnits" {
+		return t.transferUnits(stub, args)
+	} else if function == "settle" {
+		return t.settle(stub, args)
+	} else if function == "depositCash" {
+		return t.depositCash(stub, args)
+	} else if function == "withdrawCash" {
+		return t.withdrawCash(stub, args)
+	} else if function == "fundPayment" {
+		return t.fundPayment(stub, args)
+	} else if function == "repayPayment" {
+		return t.repayPayment(stub, args)
+	} else if function == "runNettingCycle" {
+		return t.runNettingCycle(stub, args)
+	} else if function == "postFxRate" {
+		return t.postFxRate(stub, args)
+	} else if function == "setBaseCurrency" {
+		return t.setBaseCurrency(stub, args)
+	} else if function == "setInvoiceCurrency" {
+		return t.setInvoiceCurrency(stub, args)
+	} else if function == "setConfig" {
+		return t.setConfig(stub, args)
+	} else if function == "pause" {
+		return t.pause(stub, args)
+	} else if function == "unpause" {
+		return t.unpause(stub, args)
+	} else if function == "freeze" {
+		return t.freeze(stub, args)
+	} else if function == "setApprovalPolicy" {
+		return t.setApprovalPolicy(stub, args)
+	} else if function == "setApprover" {
+		return t.setApprover(stub, args)
+	} else if function == "delegate" {
+		return t.delegate(stub, args)
+	} else if function == "revokeDelegation" {
+		return t.revokeDelegation(stub, args)
+	} else if function == "registerCert" {
+		return t.registerCert(stub, args)
+	} else if function == "rotateCert" {
+		return t.rotateCert(stub, args)
+	} else if function == "revokeCert" {
+		return t.revokeCert(stub, args)
+	} else if function == "migrateCertFingerprints" {
+		return t.migrateCertFingerprints(stub, args)
 	}
 
 	return nil, errors.New("Received unknown function invocation")
@@ -577,7 +1236,10 @@ func (t *AssetManagementChaincode) invoice_info(stub shim.ChaincodeStubInterface
 		return nil, fmt.Errorf("Invalid real buyer. Nil")
 	}
 
-	ok := bytes.Equal(buyer, realBuyer)
+	ok, err := isParticipantCert(stub, row.Columns[7].GetInt32(), realBuyer, buyer)
+	if err != nil {
+		return nil, err
+	}
 
 	if ok != true {
 		return nil, fmt.Errorf("Caller is not allowed to do this operation")	
@@ -590,9 +1252,44 @@ func (t *AssetManagementChaincode) invoice_info(stub shim.ChaincodeStubInterface
 	status := row.Columns[2].GetString_()
 	price := row.Columns[1].GetInt32()
 
+	lines, err := getInvoiceLines(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+
+	matchJson, err := invoiceMatchJson(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	deliveryJson, err := invoiceDeliveryJson(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	currency, err := getInvoiceCurrency(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	overdue, err := overdueJson(stub, documentEntityInvoice, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	netted, err := nettingJson(stub, documentEntityInvoice, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	approvals, err := approvalsJson(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	adjustment, err := invoiceAdjustmentJson(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+
 	jsonResp := `{"invoice":"` + strconv.Itoa(int(number)) + `","price":"` + strconv.Itoa(int(price)) + `",` +
 		`"delivery_date":"` + deliveryDate + `","request_date":"` + requestDate +
-		`","payment_date":"` + paymentDate + `","status":"` + status +`"}`
+		`","payment_date":"` + paymentDate + `","status":"` + status + `","currency":"` + currency + `",` +
+		invoiceLinesJson(lines) + adjustment + matchJson + deliveryJson + overdue + netted + approvals + `}`
 	
 	fmt.Println(jsonResp)
 	fmt.Println("Query invoice...done!")
@@ -648,7 +1345,10 @@ func (t *AssetManagementChaincode) payment_info(stub shim.ChaincodeStubInterface
 					return nil, fmt.Errorf("Invalid real payer. Nil")
 				}
 
-				ok := bytes.Equal(payer, realPayer)
+				ok, err := isParticipantCert(stub, oldPayerId, realPayer, payer)
+				if err != nil {
+					return nil, err
+				}
 
 				if ok != true {
 					return nil, fmt.Errorf("Payment request already has payer")	
@@ -660,8 +1360,38 @@ func (t *AssetManagementChaincode) payment_info(stub shim.ChaincodeStubInterface
 	status := row.Columns[5].GetString_()
 
 
+	faceValue, payout, err := paymentAmounts(stub, row)
+	if err != nil {
+		return nil, err
+	}
+	overdue, err := overdueJson(stub, documentEntityPayment, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	defaulted, err := defaultJson(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	netted, err := nettingJson(stub, documentEntityPayment, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	currency, err := settlementCurrency(stub, invoice)
+	if err != nil {
+		return nil, err
+	}
+	conversions, err := conversionsJson(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	fee, err := feeJson(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+
 	jsonResp := `{"invoice":"` + strconv.Itoa(int(invoice)) + `","paymentId":"` + strconv.Itoa(int(payment)) + `",` +
-		`"discountRate":"` + strconv.Itoa(int(discountRate)) + `"status":"` + status +`"}`
+		`"discountRate":"` + strconv.Itoa(int(discountRate)) + `","status":"` + status + `",` +
+		`"face_value":"` + strconv.FormatInt(faceValue, 10) + `","payout":"` + strconv.FormatInt(payout, 10) + `","currency":` + jsonString(currency) + overdue + defaulted + netted + conversions + fee + `}`
 	
 	fmt.Println(jsonResp)
 	fmt.Println("Query payment request...done!")
@@ -682,6 +1412,42 @@ func (t *AssetManagementChaincode) Query(stub shim.ChaincodeStubInterface, funct
 	} else if function == "payment_info" {
 		// Get payment_info
 		return t.payment_info(stub, args)
+	} else if function == "order_info" {
+		return t.order_info(stub, args)
+	} else if function == "verifyDocument" {
+		return t.verifyDocument(stub, args)
+	} else if function == "paymentInitiation" {
+		return t.paymentInitiation(stub, args)
+	} else if function == "reconciliation_info" {
+		return t.reconciliation_info(stub, args)
+	} else if function == "offer_info" {
+		return t.offer_info(stub, args)
+	} else if function == "program_info" {
+		return t.program_info(stub, args)
+	} else if function == "exposure" {
+		return t.exposure(stub, args)
+	} else if function == "dispute_info" {
+		return t.dispute_info(stub, args)
+	} else if function == "receivable_info" {
+		return t.receivable_info(stub, args)
+	} else if function == "holdings" {
+		return t.holdings(stub, args)
+	} else if function == "cash_balance" {
+		return t.cash_balance(stub, args)
+	} else if function == "netting_info" {
+		return t.netting_info(stub, args)
+	} else if function == "fx_rate" {
+		return t.fx_rate(stub, args)
+	} else if function == "getConfig" {
+		return t.getConfig(stub, args)
+	} else if function == "control_status" {
+		return t.control_status(stub, args)
+	} else if function == "approval_policy" {
+		return t.approval_policy(stub, args)
+	} else if function == "delegations" {
+		return t.delegations(stub, args)
+	} else if function == "participant_certs" {
+		return t.participant_certs(stub, args)
 	}
 
 	return nil, errors.New("Received unknown function invocation")
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPaymentAmounts(t *testing.T) {
+	_, stub := assignedRequest(t)
+	checkPaymentAmounts(t, "discount rate", stub, 100000, 98000)
+}
+
+// checkPaymentAmounts compares the face value and payout of payment request
+// 7 with the expected amounts.
+func checkPaymentAmounts(t *testing.T, name string, stub *testStub, faceValue int64, payout int64) {
+	gotFaceValue, gotPayout, err := paymentAmounts(stub, paymentRequest(t, stub, 7))
+	if err != nil {
+		t.Errorf("%s: %s", name, err)
+		return
+	}
+	if gotFaceValue != faceValue || gotPayout != payout {
+		t.Errorf("%s: got face value %d and payout %d, want %d and %d",
+			name, gotFaceValue, gotPayout, faceValue, payout)
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Unit of the settlement ledger for invoices without a currency.
+const settlementToken = "STL"
+
+func createCashTables(stub shim.ChaincodeStubInterface) error {
+	// Participant cash accounts of the settlement ledger, one per currency
+	err := stub.CreateTable("CashAccount", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Balance", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating CashAccount table.")
+	}
+
+	// Funding or repayment held while the invoice is under dispute
+	err = stub.CreateTable("Escrow", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Leg", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "FromId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Escrow table.")
+	}
+
+	// Platform fee taken from the payout of a funded payment request
+	err = stub.CreateTable("PaymentFee", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "FeeRate", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "FeeAccount", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PaymentFee table.")
+	}
+
+	return nil
+}
+
+// settlementCurrency returns the currency the payment requests of an
+// invoice settle in on the ledger.
+func settlementCurrency(stub shim.ChaincodeStubInterface, number int32) (string, error) {
+	currency, err := getInvoiceCurrency(stub, number)
+	if err != nil {
+		return "", err
+	}
+	if currency == "" {
+		return settlementToken, nil
+	}
+	return currency, nil
+}
+
+func getCashAccountRow(stub shim.ChaincodeStubInterface, participantId int32, currency string) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: participantId}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: currency}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow("CashAccount", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving %s cash account of participant [%d]: [%s]", currency, participantId, err)
+	}
+	return row, nil
+}
+
+// creditCash adds an amount to a cash account, opening it for the given
+// owner cert when it does not exist yet.
+func creditCash(stub shim.ChaincodeStubInterface, participantId int32, currency string, amount int64, owner []byte) error {
+	account, err := getCashAccountRow(stub, participantId, currency)
+	if err != nil {
+		return err
+	}
+
+	if len(account.Columns) == 0 {
+		if len(owner) != 0 {
+			owner = identityOf(owner)
+		}
+		_, err = stub.InsertRow("CashAccount", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: participantId}},
+				&shim.Column{Value: &shim.Column_String_{String_: currency}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: owner}},
+			},
+		})
+	} else {
+		account.Columns[2] = &shim.Column{Value: &shim.Column_Int64{Int64: account.Columns[2].GetInt64() + amount}}
+		_, err = stub.ReplaceRow("CashAccount", account)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed crediting %s cash account of participant [%d]: [%s]", currency, participantId, err)
+	}
+	return nil
+}
+
+// debitCash removes an amount from a cash account and fails when the
+// balance is not sufficient.
+func debitCash(stub shim.ChaincodeStubInterface, participantId int32, currency string, amount int64) error {
+	account, err := getCashAccountRow(stub, participantId, currency)
+	if err != nil {
+		return err
+	}
+	if len(account.Columns) == 0 || account.Columns[2].GetInt64() < amount {
+		return fmt.Errorf("Insufficient %s balance of participant [%d]", currency, participantId)
+	}
+
+	account.Columns[2] = &shim.Column{Value: &shim.Column_Int64{Int64: account.Columns[2].GetInt64() - amount}}
+	_, err = stub.ReplaceRow("CashAccount", account)
+	if err != nil {
+		return fmt.Errorf("Failed debiting %s cash account of participant [%d]: [%s]", currency, participantId, err)
+	}
+	return nil
+}
+
+// isDisputed checks whether an invoice has an open dispute.
+func isDisputed(stub shim.ChaincodeStubInterface, number int32) (bool, error) {
+	dispute, err := getDisputeRow(stub, number)
+	if err != nil {
+		return false, err
+	}
+	return len(dispute.Columns) != 0 && dispute.Columns[5].GetString_() == "Open", nil
+}
+
+func holdEscrow(stub shim.ChaincodeStubInterface, payment int32, leg string, fromId int32, amount int64, currency string) error {
+	ok, err := stub.InsertRow("Escrow", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_String_{String_: leg}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: fromId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Held"}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed holding %s of payment request [%d] in escrow: [%s]", leg, payment, err)
+	}
+	if !ok {
+		return fmt.Errorf("The %s of payment request [%d] is already in escrow", leg, payment)
+	}
+	return nil
+}
+
+// chargeFee records the platform fee on the payout of a payment request and
+// pays it to the fee account. Nothing is charged unless both a fee rate and
+// a fee account are configured.
+func chargeFee(stub shim.ChaincodeStubInterface, paymentRow shim.Row, payout int64, currency string) (int64, error) {
+	feeRate, err := configValue(stub, configFeeRate)
+	if err != nil {
+		return 0, err
+	}
+	feeAccount, err := configValue(stub, configFeeAccount)
+	if err != nil {
+		return 0, err
+	}
+	fee := payout * feeRate / 10000
+	if fee == 0 || feeAccount == 0 {
+		return 0, nil
+	}
+
+	payment := paymentRow.Columns[0].GetInt32()
+	_, err = stub.InsertRow("PaymentFee", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: feeRate}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(feeAccount)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: fee}},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed recording fee of payment request [%d]: [%s]", payment, err)
+	}
+	err = payFunds(stub, legDisbursement, payment, paymentRow.Columns[3].GetInt32(), int32(feeAccount), fee, currency, nil)
+	if err != nil {
+		return 0, err
+	}
+	return fee, nil
+}
+
+// disburseCash credits the payout of a payment request, less the platform
+// fee, to the supplier and marks the request funded.
+func disburseCash(stub shim.ChaincodeStubInterface, paymentRow shim.Row, amount int64, currency string) error {
+	invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return err
+	}
+	fee, err := chargeFee(stub, paymentRow, amount, currency)
+	if err != nil {
+		return err
+	}
+	err = payFunds(stub, legDisbursement, paymentRow.Columns[0].GetInt32(), paymentRow.Columns[3].GetInt32(),
+		invoiceRow.Columns[6].GetInt32(), amount-fee, currency, invoiceRow.Columns[8].GetBytes())
+	if err != nil {
+		return err
+	}
+	return setPaymentRequestStatus(stub, paymentRow, "Funded")
+}
+
+// feeJson renders the platform fee charged on a payment request, if any.
+func feeJson(stub shim.ChaincodeStubInterface, payment int32) (string, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentFee", columns)
+	if err != nil {
+		return "", fmt.Errorf("Failed retrieving fee of payment request [%d]: [%s]", payment, err)
+	}
+	if len(row.Columns) == 0 {
+		return "", nil
+	}
+	return `,"fee":{"rate":"` + strconv.FormatInt(row.Columns[1].GetInt64(), 10) +
+		`","feeAccount":"` + strconv.Itoa(int(row.Columns[2].GetInt32())) +
+		`","amount":"` + strconv.FormatInt(row.Columns[3].GetInt64(), 10) + `"}`, nil
+}
+
+// repayCash settles a payment request and credits the repayment to the
+// holders of its receivable, or to the payer when none was minted.
+func repayCash(stub shim.ChaincodeStubInterface, paymentRow shim.Row, fromId int32, amount int64, currency string, date string) error {
+	payment := paymentRow.Columns[0].GetInt32()
+	err := settlePayment(stub, paymentRow, amount, date)
+	if err != nil {
+		return err
+	}
+
+	shares, holders, err := getDistribution(stub, payment)
+	if err != nil {
+		return err
+	}
+	if len(holders) == 0 {
+		return payFunds(stub, legRepayment, payment, fromId, paymentRow.Columns[3].GetInt32(), amount, currency, paymentRow.Columns[4].GetBytes())
+	}
+	_, owner, err := receivableHolder(stub, paymentRow)
+	if err != nil {
+		return err
+	}
+	for _, holderId := range holders {
+		holder := owner
+		holding, err := getUnitHoldingRow(stub, payment, holderId)
+		if err != nil {
+			return err
+		}
+		if len(holding.Columns) != 0 {
+			holder = holding.Columns[3].GetBytes()
+		}
+		err = payFunds(stub, legRepayment, payment, fromId, holderId, shares[holderId], currency, holder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseEscrow releases the funds held for the payment requests of an
+// invoice once its dispute is resolved: to the supplier or the receivable
+// holders, or back to the payer when the invoice was cancelled.
+func releaseEscrow(stub shim.ChaincodeStubInterface, number int32, cancelled bool) error {
+	payments, err := getInvoicePayments(stub, number)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, payment := range payments {
+		for _, leg := range []string{legDisbursement, legRepayment} {
+			var columns []shim.Column
+			col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+			col2 := shim.Column{Value: &shim.Column_String_{String_: leg}}
+			columns = append(columns, col1, col2)
+
+			escrow, err := stub.GetRow("Escrow", columns)
+			if err != nil {
+				return fmt.Errorf("Failed retrieving escrow of payment request [%d]: [%s]", payment, err)
+			}
+			if len(escrow.Columns) == 0 || escrow.Columns[5].GetString_() != "Held" {
+				continue
+			}
+			fromId := escrow.Columns[2].GetInt32()
+			amount := escrow.Columns[3].GetInt64()
+			currency := escrow.Columns[4].GetString_()
+
+			paymentRow, err := getPaymentRequestRow(stub, payment)
+			if err != nil {
+				return err
+			}
+			status := "Released"
+			if cancelled {
+				status = "Refunded"
+				err = creditCash(stub, fromId, currency, amount, nil)
+			} else if leg == legDisbursement {
+				err = disburseCash(stub, paymentRow, amount, currency)
+			} else {
+				err = repayCash(stub, paymentRow, fromId, amount, currency, now.Format(dateLayout))
+			}
+			if err != nil {
+				return err
+			}
+
+			escrow.Columns[5] = &shim.Column{Value: &shim.Column_String_{String_: status}}
+			_, err = stub.ReplaceRow("Escrow", escrow)
+			if err != nil {
+				return fmt.Errorf("Failed releasing escrow of payment request [%d]: [%s]", payment, err)
+			}
+		}
+	}
+	return nil
+}
+
+// depositCash credits a participant cash account with funds received by a
+// bank. The first deposit opens the account for the given owner cert.
+func (t *AssetManagementChaincode) depositCash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Deposit cash...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("depositCash", throwError), throwError
+	}
+	currency := args[1]
+	if currency == "" {
+		return nil, errors.New("Expecting a currency")
+	}
+	amount, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || amount <= 0 {
+		throwError := errors.New("Expecting positive integer value for amount")
+		return errorJson("depositCash", throwError), throwError
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+	bank, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding bank")
+	}
+
+	err = requireRole(stub, roleBank, bank)
+	if err != nil {
+		return nil, err
+	}
+
+	err = creditCash(stub, int32(participantId), currency, amount, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Deposit cash...done!")
+
+	return nil, nil
+}
+
+// withdrawCash debits a participant cash account for funds paid out off the
+// ledger. Only the owner of the account can call this function.
+func (t *AssetManagementChaincode) withdrawCash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Withdraw cash...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("withdrawCash", throwError), throwError
+	}
+	currency := args[1]
+	amount, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || amount <= 0 {
+		throwError := errors.New("Expecting positive integer value for amount")
+		return errorJson("withdrawCash", throwError), throwError
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	account, err := getCashAccountRow(stub, int32(participantId), currency)
+	if err != nil {
+		return nil, err
+	}
+	if len(account.Columns) == 0 {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	err = requireParticipantCert(stub, int32(participantId), account.Columns[3].GetBytes(), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	err = debitCash(stub, int32(participantId), currency, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Withdraw cash...done!")
+
+	return nil, nil
+}
+
+// fundPayment moves the discounted payout of an assigned payment request
+// from the payer cash account to the supplier and marks it funded. While the
+// invoice is under dispute the payout is held in escrow instead. With a token
+// chaincode configured at Init the payout is transferred there.
+func (t *AssetManagementChaincode) fundPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Fund payment request...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("fundPayment", throwError), throwError
+	}
+	payer, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding payer")
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, paymentRow.Columns[3].GetInt32(), paymentRow.Columns[4].GetBytes(), payer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	if paymentRow.Columns[5].GetString_() != "Assigned" {
+		return nil, fmt.Errorf("Payment request [%d] is %s", payment, paymentRow.Columns[5].GetString_())
+	}
+
+	number := paymentRow.Columns[1].GetInt32()
+	invoiceRow, err := getInvoiceRow(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	if invoiceRow.Columns[2].GetString_() == "Cancelled" {
+		return nil, fmt.Errorf("Invoice [%d] was cancelled", number)
+	}
+	err = requireNotFrozen(stub, invoiceRow, paymentRow.Columns[3].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+	currency, err := settlementCurrency(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	_, payout, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+
+	payerId := paymentRow.Columns[3].GetInt32()
+	err = takeFunds(stub, number, payerId, payout, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	disputed, err := isDisputed(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	if disputed {
+		err = holdEscrow(stub, int32(payment), legDisbursement, payerId, payout, currency)
+	} else {
+		err = disburseCash(stub, paymentRow, payout, currency)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Fund payment request...done!")
+
+	return nil, nil
+}
+
+// repayPayment moves the face value of a funded payment request from the
+// buyer cash account to the holders of its receivable and settles it. While
+// the invoice is under dispute the repayment is held in escrow instead. With
+// a token chaincode configured at Init the repayment is transferred there.
+func (t *AssetManagementChaincode) repayPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Repay payment request...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("repayPayment", throwError), throwError
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	number := paymentRow.Columns[1].GetInt32()
+	invoiceRow, err := getInvoiceRow(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, invoiceRow.Columns[7].GetInt32(), invoiceRow.Columns[9].GetBytes(), buyer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	if paymentRow.Columns[5].GetString_() != "Funded" {
+		return nil, fmt.Errorf("Payment request [%d] is %s", payment, paymentRow.Columns[5].GetString_())
+	}
+
+	currency, err := settlementCurrency(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	faceValue, _, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+
+	buyerId := invoiceRow.Columns[7].GetInt32()
+	err = takeFunds(stub, number, buyerId, faceValue, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	disputed, err := isDisputed(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if disputed {
+		err = holdEscrow(stub, int32(payment), legRepayment, buyerId, faceValue, currency)
+	} else {
+		err = repayCash(stub, paymentRow, buyerId, faceValue, currency, now.Format(dateLayout))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Repay payment request...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) cash_balance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query cash balance...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("cash_balance", throwError), throwError
+	}
+	currency := args[1]
+
+	account, err := getCashAccountRow(stub, int32(participantId), currency)
+	if err != nil {
+		return nil, err
+	}
+	var balance int64
+	if len(account.Columns) != 0 {
+		balance = account.Columns[2].GetInt64()
+	}
+
+	jsonResp := `{"participantId":"` + strconv.Itoa(participantId) + `","currency":` + jsonString(currency) +
+		`,"balance":"` + strconv.FormatInt(balance, 10) + `"}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query cash balance...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestReleaseEscrow(t *testing.T) {
+	tests := []struct {
+		name      string
+		leg       string
+		fromId    int32
+		amount    int64
+		status    string
+		cancelled bool
+		balances  map[int32]int64
+		escrow    string
+		payment   string
+	}{
+		{
+			name:     "funding released to the supplier",
+			leg:      legDisbursement,
+			fromId:   5,
+			amount:   98000,
+			balances: map[int32]int64{3: 98000, 4: 0, 5: 0},
+			escrow:   "Released",
+			payment:  "Funded",
+		},
+		{
+			name:      "funding refunded to the funder",
+			leg:       legDisbursement,
+			fromId:    5,
+			amount:    98000,
+			cancelled: true,
+			balances:  map[int32]int64{3: 0, 4: 0, 5: 98000},
+			escrow:    "Refunded",
+			payment:   "Assigned",
+		},
+		{
+			name:     "repayment released to the receivable owner",
+			leg:      legRepayment,
+			fromId:   4,
+			amount:   100000,
+			balances: map[int32]int64{3: 0, 4: 0, 5: 100000},
+			escrow:   "Released",
+			payment:  "Settled",
+		},
+		{
+			name:      "repayment refunded to the buyer",
+			leg:       legRepayment,
+			fromId:    4,
+			amount:    100000,
+			cancelled: true,
+			balances:  map[int32]int64{3: 0, 4: 100000, 5: 0},
+			escrow:    "Refunded",
+			payment:   "Assigned",
+		},
+		{
+			name:     "escrow already released",
+			leg:      legDisbursement,
+			fromId:   5,
+			amount:   98000,
+			status:   "Released",
+			balances: map[int32]int64{3: 0, 4: 0, 5: 0},
+			escrow:   "Released",
+			payment:  "Assigned",
+		},
+	}
+
+	for _, test := range tests {
+		_, stub := assignedRequest(t)
+		stub.MockTransactionStart(test.name)
+		err := holdEscrow(stub, 7, test.leg, test.fromId, test.amount, settlementToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.status != "" {
+			escrow, _ := stub.GetRow("Escrow", escrowKey(7, test.leg))
+			escrow.Columns[5].Value = &shim.Column_String_{String_: test.status}
+			stub.ReplaceRow("Escrow", escrow)
+		}
+		err = releaseEscrow(stub, 1, test.cancelled)
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		balances := make(map[int32]int64)
+		for participantId := range test.balances {
+			balances[participantId] = cashBalance(t, stub, participantId)
+		}
+		if !reflect.DeepEqual(balances, test.balances) {
+			t.Errorf("%s: got balances %v, want %v", test.name, balances, test.balances)
+		}
+		escrow, err := stub.GetRow("Escrow", escrowKey(7, test.leg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := escrow.Columns[5].GetString_(); status != test.escrow {
+			t.Errorf("%s: got escrow %s, want %s", test.name, status, test.escrow)
+		}
+		if status := paymentRequest(t, stub, 7).Columns[5].GetString_(); status != test.payment {
+			t.Errorf("%s: got payment request %s, want %s", test.name, status, test.payment)
+		}
+	}
+}
+
+func escrowKey(payment int32, leg string) []shim.Column {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: leg}}
+	columns = append(columns, col1, col2)
+	return columns
+}
+
+func TestFundAndRepay(t *testing.T) {
+	cc, stub := assignedRequest(t)
+	stub.invoke(t, cc, "addRole", roleBank, encodeCert("bank"), encodeCert("admin"))
+	stub.invoke(t, cc, "depositCash", "5", settlementToken, "50000", encodeCert("funder"), encodeCert("bank"))
+
+	stub.MockTransactionStart("insufficient funds")
+	_, err := cc.Invoke(stub, "fundPayment", []string{"7", encodeCert("funder")})
+	stub.MockTransactionEnd("insufficient funds")
+	if err == nil {
+		t.Error("expected funding beyond the funder balance to be rejected")
+	}
+	checkBalances(t, "insufficient funds", stub, map[int32]int64{3: 0, 4: 0, 5: 50000})
+
+	stub.invoke(t, cc, "depositCash", "5", settlementToken, "50000", encodeCert("funder"), encodeCert("bank"))
+	stub.invoke(t, cc, "fundPayment", "7", encodeCert("funder"))
+	checkBalances(t, "funded", stub, map[int32]int64{3: 98000, 4: 0, 5: 2000})
+	if status := paymentRequest(t, stub, 7).Columns[5].GetString_(); status != "Funded" {
+		t.Errorf("funded: got payment request %s, want Funded", status)
+	}
+
+	stub.invoke(t, cc, "depositCash", "4", settlementToken, "100000", encodeCert("buyer"), encodeCert("bank"))
+	stub.invoke(t, cc, "repayPayment", "7", encodeCert("buyer"))
+	checkBalances(t, "repaid", stub, map[int32]int64{3: 98000, 4: 0, 5: 102000})
+	if status := paymentRequest(t, stub, 7).Columns[5].GetString_(); status != "Settled" {
+		t.Errorf("repaid: got payment request %s, want Settled", status)
+	}
+}
+
+// checkBalances compares the settlement token balances of participants
+// with the expected amounts.
+func checkBalances(t *testing.T, name string, stub *testStub, balances map[int32]int64) {
+	for participantId, want := range balances {
+		if balance := cashBalance(t, stub, participantId); balance != want {
+			t.Errorf("%s: got balance %d for participant %d, want %d", name, balance, participantId, want)
+		}
+	}
+}
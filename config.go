@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Platform parameters an admin can change with setConfig.
+const (
+	// Highest discount rate of a payment request, in percent
+	configMaxDiscountRate = "maxDiscountRate"
+	// Days from the request to the invoice due date a payment request may
+	// finance; a zero max tenor means no limit
+	configMinTenor = "minTenor"
+	configMaxTenor = "maxTenor"
+	// Platform fee on the payout of a funded payment request, in basis
+	// points, credited to the fee account participant
+	configFeeRate    = "feeRate"
+	configFeeAccount = "feeAccount"
+	// Days after its creation a payment request can still be assigned; zero
+	// means it does not expire
+	configPaymentRequestExpiry = "paymentRequestExpiry"
+	// Hours a new payment request is offered to all funders before the first
+	// of them can take it; zero means it can be assigned at once
+	configAuctionWindow = "auctionWindow"
+	// Days after the due date before a funder can declare a buyer default
+	configDefaultGraceDays = "defaultGraceDays"
+)
+
+// configRange returns the default and the allowed range of a platform
+// parameter, and false for unknown parameters.
+func configRange(name string) (int64, int64, int64, bool) {
+	switch name {
+	case configMaxDiscountRate:
+		return 100, 0, 100, true
+	case configMinTenor, configMaxTenor, configPaymentRequestExpiry:
+		return 0, 0, 3650, true
+	case configFeeRate:
+		return 0, 0, 10000, true
+	case configFeeAccount:
+		return 0, 0, 2147483647, true
+	case configDefaultGraceDays:
+		return 30, 0, 3650, true
+	case configAuctionWindow:
+		return 0, 0, 720, true
+	}
+	return 0, 0, 0, false
+}
+
+func configNames() []string {
+	names := []string{configMaxDiscountRate, configMinTenor, configMaxTenor, configFeeRate,
+		configFeeAccount, configPaymentRequestExpiry, configDefaultGraceDays, configAuctionWindow}
+	sort.Strings(names)
+	return names
+}
+
+func createConfigTables(stub shim.ChaincodeStubInterface) error {
+	// Current value of the parameters set by an admin
+	err := stub.CreateTable("Config", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Name", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Value", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Version", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Config table.")
+	}
+
+	// Every value a parameter had, by version
+	err = stub.CreateTable("ConfigHistory", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Name", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Version", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Value", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Date", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "AdminCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating ConfigHistory table.")
+	}
+
+	return nil
+}
+
+func getConfigRow(stub shim.ChaincodeStubInterface, name string) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: name}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("Config", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving parameter [%s]: [%s]", name, err)
+	}
+	return row, nil
+}
+
+// configValue returns the current value of a platform parameter, or its
+// default when it was never set.
+func configValue(stub shim.ChaincodeStubInterface, name string) (int64, error) {
+	value, _, _, ok := configRange(name)
+	if !ok {
+		return 0, fmt.Errorf("Unknown parameter [%s]", name)
+	}
+	row, err := getConfigRow(stub, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(row.Columns) != 0 {
+		value = row.Columns[1].GetInt64()
+	}
+	return value, nil
+}
+
+// checkTenor fails when the days from a date to the due date of an invoice
+// are outside the platform tenor bounds, if any are set.
+func checkTenor(stub shim.ChaincodeStubInterface, from time.Time, dueDate string) error {
+	minTenor, err := configValue(stub, configMinTenor)
+	if err != nil {
+		return err
+	}
+	maxTenor, err := configValue(stub, configMaxTenor)
+	if err != nil {
+		return err
+	}
+	if minTenor == 0 && maxTenor == 0 {
+		return nil
+	}
+
+	due, err := parseDate(dueDate)
+	if err != nil {
+		return err
+	}
+	days := daysBetween(from, due)
+	if days < minTenor {
+		return fmt.Errorf("Tenor of %d days is below the minimum of %d days", days, minTenor)
+	}
+	if maxTenor > 0 && days > maxTenor {
+		return fmt.Errorf("Tenor of %d days exceeds the maximum of %d days", days, maxTenor)
+	}
+	return nil
+}
+
+// checkPaymentExpiry fails when a payment request is assigned after the
+// expiry period following its creation, if one is set. Requests created
+// before their creation time was recorded count from the invoice request date.
+func checkPaymentExpiry(stub shim.ChaincodeStubInterface, payment int32, invoiceRow shim.Row) error {
+	expired, err := paymentExpired(stub, payment, invoiceRow)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return fmt.Errorf("Payment request [%d] has expired", payment)
+	}
+	return nil
+}
+
+// paymentExpired tells whether the expiry period following the creation of
+// a payment request is over, if one is set.
+func paymentExpired(stub shim.ChaincodeStubInterface, payment int32, invoiceRow shim.Row) (bool, error) {
+	expiry, err := configValue(stub, configPaymentRequestExpiry)
+	if err != nil || expiry == 0 {
+		return false, err
+	}
+
+	created, ok, err := paymentRequestCreated(stub, payment)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		created, err = parseDate(invoiceRow.Columns[4].GetString_())
+		if err != nil {
+			return false, err
+		}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return false, err
+	}
+	return daysBetween(created, now) > expiry, nil
+}
+
+// paymentRequestCreated returns the transaction time a payment request was
+// created at, and false for requests created before it was recorded.
+func paymentRequestCreated(stub shim.ChaincodeStubInterface, payment int32) (time.Time, bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentRequestTime", columns)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Failed retrieving creation of payment request [%d]: [%s]", payment, err)
+	}
+	if len(row.Columns) == 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(row.Columns[1].GetInt64(), 0).UTC(), true, nil
+}
+
+// checkAuctionWindow fails when a payment request is assigned before the
+// auction window following its creation has closed, if one is set.
+func checkAuctionWindow(stub shim.ChaincodeStubInterface, payment int32) error {
+	window, err := configValue(stub, configAuctionWindow)
+	if err != nil || window == 0 {
+		return err
+	}
+
+	created, ok, err := paymentRequestCreated(stub, payment)
+	if err != nil || !ok {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	closes := created.Add(time.Duration(window) * time.Hour)
+	if now.Before(closes) {
+		return fmt.Errorf("Payment request [%d] is offered to funders until %s", payment, closes.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// setConfig changes a platform parameter. Only a certificate holding the
+// admin role can call this function. Each change gets the next version of
+// the parameter and is kept in its history.
+func (t *AssetManagementChaincode) setConfig(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set config...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	name := args[0]
+	_, min, max, ok := configRange(name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown parameter [%s]", name)
+	}
+	value, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		throwError := errors.New("Expecting integer value for parameter")
+		return errorJson("setConfig", throwError), throwError
+	}
+	if value < min || value > max {
+		return nil, fmt.Errorf("Parameter [%s] must be between %d and %d", name, min, max)
+	}
+	admin, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding admin")
+	}
+
+	err = requireRole(stub, roleAdmin, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tenor bounds must stay consistent with each other
+	if name == configMinTenor || name == configMaxTenor {
+		minTenor, maxTenor := value, value
+		if name == configMinTenor {
+			maxTenor, err = configValue(stub, configMaxTenor)
+		} else {
+			minTenor, err = configValue(stub, configMinTenor)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if maxTenor > 0 && minTenor > maxTenor {
+			return nil, errors.New("Minimum tenor exceeds the maximum tenor")
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := getConfigRow(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	version := int32(1)
+	if len(current.Columns) != 0 {
+		version = current.Columns[2].GetInt32() + 1
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: name}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: value}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: version}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("Config", row)
+	} else {
+		_, err = stub.ReplaceRow("Config", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing parameter [%s]: [%s]", name, err)
+	}
+
+	_, err = stub.InsertRow("ConfigHistory", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: name}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: version}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: value}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(admin)}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed recording history of parameter [%s]: [%s]", name, err)
+	}
+
+	fmt.Printf("Parameter [%s] set to %d, version %d\n", name, value, version)
+	fmt.Println("Set config...done!")
+
+	return nil, nil
+}
+
+// configJson renders the current value of a parameter and its version,
+// zero for a default that was never changed.
+func configJson(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	value, err := configValue(stub, name)
+	if err != nil {
+		return "", err
+	}
+	row, err := getConfigRow(stub, name)
+	if err != nil {
+		return "", err
+	}
+	version := int32(0)
+	if len(row.Columns) != 0 {
+		version = row.Columns[2].GetInt32()
+	}
+	return `{"name":"` + name + `","value":"` + strconv.FormatInt(value, 10) +
+		`","version":"` + strconv.Itoa(int(version)) + `"`, nil
+}
+
+// getConfig returns all platform parameters, or one parameter with the
+// history of its changes.
+func (t *AssetManagementChaincode) getConfig(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query config...")
+
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	var jsonResp string
+	if len(args) == 0 {
+		jsonResp = `{"parameters":[`
+		for i, name := range configNames() {
+			entry, err := configJson(stub, name)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				jsonResp += `,`
+			}
+			jsonResp += entry + `}`
+		}
+		jsonResp += `]}`
+	} else {
+		name := args[0]
+		entry, err := configJson(stub, name)
+		if err != nil {
+			return nil, err
+		}
+
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_String_{String_: name}}
+		columns = append(columns, col1)
+
+		rows, err := stub.GetRows("ConfigHistory", columns)
+		if err != nil {
+			return nil, fmt.Errorf("Failed retrieving history of parameter [%s]: [%s]", name, err)
+		}
+		changes := make(map[int32]string)
+		var versions []int32
+		for row := range rows {
+			version := row.Columns[1].GetInt32()
+			changes[version] = `{"version":"` + strconv.Itoa(int(version)) +
+				`","value":"` + strconv.FormatInt(row.Columns[2].GetInt64(), 10) +
+				`","date":"` + row.Columns[3].GetString_() +
+				`","admin":"` + hex.EncodeToString(identityOf(row.Columns[4].GetBytes())) + `"}`
+			versions = append(versions, version)
+		}
+		sortInt32s(versions)
+
+		jsonResp = entry + `,"history":[`
+		for i, version := range versions {
+			if i > 0 {
+				jsonResp += `,`
+			}
+			jsonResp += changes[version]
+		}
+		jsonResp += `]}`
+	}
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query config...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		fails bool
+	}{
+		{name: "within the range", args: []string{configFeeRate, "50", encodeCert("admin")}},
+		{name: "above the range", args: []string{configFeeRate, "10001", encodeCert("admin")}, fails: true},
+		{name: "below the range", args: []string{configMaxDiscountRate, "-1", encodeCert("admin")}, fails: true},
+		{name: "unknown parameter", args: []string{"maxFee", "1", encodeCert("admin")}, fails: true},
+		{name: "not an admin", args: []string{configFeeRate, "50", encodeCert("buyer")}, fails: true},
+		{name: "min tenor over the max tenor", args: []string{configMinTenor, "91", encodeCert("admin")}, fails: true},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "setConfig", configMaxTenor, "90", encodeCert("admin"))
+
+		stub.MockTransactionStart(test.name)
+		_, err := cc.Invoke(stub, "setConfig", test.args)
+		stub.MockTransactionEnd(test.name)
+		if test.fails != (err != nil) {
+			t.Errorf("%s: got error %v, want an error: %t", test.name, err, test.fails)
+		}
+	}
+}
+
+func TestConfigHistory(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.invoke(t, cc, "setConfig", configFeeRate, "50", encodeCert("admin"))
+	stub.now = stub.now.Add(24 * time.Hour)
+	stub.invoke(t, cc, "setConfig", configFeeRate, "75", encodeCert("admin"))
+
+	stub.MockTransactionStart("getConfig")
+	config, err := cc.Query(stub, "getConfig", []string{configFeeRate})
+	stub.MockTransactionEnd("getConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`{"name":"feeRate","value":"75","version":"2"`,
+		`{"version":"1","value":"50","date":"2026-10-01"`,
+		`{"version":"2","value":"75","date":"2026-10-02"`,
+	} {
+		if !strings.Contains(string(config), want) {
+			t.Errorf("got config %s, want %s", config, want)
+		}
+	}
+}
+
+func TestPaymentRequestWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		after  time.Duration
+		fails  bool
+	}{
+		{name: "no auction window or expiry"},
+		{name: "auction window open", config: map[string]string{configAuctionWindow: "24"}, after: time.Hour, fails: true},
+		{name: "auction window closed", config: map[string]string{configAuctionWindow: "24"}, after: 25 * time.Hour},
+		{name: "before expiry", config: map[string]string{configPaymentRequestExpiry: "10"}, after: 10 * 24 * time.Hour},
+		{name: "expired", config: map[string]string{configPaymentRequestExpiry: "10"}, after: 11 * 24 * time.Hour, fails: true},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		for name, value := range test.config {
+			stub.invoke(t, cc, "setConfig", name, value, encodeCert("admin"))
+		}
+		stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+		stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+		stub.invoke(t, cc, "createPaymentRequest", "7", "1", "2", "2026-10-01", encodeCert("buyer"))
+		stub.now = stub.now.Add(test.after)
+
+		stub.MockTransactionStart(test.name)
+		_, err := cc.Invoke(stub, "assignPaymentRequest", []string{"7", "5", encodeCert("funder")})
+		stub.MockTransactionEnd(test.name)
+		if test.fails != (err != nil) {
+			t.Errorf("%s: got error %v, want an error: %t", test.name, err, test.fails)
+		}
+	}
+}
+
+func TestChargeFee(t *testing.T) {
+	tests := []struct {
+		name       string
+		feeRate    int64
+		feeAccount int32
+		payout     int64
+		fee        int64
+	}{
+		{name: "no fee configured", payout: 98000, fee: 0},
+		{name: "no fee account", feeRate: 50, payout: 98000, fee: 0},
+		{name: "fee rate and account", feeRate: 50, feeAccount: 9, payout: 98000, fee: 490},
+		{name: "fee rounded down to nothing", feeRate: 1, feeAccount: 9, payout: 99, fee: 0},
+		{name: "whole payout", feeRate: 10000, feeAccount: 9, payout: 98000, fee: 98000},
+	}
+
+	for _, test := range tests {
+		cc, stub := assignedRequest(t)
+		if test.feeRate != 0 {
+			stub.invoke(t, cc, "setConfig", configFeeRate, strconv.FormatInt(test.feeRate, 10), encodeCert("admin"))
+		}
+		if test.feeAccount != 0 {
+			stub.invoke(t, cc, "setConfig", configFeeAccount, strconv.Itoa(int(test.feeAccount)), encodeCert("admin"))
+		}
+
+		stub.MockTransactionStart(test.name)
+		fee, err := chargeFee(stub, paymentRequest(t, stub, 7), test.payout, settlementToken)
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if fee != test.fee {
+			t.Errorf("%s: got fee %d, want %d", test.name, fee, test.fee)
+		}
+		if balance := cashBalance(t, stub, 9); balance != test.fee {
+			t.Errorf("%s: got fee account balance %d, want %d", test.name, balance, test.fee)
+		}
+		recorded, err := feeJson(stub, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (recorded != "") != (test.fee != 0) {
+			t.Errorf("%s: got fee record %q for a fee of %d", test.name, recorded, test.fee)
+		}
+	}
+}
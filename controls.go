@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Entities an admin can freeze. Freezing the platform pauses it.
+const (
+	freezePlatform    = "platform"
+	freezeParticipant = "participant"
+	freezeInvoice     = "invoice"
+)
+
+func createFreezeTable(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("Freeze", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Entity", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "EntityId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Reason", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Date", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "AdminCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Freeze table.")
+	}
+	return nil
+}
+
+func freezeKey(entity string, id int32) []shim.Column {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: entity}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1, col2)
+	return columns
+}
+
+// getFreezeRow returns the freeze of an entity, or an empty row when it is
+// not frozen.
+func getFreezeRow(stub shim.ChaincodeStubInterface, entity string, id int32) (shim.Row, error) {
+	row, err := stub.GetRow("Freeze", freezeKey(entity, id))
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving freeze of %s [%d]: [%s]", entity, id, err)
+	}
+	return row, nil
+}
+
+// requireNotPaused fails while the platform is paused.
+func requireNotPaused(stub shim.ChaincodeStubInterface) error {
+	row, err := getFreezeRow(stub, freezePlatform, 0)
+	if err != nil {
+		return err
+	}
+	if len(row.Columns) != 0 {
+		return fmt.Errorf("Platform is paused: %s", row.Columns[2].GetString_())
+	}
+	return nil
+}
+
+// requireNotFrozen fails when financing of an invoice is blocked because the
+// invoice, its supplier or buyer, or any of the other participants involved
+// is frozen.
+func requireNotFrozen(stub shim.ChaincodeStubInterface, invoiceRow shim.Row, participants ...int32) error {
+	number := invoiceRow.Columns[0].GetInt32()
+	row, err := getFreezeRow(stub, freezeInvoice, number)
+	if err != nil {
+		return err
+	}
+	if len(row.Columns) != 0 {
+		return fmt.Errorf("Invoice [%d] is frozen: %s", number, row.Columns[2].GetString_())
+	}
+
+	participants = append([]int32{invoiceRow.Columns[6].GetInt32(), invoiceRow.Columns[7].GetInt32()}, participants...)
+	for _, participantId := range participants {
+		row, err := getFreezeRow(stub, freezeParticipant, participantId)
+		if err != nil {
+			return err
+		}
+		if len(row.Columns) != 0 {
+			return fmt.Errorf("Participant [%d] is frozen: %s", participantId, row.Columns[2].GetString_())
+		}
+	}
+	return nil
+}
+
+// setFreeze freezes or, with an empty reason, unfreezes an entity.
+func setFreeze(stub shim.ChaincodeStubInterface, entity string, id int32, reason string, admin []byte) error {
+	ok, err := isAdministrator(stub, admin)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Caller is not allowed to do this operation")
+	}
+
+	current, err := getFreezeRow(stub, entity, id)
+	if err != nil {
+		return err
+	}
+	if reason == "" {
+		if len(current.Columns) == 0 {
+			return fmt.Errorf("The %s [%d] is not frozen", entity, id)
+		}
+		err = stub.DeleteRow("Freeze", freezeKey(entity, id))
+		if err != nil {
+			return fmt.Errorf("Failed unfreezing %s [%d]: [%s]", entity, id, err)
+		}
+		return nil
+	}
+	if len(current.Columns) != 0 {
+		return fmt.Errorf("The %s [%d] is already frozen", entity, id)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	_, err = stub.InsertRow("Freeze", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: entity}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+			&shim.Column{Value: &shim.Column_String_{String_: reason}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(admin)}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed freezing %s [%d]: [%s]", entity, id, err)
+	}
+	return nil
+}
+
+// pause blocks every Invoke function except unpause until the platform is
+// unpaused. Queries are still answered. Only an admin can pause.
+func (t *AssetManagementChaincode) pause(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Pause...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	reason := args[0]
+	if reason == "" {
+		return nil, errors.New("Expecting a reason")
+	}
+	admin, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding admin")
+	}
+
+	err = setFreeze(stub, freezePlatform, 0, reason, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Pause...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) unpause(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Unpause...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	admin, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("Failed decoding admin")
+	}
+
+	err = setFreeze(stub, freezePlatform, 0, "", admin)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Unpause...done!")
+
+	return nil, nil
+}
+
+// freeze blocks the financing of an invoice or of every invoice a
+// participant is involved in, with the reason recorded. An empty reason
+// lifts the freeze. Only an admin can call this function.
+func (t *AssetManagementChaincode) freeze(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Freeze...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	entity := args[0]
+	if entity != freezeParticipant && entity != freezeInvoice {
+		return nil, fmt.Errorf("Unknown entity [%s]", entity)
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for id")
+		return errorJson("freeze", throwError), throwError
+	}
+	reason := args[2]
+	admin, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding admin")
+	}
+
+	err = setFreeze(stub, entity, int32(id), reason, admin)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Freeze...done!")
+
+	return nil, nil
+}
+
+func freezeJson(row shim.Row) string {
+	return `{"entity":"` + row.Columns[0].GetString_() +
+		`","id":"` + strconv.Itoa(int(row.Columns[1].GetInt32())) +
+		`","reason":` + jsonString(row.Columns[2].GetString_()) +
+		`,"date":"` + row.Columns[3].GetString_() + `"}`
+}
+
+// control_status reports whether the platform is paused and which
+// participants and invoices are frozen, or the freeze of a single entity.
+func (t *AssetManagementChaincode) control_status(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query control status...")
+
+	if len(args) != 0 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0 or 2")
+	}
+
+	if len(args) == 2 {
+		entity := args[0]
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			throwError := errors.New("Expecting integer value for id")
+			return errorJson("control_status", throwError), throwError
+		}
+		row, err := getFreezeRow(stub, entity, int32(id))
+		if err != nil {
+			return nil, err
+		}
+		jsonResp := `{"entity":` + jsonString(entity) + `,"id":"` + strconv.Itoa(id) + `","frozen":"false"}`
+		if len(row.Columns) != 0 {
+			jsonResp = `{"frozen":"true","freeze":` + freezeJson(row) + `}`
+		}
+		fmt.Println(jsonResp)
+		fmt.Println("Query control status...done!")
+		return []byte(jsonResp), nil
+	}
+
+	pause, err := getFreezeRow(stub, freezePlatform, 0)
+	if err != nil {
+		return nil, err
+	}
+	jsonResp := `{"paused":"` + strconv.FormatBool(len(pause.Columns) != 0) + `"`
+	if len(pause.Columns) != 0 {
+		jsonResp += `,"pause":` + freezeJson(pause)
+	}
+
+	jsonResp += `,"frozen":[`
+	count := 0
+	for _, entity := range []string{freezeInvoice, freezeParticipant} {
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_String_{String_: entity}}
+		columns = append(columns, col1)
+
+		rows, err := stub.GetRows("Freeze", columns)
+		if err != nil {
+			return nil, fmt.Errorf("Failed retrieving frozen %s list: [%s]", entity, err)
+		}
+		frozen := make(map[int32]string)
+		var ids []int32
+		for row := range rows {
+			frozen[row.Columns[1].GetInt32()] = freezeJson(row)
+			ids = append(ids, row.Columns[1].GetInt32())
+		}
+		sortInt32s(ids)
+
+		for _, id := range ids {
+			if count > 0 {
+				jsonResp += `,`
+			}
+			jsonResp += frozen[id]
+			count++
+		}
+	}
+	jsonResp += `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query control status...done!")
+
+	return []byte(jsonResp), nil
+}
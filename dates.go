@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Layout of the dates stored on invoices and payment requests.
+const dateLayout = "2006-01-02"
+
+func parseDate(value string) (time.Time, error) {
+	date, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return date, fmt.Errorf("Expecting date as YYYY-MM-DD, got [%s]", value)
+	}
+	return date, nil
+}
+
+// txTime returns the transaction timestamp, so that every peer computes
+// time-dependent values identically.
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil || timestamp == nil {
+		return time.Time{}, errors.New("Failed getting transaction timestamp")
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// daysBetween returns the number of calendar days from one date to another,
+// negative when to is before from.
+func daysBetween(from time.Time, to time.Time) int64 {
+	fromDay := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDay := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int64(toDay.Sub(fromDay).Hours()) / 24
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// isDelegable tells whether a principal can let a delegate call a function
+// on its behalf.
+func isDelegable(function string) bool {
+	switch function {
+	case "approveInvoice", "createPaymentRequest", "createProgramPaymentRequest":
+		return true
+	}
+	return false
+}
+
+func createDelegationTable(stub shim.ChaincodeStubInterface) error {
+	// Delegates allowed to act on behalf of a principal certificate for the
+	// comma separated functions, up to an amount cap (zero for no cap) and
+	// until an expiry date (empty for no expiry). Both certificates are kept
+	// as fingerprints
+	err := stub.CreateTable("Delegation", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "PrincipalCert", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "DelegateCert", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "Functions", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "AmountCap", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Expiry", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Date", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Delegation table.")
+	}
+	return nil
+}
+
+func delegationKey(principal []byte, delegate []byte) []shim.Column {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Bytes{Bytes: principal}}
+	col2 := shim.Column{Value: &shim.Column_Bytes{Bytes: delegate}}
+	columns = append(columns, col1, col2)
+	return columns
+}
+
+// actsFor tells whether a caller certificate can call a function for an
+// amount on behalf of a participant, whose certificate stored on the row
+// being authorized is principal: either it is a certificate of the
+// participant or it holds a delegation from one, covering the function and
+// the amount, that has not expired at the transaction time.
+func actsFor(stub shim.ChaincodeStubInterface, principalId int32, principal []byte, caller []byte, function string, amount int64) (bool, error) {
+	if len(caller) == 0 {
+		return false, nil
+	}
+	certs, err := participantCerts(stub, principalId, principal)
+	if err != nil {
+		return false, err
+	}
+
+	var row shim.Row
+	for _, cert := range certs {
+		if sameIdentity(cert, caller) {
+			return true, nil
+		}
+		row, err = stub.GetRow("Delegation", delegationKey(identityOf(cert), certFingerprint(caller)))
+		if err != nil {
+			return false, fmt.Errorf("Failed retrieving delegation: [%s]", err)
+		}
+		if len(row.Columns) != 0 {
+			break
+		}
+	}
+	if len(row.Columns) == 0 {
+		return false, nil
+	}
+
+	allowed := false
+	for _, name := range strings.Split(row.Columns[2].GetString_(), ",") {
+		if name == function {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return false, nil
+	}
+	if cap := row.Columns[3].GetInt64(); cap > 0 && amount > cap {
+		return false, nil
+	}
+	if expiry := row.Columns[4].GetString_(); expiry != "" {
+		until, err := parseDate(expiry)
+		if err != nil {
+			return false, err
+		}
+		now, err := txTime(stub)
+		if err != nil {
+			return false, err
+		}
+		if daysBetween(now, until) < 0 {
+			return false, nil
+		}
+	}
+
+	fmt.Printf("Caller acts on behalf of its principal for [%s]\n", function)
+	return true, nil
+}
+
+// delegate lets a delegate certificate call some functions on behalf of the
+// principal certificate, replacing any previous delegation between them.
+func (t *AssetManagementChaincode) delegate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Delegate...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	principal, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil || len(principal) == 0 {
+		return nil, errors.New("Failed decoding principal")
+	}
+	delegate, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil || len(delegate) == 0 {
+		return nil, errors.New("Failed decoding delegate")
+	}
+	if bytes.Equal(principal, delegate) {
+		return nil, errors.New("A certificate cannot delegate to itself")
+	}
+	principal, delegate = certFingerprint(principal), certFingerprint(delegate)
+	var functions []string
+	for _, function := range strings.Split(args[2], ",") {
+		function = strings.TrimSpace(function)
+		if !isDelegable(function) {
+			return nil, fmt.Errorf("Function [%s] cannot be delegated", function)
+		}
+		functions = append(functions, function)
+	}
+	amountCap, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || amountCap < 0 {
+		throwError := errors.New("Expecting a non negative integer value for amount cap")
+		return errorJson("delegate", throwError), throwError
+	}
+	expiry := args[4]
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if expiry != "" {
+		until, err := parseDate(expiry)
+		if err != nil {
+			return errorJson("delegate", err), err
+		}
+		if daysBetween(now, until) < 0 {
+			return nil, errors.New("Delegation expiry is in the past")
+		}
+	}
+
+	current, err := stub.GetRow("Delegation", delegationKey(principal, delegate))
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving delegation: [%s]", err)
+	}
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: principal}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: delegate}},
+			&shim.Column{Value: &shim.Column_String_{String_: strings.Join(functions, ",")}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amountCap}},
+			&shim.Column{Value: &shim.Column_String_{String_: expiry}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("Delegation", row)
+	} else {
+		_, err = stub.ReplaceRow("Delegation", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing delegation: [%s]", err)
+	}
+
+	fmt.Println("Delegate...done!")
+
+	return nil, nil
+}
+
+// revokeDelegation removes a delegation; the delegate loses its authority
+// from this transaction on.
+func (t *AssetManagementChaincode) revokeDelegation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Revoke delegation...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	principal, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("Failed decoding principal")
+	}
+	delegate, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding delegate")
+	}
+	principal, delegate = certFingerprint(principal), certFingerprint(delegate)
+
+	current, err := stub.GetRow("Delegation", delegationKey(principal, delegate))
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving delegation: [%s]", err)
+	}
+	if len(current.Columns) == 0 {
+		return nil, errors.New("No such delegation")
+	}
+	err = stub.DeleteRow("Delegation", delegationKey(principal, delegate))
+	if err != nil {
+		return nil, fmt.Errorf("Failed revoking delegation: [%s]", err)
+	}
+
+	fmt.Println("Revoke delegation...done!")
+
+	return nil, nil
+}
+
+// delegations lists the delegates of a principal certificate.
+func (t *AssetManagementChaincode) delegations(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query delegations...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	principal, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("Failed decoding principal")
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(principal)}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("Delegation", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving delegations: [%s]", err)
+	}
+	entries := make(map[string]string)
+	var delegates []string
+	for row := range rows {
+		delegate := hex.EncodeToString(row.Columns[1].GetBytes())
+		entries[delegate] = `{"delegate":"` + delegate +
+			`","functions":` + jsonString(row.Columns[2].GetString_()) +
+			`,"amount_cap":"` + strconv.FormatInt(row.Columns[3].GetInt64(), 10) +
+			`","expiry":"` + row.Columns[4].GetString_() +
+			`","date":"` + row.Columns[5].GetString_() + `"}`
+		delegates = append(delegates, delegate)
+	}
+	sort.Strings(delegates)
+
+	jsonResp := `{"delegations":[`
+	for i, delegate := range delegates {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += entries[delegate]
+	}
+	jsonResp += `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query delegations...done!")
+
+	return []byte(jsonResp), nil
+}
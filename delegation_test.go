@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApproveInvoiceByDelegate(t *testing.T) {
+	tests := []struct {
+		name      string
+		functions string
+		amountCap string
+		expiry    string
+		change    func(cc *AssetManagementChaincode, stub *testStub)
+		price     string
+		approved  bool
+	}{
+		{name: "within the cap", functions: "approveInvoice", amountCap: "100000", price: "100000", approved: true},
+		{name: "no cap", functions: "approveInvoice", amountCap: "0", price: "100000", approved: true},
+		{name: "over the cap", functions: "approveInvoice", amountCap: "50000", price: "100000"},
+		{name: "other function delegated", functions: "createPaymentRequest", amountCap: "0", price: "100000"},
+		{
+			name:      "before expiry",
+			functions: "approveInvoice",
+			amountCap: "0",
+			expiry:    "2026-10-15",
+			change: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.now = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+			},
+			price:    "100000",
+			approved: true,
+		},
+		{
+			name:      "expired",
+			functions: "approveInvoice",
+			amountCap: "0",
+			expiry:    "2026-10-15",
+			change: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.now = time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+			},
+			price: "100000",
+		},
+		{
+			name:      "revoked",
+			functions: "approveInvoice",
+			amountCap: "0",
+			change: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "revokeDelegation", encodeCert("buyer"), encodeCert("assistant"))
+			},
+			price: "100000",
+		},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+		stub.invoke(t, cc, "delegate", encodeCert("buyer"), encodeCert("assistant"), test.functions, test.amountCap, test.expiry)
+		stub.invoke(t, cc, "createInvoice", "1", test.price, "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+		if test.change != nil {
+			test.change(cc, stub)
+		}
+
+		stub.MockTransactionStart(test.name)
+		_, err := cc.Invoke(stub, "approveInvoice", []string{"1", encodeCert("assistant")})
+		stub.MockTransactionEnd(test.name)
+		if test.approved != (err == nil) {
+			t.Errorf("%s: got error %v, want approved: %t", test.name, err, test.approved)
+		}
+	}
+}
+
+func TestDelegate(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		fails bool
+	}{
+		{name: "delegable functions", args: []string{encodeCert("buyer"), encodeCert("assistant"), "approveInvoice, createPaymentRequest", "0", ""}},
+		{name: "function not delegable", args: []string{encodeCert("buyer"), encodeCert("assistant"), "assignPaymentRequest", "0", ""}, fails: true},
+		{name: "to itself", args: []string{encodeCert("buyer"), encodeCert("buyer"), "approveInvoice", "0", ""}, fails: true},
+		{name: "negative cap", args: []string{encodeCert("buyer"), encodeCert("assistant"), "approveInvoice", "-1", ""}, fails: true},
+		{name: "expiry in the past", args: []string{encodeCert("buyer"), encodeCert("assistant"), "approveInvoice", "0", "2026-09-30"}, fails: true},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.MockTransactionStart(test.name)
+		_, err := cc.Invoke(stub, "delegate", test.args)
+		stub.MockTransactionEnd(test.name)
+		if test.fails != (err != nil) {
+			t.Errorf("%s: got error %v, want an error: %t", test.name, err, test.fails)
+		}
+	}
+}
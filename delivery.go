@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createDeliveryTables(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("ProofOfDelivery", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "ShipmentId", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "DeliveredDate", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "DocumentHash", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "CarrierCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Signature", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating ProofOfDelivery table.")
+	}
+
+	err = stub.CreateTable("DeliveryPolicy", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "RequireDelivery", Type: shim.ColumnDefinition_BOOL, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating DeliveryPolicy table.")
+	}
+
+	return nil
+}
+
+func getProofOfDeliveryRow(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("ProofOfDelivery", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving proof of delivery of invoice [%d]: [%s]", number, err)
+	}
+	return row, nil
+}
+
+func getDeliveryPolicyRow(stub shim.ChaincodeStubInterface, buyerId int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: buyerId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("DeliveryPolicy", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving delivery policy of buyer [%d]: [%s]", buyerId, err)
+	}
+	return row, nil
+}
+
+// requireDelivery fails when the buyer of the invoice requires a proof of
+// delivery before approval or financing and none was posted yet.
+func requireDelivery(stub shim.ChaincodeStubInterface, invoiceRow shim.Row) error {
+	number := invoiceRow.Columns[0].GetInt32()
+
+	policy, err := getDeliveryPolicyRow(stub, invoiceRow.Columns[7].GetInt32())
+	if err != nil {
+		return err
+	}
+	if len(policy.Columns) == 0 || !policy.Columns[1].GetBool() {
+		return nil
+	}
+
+	proof, err := getProofOfDeliveryRow(stub, number)
+	if err != nil {
+		return err
+	}
+	if len(proof.Columns) == 0 {
+		return fmt.Errorf("Delivery of invoice [%d] is not confirmed yet", number)
+	}
+	return nil
+}
+
+// setDeliveryPolicy sets whether a buyer requires a proof of delivery before
+// its invoices can be approved or financed. Only a registered certificate of
+// the buyer or an administrator can set it.
+func (t *AssetManagementChaincode) setDeliveryPolicy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set delivery policy...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	buyerId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("setDeliveryPolicy", throwError), throwError
+	}
+	required, err := strconv.ParseBool(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting boolean value for delivery requirement")
+		return errorJson("setDeliveryPolicy", throwError), throwError
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	err = requireParticipantAuthority(stub, int32(buyerId), buyer)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := getDeliveryPolicyRow(stub, int32(buyerId))
+	if err != nil {
+		return nil, err
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: required}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(buyer)}},
+		},
+	}
+	if len(policy.Columns) == 0 {
+		_, err = stub.InsertRow("DeliveryPolicy", row)
+	} else {
+		_, err = stub.ReplaceRow("DeliveryPolicy", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing delivery policy of buyer [%d]: [%s]", buyerId, err)
+	}
+
+	fmt.Println("Set delivery policy...done!")
+
+	return nil, nil
+}
+
+// postProofOfDelivery records the delivery of the goods of an invoice. It can
+// only be called by a certificate holding the carrier role, and the record
+// must be signed by that certificate.
+func (t *AssetManagementChaincode) postProofOfDelivery(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Post proof of delivery...")
+
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("postProofOfDelivery", throwError), throwError
+	}
+	shipmentId := args[1]
+	deliveredDate := args[2]
+	documentHash := args[3]
+
+	signature, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding signature")
+	}
+	carrier, err := base64.StdEncoding.DecodeString(args[5])
+	if err != nil {
+		return nil, errors.New("Failed decoding carrier")
+	}
+
+	err = requireRole(stub, roleCarrier, carrier)
+	if err != nil {
+		return nil, err
+	}
+
+	// The carrier signs invoice number, shipment id, delivered date and
+	// document hash separated by '|'
+	message := []byte(args[0] + "|" + shipmentId + "|" + deliveredDate + "|" + documentHash)
+	ok, err := stub.VerifySignature(carrier, signature, message)
+	if err != nil {
+		return nil, fmt.Errorf("Failed verifying proof of delivery signature: [%s]", err)
+	}
+	if !ok {
+		return nil, errors.New("Invalid proof of delivery signature")
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err = stub.InsertRow("ProofOfDelivery", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_String_{String_: shipmentId}},
+			&shim.Column{Value: &shim.Column_String_{String_: deliveredDate}},
+			&shim.Column{Value: &shim.Column_String_{String_: documentHash}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(carrier)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: signature}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Delivery of invoice [%d] was already confirmed", number)
+	}
+
+	// The confirmed date replaces the one typed in by the supplier
+	invoiceRow.Columns[3] = &shim.Column{Value: &shim.Column_String_{String_: deliveredDate}}
+	_, err = stub.ReplaceRow("Invoice", invoiceRow)
+	if err != nil {
+		return nil, fmt.Errorf("Failed updating delivery date of invoice [%d]: [%s]", number, err)
+	}
+
+	// An invoice raised against a purchase order may have been waiting for
+	// the delivery to be approved
+	_, err = t.matchInvoice(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Post proof of delivery...done!")
+
+	return nil, nil
+}
+
+// invoiceDeliveryJson renders the proof of delivery of an invoice as JSON
+// object members, or an empty string when delivery was not confirmed.
+func invoiceDeliveryJson(stub shim.ChaincodeStubInterface, number int32) (string, error) {
+	proof, err := getProofOfDeliveryRow(stub, number)
+	if err != nil || len(proof.Columns) == 0 {
+		return "", err
+	}
+
+	return `,"delivery":{"shipment_id":` + jsonString(proof.Columns[1].GetString_()) +
+		`,"delivered_date":` + jsonString(proof.Columns[2].GetString_()) +
+		`,"document_hash":` + jsonString(proof.Columns[3].GetString_()) + `}`, nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Outcomes of a dispute resolved by an arbitrator. An upheld invoice stands
+// as approved, an adjusted one stands with the amount set by the arbitrator
+// and a cancelled one is withdrawn together with its payment requests.
+const (
+	disputeUpheld    = "upheld"
+	disputeAdjusted  = "adjusted"
+	disputeCancelled = "cancelled"
+)
+
+func createDisputeTable(stub shim.ChaincodeStubInterface) error {
+	// Latest dispute on each invoice
+	err := stub.CreateTable("Dispute", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "RaisedBy", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Reason", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "EvidenceHash", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "RaisedDate", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Outcome", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "AdjustedAmount", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "ArbitratorCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Dispute table.")
+	}
+
+	// Amount an invoice stands with after a dispute was resolved as adjusted.
+	// The invoice row keeps the amount its lines add up to.
+	err = stub.CreateTable("InvoiceAdjustment", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "AdjustedDate", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating InvoiceAdjustment table.")
+	}
+
+	// Face value of the payment requests created before the amount of their
+	// invoice was adjusted; they keep the amount they were priced on
+	err = stub.CreateTable("PaymentFaceValue", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "FaceValue", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PaymentFaceValue table.")
+	}
+	return nil
+}
+
+func getInvoiceAdjustmentRow(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("InvoiceAdjustment", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving adjustment of invoice [%d]: [%s]", number, err)
+	}
+	return row, nil
+}
+
+// invoiceAmount returns the amount an invoice stands with: the amount set
+// by an arbitrator when a dispute on it was adjusted, its own otherwise.
+func invoiceAmount(stub shim.ChaincodeStubInterface, invoiceRow shim.Row) (int64, error) {
+	adjustment, err := getInvoiceAdjustmentRow(stub, invoiceRow.Columns[0].GetInt32())
+	if err != nil {
+		return 0, err
+	}
+	if len(adjustment.Columns) != 0 {
+		return adjustment.Columns[1].GetInt64(), nil
+	}
+	return int64(invoiceRow.Columns[1].GetInt32()), nil
+}
+
+// paymentFaceValue returns the face value of a payment request, which is the
+// amount of its invoice unless the request predates an adjustment of it.
+func paymentFaceValue(stub shim.ChaincodeStubInterface, payment int32, invoiceRow shim.Row) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentFaceValue", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving face value of payment request [%d]: [%s]", payment, err)
+	}
+	if len(row.Columns) != 0 {
+		return row.Columns[1].GetInt64(), nil
+	}
+	return invoiceAmount(stub, invoiceRow)
+}
+
+// invoiceAdjustmentJson renders the amount an arbitrator adjusted an invoice
+// to as a JSON object member, or an empty string when it was never adjusted.
+func invoiceAdjustmentJson(stub shim.ChaincodeStubInterface, number int32) (string, error) {
+	adjustment, err := getInvoiceAdjustmentRow(stub, number)
+	if err != nil || len(adjustment.Columns) == 0 {
+		return "", err
+	}
+	return `,"adjusted_amount":"` + strconv.FormatInt(adjustment.Columns[1].GetInt64(), 10) +
+		`","adjusted_date":"` + adjustment.Columns[2].GetString_() + `"`, nil
+}
+
+// adjustInvoice records the amount set by an arbitrator on an invoice. The
+// payment requests already created on it keep their face value.
+func adjustInvoice(stub shim.ChaincodeStubInterface, invoiceRow shim.Row, amount int64) error {
+	number := invoiceRow.Columns[0].GetInt32()
+	if amount > int64(invoiceRow.Columns[1].GetInt32()) {
+		return fmt.Errorf("Adjusted amount [%d] exceeds the amount of invoice [%d]", amount, number)
+	}
+
+	payments, err := getInvoicePayments(stub, number)
+	if err != nil {
+		return err
+	}
+	for _, payment := range payments {
+		faceValue, err := paymentFaceValue(stub, payment, invoiceRow)
+		if err != nil {
+			return err
+		}
+		_, err = stub.InsertRow("PaymentFaceValue", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: faceValue}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed storing face value of payment request [%d]: [%s]", payment, err)
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	adjustment, err := getInvoiceAdjustmentRow(stub, number)
+	if err != nil {
+		return err
+	}
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: number}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+		},
+	}
+	if len(adjustment.Columns) == 0 {
+		_, err = stub.InsertRow("InvoiceAdjustment", row)
+	} else {
+		_, err = stub.ReplaceRow("InvoiceAdjustment", row)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed adjusting amount of invoice [%d]: [%s]", number, err)
+	}
+	return nil
+}
+
+// getDisputeRow returns the latest dispute on an invoice, or an empty row
+// when it was never disputed.
+func getDisputeRow(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("Dispute", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving dispute of invoice [%d]: [%s]", number, err)
+	}
+	return row, nil
+}
+
+// requireNoDispute fails when financing of the invoice is frozen by an open
+// dispute, or the invoice was cancelled.
+func requireNoDispute(stub shim.ChaincodeStubInterface, invoiceRow shim.Row) error {
+	number := invoiceRow.Columns[0].GetInt32()
+	if invoiceRow.Columns[2].GetString_() == "Cancelled" {
+		return fmt.Errorf("Invoice [%d] was cancelled", number)
+	}
+	dispute, err := getDisputeRow(stub, number)
+	if err != nil {
+		return err
+	}
+	if len(dispute.Columns) != 0 && dispute.Columns[5].GetString_() == "Open" {
+		return fmt.Errorf("Invoice [%d] is under dispute", number)
+	}
+	return nil
+}
+
+// disputeEvent emits a chaincode event so that the funders of the payment
+// requests of a disputed invoice are notified.
+func disputeEvent(stub shim.ChaincodeStubInterface, name string, number int32, status string) error {
+	payments, err := getInvoicePayments(stub, number)
+	if err != nil {
+		return err
+	}
+
+	funders := `[`
+	first := true
+	for _, payment := range payments {
+		paymentRow, err := getPaymentRequestRow(stub, payment)
+		if err != nil {
+			return err
+		}
+		payerId := paymentRow.Columns[3].GetInt32()
+		if payerId == -1 {
+			continue
+		}
+		if !first {
+			funders += `,`
+		}
+		first = false
+		funders += `{"paymentId":"` + strconv.Itoa(int(payment)) + `","payerId":"` + strconv.Itoa(int(payerId)) + `"}`
+	}
+	funders += `]`
+
+	payload := `{"invoice":"` + strconv.Itoa(int(number)) + `","status":"` + status + `","funders":` + funders + `}`
+	fmt.Println(payload)
+	return stub.SetEvent(name, []byte(payload))
+}
+
+// raiseDispute lets the buyer or the supplier of an approved invoice dispute
+// it, with a reason and the hash of the evidence. Financing of the invoice
+// is frozen until an arbitrator resolves the dispute.
+func (t *AssetManagementChaincode) raiseDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Raise dispute...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("raiseDispute", throwError), throwError
+	}
+	reason := args[1]
+	if reason == "" {
+		return nil, errors.New("Expecting a reason for the dispute")
+	}
+	hash, err := normalizeDocumentHash(args[2])
+	if err != nil {
+		return errorJson("raiseDispute", err), err
+	}
+	caller, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	raisedBy := "supplier"
+	isBuyer, err := isParticipantCert(stub, invoiceRow.Columns[7].GetInt32(), invoiceRow.Columns[9].GetBytes(), caller)
+	if err != nil {
+		return nil, err
+	}
+	if isBuyer {
+		raisedBy = "buyer"
+	} else {
+		err = requireParticipantCert(stub, invoiceRow.Columns[6].GetInt32(), invoiceRow.Columns[8].GetBytes(), caller)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if invoiceRow.Columns[2].GetString_() != "Approved" {
+		return nil, fmt.Errorf("Invoice [%d] is not approved", number)
+	}
+
+	dispute, err := getDisputeRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(dispute.Columns) != 0 && dispute.Columns[5].GetString_() == "Open" {
+		return nil, fmt.Errorf("Invoice [%d] is already under dispute", number)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_String_{String_: raisedBy}},
+			&shim.Column{Value: &shim.Column_String_{String_: reason}},
+			&shim.Column{Value: &shim.Column_String_{String_: hash}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Open"}},
+			&shim.Column{Value: &shim.Column_String_{String_: ""}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: 0}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: nil}},
+		},
+	}
+	if len(dispute.Columns) == 0 {
+		_, err = stub.InsertRow("Dispute", row)
+	} else {
+		_, err = stub.ReplaceRow("Dispute", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing dispute of invoice [%d]: [%s]", number, err)
+	}
+
+	// The evidence may have been anchored already
+	evidence, err := getDocumentRow(stub, documentEntityInvoice, int32(number), hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(evidence.Columns) == 0 {
+		err = anchorDocument(stub, documentEntityInvoice, int32(number), "dispute_evidence", hash, "", caller)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = disputeEvent(stub, "disputeRaised", int32(number), "Open")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Raise dispute...done!")
+
+	return nil, nil
+}
+
+// resolveDispute lets an arbitrator close the open dispute on an invoice
+// with an outcome. The adjusted amount is ignored for the other outcomes; it
+// cannot exceed the invoice amount and leaves the payment requests already
+// created on the invoice unchanged.
+func (t *AssetManagementChaincode) resolveDispute(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Resolve dispute...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("resolveDispute", throwError), throwError
+	}
+	outcome := args[1]
+	if outcome != disputeUpheld && outcome != disputeAdjusted && outcome != disputeCancelled {
+		return nil, fmt.Errorf("Unknown dispute outcome [%s]", outcome)
+	}
+	adjusted := 0
+	if outcome == disputeAdjusted {
+		adjusted, err = strconv.Atoi(args[2])
+		if err != nil || adjusted <= 0 {
+			throwError := errors.New("Expecting positive integer value for adjusted amount")
+			return errorJson("resolveDispute", throwError), throwError
+		}
+	}
+	arbitrator, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding arbitrator")
+	}
+
+	err = requireRole(stub, roleArbitrator, arbitrator)
+	if err != nil {
+		return nil, err
+	}
+
+	dispute, err := getDisputeRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(dispute.Columns) == 0 || dispute.Columns[5].GetString_() != "Open" {
+		return nil, fmt.Errorf("Invoice [%d] has no open dispute", number)
+	}
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+
+	switch outcome {
+	case disputeAdjusted:
+		err = adjustInvoice(stub, invoiceRow, int64(adjusted))
+		if err != nil {
+			return nil, err
+		}
+	case disputeCancelled:
+		err = setInvoiceStatus(stub, invoiceRow, "Cancelled")
+		if err != nil {
+			return nil, err
+		}
+		payments, err := getInvoicePayments(stub, int32(number))
+		if err != nil {
+			return nil, err
+		}
+		for _, payment := range payments {
+			paymentRow, err := getPaymentRequestRow(stub, payment)
+			if err != nil {
+				return nil, err
+			}
+			if paymentRow.Columns[5].GetString_() == "Settled" {
+				continue
+			}
+			err = setPaymentRequestStatus(stub, paymentRow, "Cancelled")
+			if err != nil {
+				return nil, err
+			}
+			err = releaseExposure(stub, payment)
+			if err != nil {
+				return nil, err
+			}
+			// The supplier no longer owes back a request under recourse
+			defaultRow, err := getBuyerDefaultRow(stub, payment)
+			if err != nil {
+				return nil, err
+			}
+			if len(defaultRow.Columns) != 0 && defaultRow.Columns[6].GetString_() == "Open" {
+				err = closeDefault(stub, defaultRow, "Cancelled")
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	status := "Resolved"
+	dispute.Columns[5] = &shim.Column{Value: &shim.Column_String_{String_: status}}
+	dispute.Columns[6] = &shim.Column{Value: &shim.Column_String_{String_: outcome}}
+	dispute.Columns[7] = &shim.Column{Value: &shim.Column_Int32{Int32: int32(adjusted)}}
+	dispute.Columns[8] = &shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(arbitrator)}}
+	_, err = stub.ReplaceRow("Dispute", dispute)
+	if err != nil {
+		return nil, fmt.Errorf("Failed resolving dispute of invoice [%d]: [%s]", number, err)
+	}
+
+	err = releaseEscrow(stub, int32(number), outcome == disputeCancelled)
+	if err != nil {
+		return nil, err
+	}
+
+	err = disputeEvent(stub, "disputeResolved", int32(number), outcome)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Resolve dispute...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) dispute_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query dispute...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("dispute_info", throwError), throwError
+	}
+
+	dispute, err := getDisputeRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(dispute.Columns) == 0 {
+		return nil, fmt.Errorf("Invoice [%d] was never disputed", number)
+	}
+
+	jsonResp := `{"invoice":"` + strconv.Itoa(number) + `","raised_by":"` + dispute.Columns[1].GetString_() +
+		`","reason":` + jsonString(dispute.Columns[2].GetString_()) +
+		`,"evidence_hash":"` + dispute.Columns[3].GetString_() +
+		`","raised_date":"` + dispute.Columns[4].GetString_() +
+		`","status":"` + dispute.Columns[5].GetString_() + `"`
+	if dispute.Columns[5].GetString_() != "Open" {
+		jsonResp += `,"outcome":"` + dispute.Columns[6].GetString_() + `"`
+		if dispute.Columns[6].GetString_() == disputeAdjusted {
+			jsonResp += `,"adjusted_amount":"` + strconv.Itoa(int(dispute.Columns[7].GetInt32())) + `"`
+		}
+	}
+	jsonResp += `}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query dispute...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestAdjustedPaymentAmounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(stub *testStub)
+		faceValue int64
+		payout    int64
+	}{
+		{
+			name: "invoice adjusted after the request",
+			setup: func(stub *testStub) {
+				invoiceRow, _ := getInvoiceRow(stub, 1)
+				adjustInvoice(stub, invoiceRow, 60000)
+			},
+			faceValue: 100000,
+			payout:    98000,
+		},
+		{
+			name: "invoice adjusted before the request",
+			setup: func(stub *testStub) {
+				stub.InsertRow("InvoiceAdjustment", shim.Row{
+					Columns: []*shim.Column{
+						&shim.Column{Value: &shim.Column_Int32{Int32: 1}},
+						&shim.Column{Value: &shim.Column_Int64{Int64: 60000}},
+						&shim.Column{Value: &shim.Column_String_{String_: "2026-10-01"}},
+					},
+				})
+			},
+			faceValue: 60000,
+			payout:    58800,
+		},
+	}
+
+	for _, test := range tests {
+		_, stub := assignedRequest(t)
+		stub.MockTransactionStart(test.name)
+		test.setup(stub)
+		stub.MockTransactionEnd(test.name)
+
+		checkPaymentAmounts(t, test.name, stub, test.faceValue, test.payout)
+	}
+}
+
+func TestRaiseDisputeEvidence(t *testing.T) {
+	evidence := strings.Repeat("ab", 32)
+	tests := []struct {
+		name     string
+		anchored bool
+		docType  string
+	}{
+		{name: "evidence anchored with the dispute", docType: "dispute_evidence"},
+		{name: "evidence anchored before", anchored: true, docType: "delivery_note"},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+		stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+		if test.anchored {
+			stub.invoke(t, cc, "attachDocument", documentEntityInvoice, "1", "delivery_note", evidence, "", encodeCert("buyer"))
+		}
+		stub.invoke(t, cc, "raiseDispute", "1", "short delivery", evidence, encodeCert("buyer"))
+
+		stub.MockTransactionStart(test.name)
+		dispute, err := getDisputeRow(stub, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		document, err := getDocumentRow(stub, documentEntityInvoice, 1, evidence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stub.MockTransactionEnd(test.name)
+		if len(dispute.Columns) == 0 || dispute.Columns[5].GetString_() != "Open" {
+			t.Errorf("%s: expected an open dispute", test.name)
+		}
+		if len(document.Columns) == 0 || document.Columns[3].GetString_() != test.docType {
+			t.Errorf("%s: expected the evidence anchored as %s", test.name, test.docType)
+		}
+	}
+}
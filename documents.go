@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Entities documents can be attached to.
+const (
+	documentEntityInvoice = "invoice"
+	documentEntityPayment = "payment"
+)
+
+func createDocumentTable(stub shim.ChaincodeStubInterface) error {
+	// Only the hash and the off-chain location are kept, never the document
+	err := stub.CreateTable("Document", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Entity", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "EntityId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Hash", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Type", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Uri", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "UploaderCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Document table.")
+	}
+	return nil
+}
+
+// normalizeDocumentHash checks that the hash is a hex encoded SHA-256 digest
+// and returns it in lower case.
+func normalizeDocumentHash(hash string) (string, error) {
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != 32 {
+		return "", errors.New("Expecting hex encoded SHA-256 document hash")
+	}
+	return strings.ToLower(hash), nil
+}
+
+// isInvoiceParty checks whether the cert is the supplier or the buyer of the invoice.
+func isInvoiceParty(stub shim.ChaincodeStubInterface, invoiceRow shim.Row, cert []byte) (bool, error) {
+	ok, err := isParticipantCert(stub, invoiceRow.Columns[6].GetInt32(), invoiceRow.Columns[8].GetBytes(), cert)
+	if err != nil || ok {
+		return ok, err
+	}
+	return isParticipantCert(stub, invoiceRow.Columns[7].GetInt32(), invoiceRow.Columns[9].GetBytes(), cert)
+}
+
+// getDocumentRow returns a document anchored to an invoice or a payment
+// request, or an empty row when the hash is not anchored to it.
+func getDocumentRow(stub shim.ChaincodeStubInterface, entity string, entityId int32, hash string) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: entity}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: entityId}}
+	col3 := shim.Column{Value: &shim.Column_String_{String_: hash}}
+	columns = append(columns, col1, col2, col3)
+
+	row, err := stub.GetRow("Document", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving document [%s]: [%s]", hash, err)
+	}
+	return row, nil
+}
+
+func anchorDocument(stub shim.ChaincodeStubInterface, entity string, entityId int32, docType string, hash string, uri string, uploader []byte) error {
+	ok, err := stub.InsertRow("Document", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: entity}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: entityId}},
+			&shim.Column{Value: &shim.Column_String_{String_: hash}},
+			&shim.Column{Value: &shim.Column_String_{String_: docType}},
+			&shim.Column{Value: &shim.Column_String_{String_: uri}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(uploader)}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed anchoring document of %s [%d]: [%s]", entity, entityId, err)
+	}
+	if !ok {
+		return fmt.Errorf("Document [%s] is already attached to %s [%d]", hash, entity, entityId)
+	}
+	return nil
+}
+
+// attachDocument anchors the hash of an off-chain document to an invoice or
+// a payment request. Only the invoice supplier or buyer, or the payer of a
+// payment request, can attach documents.
+func (t *AssetManagementChaincode) attachDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Attach document...")
+
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+
+	entity := args[0]
+	entityId, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for entity id")
+		return errorJson("attachDocument", throwError), throwError
+	}
+	docType := args[2]
+	hash, err := normalizeDocumentHash(args[3])
+	if err != nil {
+		return errorJson("attachDocument", err), err
+	}
+	uri := args[4]
+
+	uploader, err := base64.StdEncoding.DecodeString(args[5])
+	if err != nil {
+		return nil, errors.New("Failed decoding uploader")
+	}
+
+	var allowed bool
+	switch entity {
+	case documentEntityInvoice:
+		invoiceRow, err := getInvoiceRow(stub, int32(entityId))
+		if err != nil {
+			return nil, err
+		}
+		allowed, err = isInvoiceParty(stub, invoiceRow, uploader)
+		if err != nil {
+			return nil, err
+		}
+	case documentEntityPayment:
+		paymentRow, err := getPaymentRequestRow(stub, int32(entityId))
+		if err != nil {
+			return nil, err
+		}
+		allowed, err = isParticipantCert(stub, paymentRow.Columns[3].GetInt32(), paymentRow.Columns[4].GetBytes(), uploader)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+			if err != nil {
+				return nil, err
+			}
+			allowed, err = isInvoiceParty(stub, invoiceRow, uploader)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown document entity [%s]", entity)
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+
+	err = anchorDocument(stub, entity, int32(entityId), docType, hash, uri, uploader)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Attach document...done!")
+
+	return nil, nil
+}
+
+// verifyDocument checks a document hash against the ones anchored to an
+// invoice or a payment request.
+func (t *AssetManagementChaincode) verifyDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Verify document...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	entity := args[0]
+	entityId, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for entity id")
+		return errorJson("verifyDocument", throwError), throwError
+	}
+	if entity != documentEntityInvoice && entity != documentEntityPayment {
+		return nil, fmt.Errorf("Unknown document entity [%s]", entity)
+	}
+	hash, err := normalizeDocumentHash(args[2])
+	if err != nil {
+		return errorJson("verifyDocument", err), err
+	}
+
+	row, err := getDocumentRow(stub, entity, int32(entityId), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonResp := `{"entity":"` + entity + `","id":"` + strconv.Itoa(entityId) + `","hash":"` + hash + `",`
+	if len(row.Columns) == 0 {
+		jsonResp += `"verified":"false"}`
+	} else {
+		jsonResp += `"verified":"true","type":` + jsonString(row.Columns[3].GetString_()) +
+			`,"uri":` + jsonString(row.Columns[4].GetString_()) + `}`
+	}
+
+	fmt.Println(jsonResp)
+	fmt.Println("Verify document...done!")
+
+	return []byte(jsonResp), nil
+}
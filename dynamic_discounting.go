@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createDynamicDiscountTables(stub shim.ChaincodeStubInterface) error {
+	// Early payment offer published by a buyer, as an annual rate in basis points
+	err := stub.CreateTable("DiscountOffer", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Apr", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Active", Type: shim.ColumnDefinition_BOOL, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating DiscountOffer table.")
+	}
+
+	// Discount computed when a supplier takes an offer; at most one per invoice
+	err = stub.CreateTable("DynamicDiscount", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Apr", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Days", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "DiscountAmount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "RequestDate", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating DynamicDiscount table.")
+	}
+
+	return nil
+}
+
+func getDiscountOfferRow(stub shim.ChaincodeStubInterface, buyerId int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: buyerId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("DiscountOffer", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving discount offer of buyer [%d]: [%s]", buyerId, err)
+	}
+	return row, nil
+}
+
+// getDynamicDiscountRow returns the dynamic discount taken on an invoice, or
+// an empty row when there is none.
+func getDynamicDiscountRow(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("DynamicDiscount", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving dynamic discount of invoice [%d]: [%s]", number, err)
+	}
+	return row, nil
+}
+
+// dynamicDiscount computes the discount on an amount paid the given number
+// of days early at an annual rate in basis points.
+func dynamicDiscount(amount int64, apr int32, days int64) int64 {
+	return amount * int64(apr) * days / (365 * 10000)
+}
+
+// publishDiscountOffer publishes, updates or, with a zero rate, withdraws
+// the early payment offer of a buyer. Only a registered certificate of the
+// buyer or an administrator can publish it.
+func (t *AssetManagementChaincode) publishDiscountOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Publish discount offer...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	buyerId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("publishDiscountOffer", throwError), throwError
+	}
+	apr, err := strconv.Atoi(args[1])
+	if err != nil || apr < 0 || apr > 10000 {
+		throwError := errors.New("Expecting annual rate in basis points between 0 and 10000")
+		return errorJson("publishDiscountOffer", throwError), throwError
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	err = requireParticipantAuthority(stub, int32(buyerId), buyer)
+	if err != nil {
+		return nil, err
+	}
+
+	offer, err := getDiscountOfferRow(stub, int32(buyerId))
+	if err != nil {
+		return nil, err
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(apr)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: apr > 0}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(buyer)}},
+		},
+	}
+	if len(offer.Columns) == 0 {
+		_, err = stub.InsertRow("DiscountOffer", row)
+	} else {
+		_, err = stub.ReplaceRow("DiscountOffer", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing discount offer of buyer [%d]: [%s]", buyerId, err)
+	}
+
+	fmt.Println("Publish discount offer...done!")
+
+	return nil, nil
+}
+
+// requestEarlyPayment lets the supplier of an approved invoice take the
+// early payment offer of its buyer. The discount is computed pro rata for
+// the days left until the invoice payment date at the transaction time, and
+// the resulting payment request is funded by the buyer itself, within its
+// credit limits. Invoices already financed by an outstanding payment request
+// cannot be paid early.
+func (t *AssetManagementChaincode) requestEarlyPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Request early payment...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("requestEarlyPayment", throwError), throwError
+	}
+	number, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("requestEarlyPayment", throwError), throwError
+	}
+	supplier, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding supplier")
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, invoiceRow.Columns[6].GetInt32(), invoiceRow.Columns[8].GetBytes(), supplier)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	if invoiceRow.Columns[2].GetString_() != "Approved" {
+		return nil, fmt.Errorf("Invoice [%d] is not approved", number)
+	}
+	err = requireDelivery(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoDispute(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotFrozen(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	live, err := livePaymentRequest(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(live.Columns) != 0 {
+		return nil, fmt.Errorf("Invoice [%d] is already financed by payment request [%d]", number, live.Columns[0].GetInt32())
+	}
+
+	buyerId := invoiceRow.Columns[7].GetInt32()
+	offer, err := getDiscountOfferRow(stub, buyerId)
+	if err != nil {
+		return nil, err
+	}
+	if len(offer.Columns) == 0 || !offer.Columns[2].GetBool() {
+		return nil, fmt.Errorf("Buyer [%d] has no active early payment offer", buyerId)
+	}
+	apr := offer.Columns[1].GetInt32()
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	dueDate, err := parseDate(invoiceRow.Columns[5].GetString_())
+	if err != nil {
+		return nil, err
+	}
+	days := daysBetween(now, dueDate)
+	if days <= 0 {
+		return nil, fmt.Errorf("Invoice [%d] is already due", number)
+	}
+
+	price, err := invoiceAmount(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	if price <= 0 {
+		return nil, fmt.Errorf("Invoice [%d] has no amount to pay early", number)
+	}
+	discount := dynamicDiscount(price, apr, days)
+	requestDate := now.Format(dateLayout)
+
+	fmt.Printf("Early payment of invoice [%d]: %d days at %d bp, discount [%d]\n", number, days, apr, discount)
+
+	ok, err = stub.InsertRow("DynamicDiscount", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: apr}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(days)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: discount}},
+			&shim.Column{Value: &shim.Column_String_{String_: requestDate}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Early payment of invoice [%d] was already requested", number)
+	}
+
+	// The discount rate column is a whole percentage; the exact discount
+	// is taken from the DynamicDiscount table
+	paymentRow := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(discount * 100 / price)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: buyerId}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: identityOf(invoiceRow.Columns[9].GetBytes())}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Assigned"}},
+		},
+	}
+	ok, err = stub.InsertRow("PaymentRequest", paymentRow)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("payment request with this id was already created.")
+	}
+	// The buyer funds the request, so it carries the exposure of a funder
+	err = takeExposure(stub, paymentRow, invoiceRow, buyerId)
+	if err != nil {
+		return nil, err
+	}
+	err = indexInvoicePayment(stub, int32(number), int32(payment))
+	if err != nil {
+		return nil, err
+	}
+
+	invoiceRow.Columns[4] = &shim.Column{Value: &shim.Column_String_{String_: requestDate}}
+	_, err = stub.ReplaceRow("Invoice", invoiceRow)
+	if err != nil {
+		return nil, fmt.Errorf("Failed updating request date of invoice [%d]: [%s]", number, err)
+	}
+
+	fmt.Println("Request early payment...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) offer_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query discount offer...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	buyerId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("offer_info", throwError), throwError
+	}
+
+	offer, err := getDiscountOfferRow(stub, int32(buyerId))
+	if err != nil {
+		return nil, err
+	}
+	if len(offer.Columns) == 0 {
+		return nil, fmt.Errorf("Buyer [%d] has no early payment offer", buyerId)
+	}
+
+	jsonResp := `{"buyerId":"` + strconv.Itoa(buyerId) + `","apr":"` + strconv.Itoa(int(offer.Columns[1].GetInt32())) +
+		`","active":"` + strconv.FormatBool(offer.Columns[2].GetBool()) + `"}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query discount offer...done!")
+
+	return []byte(jsonResp), nil
+}
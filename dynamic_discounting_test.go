@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestDynamicDiscountAmounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		payment   int32
+		faceValue int64
+		payout    int64
+	}{
+		{name: "dynamic discount of the request", payment: 7, faceValue: 100000, payout: 99383},
+		{name: "dynamic discount of another request", payment: 8, faceValue: 100000, payout: 98000},
+	}
+
+	for _, test := range tests {
+		_, stub := assignedRequest(t)
+		stub.MockTransactionStart(test.name)
+		insertDynamicDiscount(stub, test.payment, 617)
+		stub.MockTransactionEnd(test.name)
+
+		checkPaymentAmounts(t, test.name, stub, test.faceValue, test.payout)
+	}
+}
+
+func TestRequestEarlyPayment(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+	stub.invoke(t, cc, "publishDiscountOffer", "4", "500", encodeCert("buyer"))
+	stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+	stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+	stub.invoke(t, cc, "requestEarlyPayment", "7", "1", encodeCert("supplier"))
+
+	// 45 days early at 5% a year
+	checkPaymentAmounts(t, "early payment", stub, 100000, 99384)
+
+	stub.MockTransactionStart("second request")
+	_, err := cc.Invoke(stub, "requestEarlyPayment", []string{"8", "1", encodeCert("supplier")})
+	stub.MockTransactionEnd("second request")
+	if err == nil {
+		t.Error("expected an invoice paid early to be rejected a second time")
+	}
+}
+
+func insertDynamicDiscount(stub *testStub, payment int32, discount int64) {
+	stub.InsertRow("DynamicDiscount", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: 1}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: 500}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: 45}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: discount}},
+			&shim.Column{Value: &shim.Column_String_{String_: "2026-10-01"}},
+		},
+	})
+}
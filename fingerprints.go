@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/crypto/primitives"
+)
+
+// Size of a certificate fingerprint, a SHA3-256 digest under the security
+// level set in main.
+const fingerprintSize = 32
+
+// certFingerprint returns the identity fingerprint stored in rows in place
+// of a raw certificate.
+func certFingerprint(cert []byte) []byte {
+	return primitives.Hash(cert)
+}
+
+// identityOf returns the fingerprint of a stored identity, which is the raw
+// certificate on rows written before the fingerprint migration.
+func identityOf(stored []byte) []byte {
+	if len(stored) == fingerprintSize {
+		return stored
+	}
+	return certFingerprint(stored)
+}
+
+// sameIdentity tells whether a certificate is the identity stored on a row.
+func sameIdentity(stored []byte, cert []byte) bool {
+	if len(stored) == 0 || len(cert) == 0 {
+		return false
+	}
+	if bytes.Equal(stored, certFingerprint(cert)) {
+		return true
+	}
+	// Rows not migrated yet still hold the raw certificate
+	return len(stored) != fingerprintSize && bytes.Equal(stored, cert)
+}
+
+// migrateTableFingerprints replaces the raw certificates held in some
+// columns of every row of a table by their fingerprints, and returns the
+// number of rows changed. When a certificate is part of the key, keys is the
+// number of key columns and the row is moved to its new key; a row already
+// stored under that key was written later and is kept.
+func migrateTableFingerprints(stub shim.ChaincodeStubInterface, table string, keys int, certColumns ...int) (int, error) {
+	rows, err := stub.GetRows(table, []shim.Column{})
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving %s rows: [%s]", table, err)
+	}
+	// Read everything first, the rows are replaced afterwards
+	var all []shim.Row
+	for row := range rows {
+		all = append(all, row)
+	}
+
+	count := 0
+	for _, row := range all {
+		var key []shim.Column
+		for i := 0; i < keys; i++ {
+			key = append(key, *row.Columns[i])
+		}
+
+		changed, rekeyed := false, false
+		for _, i := range certColumns {
+			stored := row.Columns[i].GetBytes()
+			if len(stored) == 0 || len(stored) == fingerprintSize {
+				continue
+			}
+			row.Columns[i] = &shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(stored)}}
+			changed = true
+			rekeyed = rekeyed || i < keys
+		}
+		if !changed {
+			continue
+		}
+		if rekeyed {
+			err = stub.DeleteRow(table, key)
+			if err == nil {
+				_, err = stub.InsertRow(table, row)
+			}
+		} else {
+			_, err = stub.ReplaceRow(table, row)
+		}
+		if err != nil {
+			return count, fmt.Errorf("Failed migrating %s row: [%s]", table, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Certificate columns holding raw certificates on rows written before
+// fingerprints were stored, by table, with the number of key columns of the
+// tables keyed by a certificate.
+var fingerprintColumns = []struct {
+	table   string
+	keys    int
+	columns []int
+}{
+	{"Invoice", 0, []int{8, 9}},
+	{"PaymentRequest", 0, []int{4}},
+	{"PurchaseOrder", 0, []int{5}},
+	{"DeliveryPolicy", 0, []int{2}},
+	{"ProofOfDelivery", 0, []int{4}},
+	{"Document", 0, []int{5}},
+	{"BankAccount", 0, []int{4}},
+	{"DiscountOffer", 0, []int{3}},
+	{"Program", 0, []int{7}},
+	{"CreditLimit", 0, []int{4}},
+	{"Receivable", 0, []int{3}},
+	{"UnitHolding", 0, []int{3}},
+	{"CashAccount", 0, []int{3}},
+	{"BaseCurrency", 0, []int{2}},
+	{"FxRate", 0, []int{4}},
+	{"Statement", 0, []int{1}},
+	{"Dispute", 0, []int{8}},
+	{"Freeze", 0, []int{4}},
+	{"ConfigHistory", 0, []int{4}},
+	{"Role", 2, []int{1}},
+	{"ParticipantCert", 2, []int{1, 4}},
+	{"BuyerApprover", 2, []int{1}},
+	{"InvoiceApproval", 2, []int{1}},
+	{"Delegation", 2, []int{0, 1}},
+}
+
+// migrateCertFingerprints replaces the raw certificates still held by rows
+// written before fingerprints were stored by their fingerprints. Rows
+// already holding fingerprints are left alone, so it can be run again.
+// Only an administrator can call it.
+func (t *AssetManagementChaincode) migrateCertFingerprints(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Migrate certificate fingerprints...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	admin, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("Failed decoding admin")
+	}
+	ok, err := isAdministrator(stub, admin)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Caller is not allowed to do this operation")
+	}
+
+	for _, migration := range fingerprintColumns {
+		count, err := migrateTableFingerprints(stub, migration.table, migration.keys, migration.columns...)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Migrated %d %s rows\n", count, migration.table)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState("certFingerprints", []byte(now.Format(dateLayout)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed recording migration: [%s]", err)
+	}
+
+	fmt.Println("Migrate certificate fingerprints...done!")
+
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestMigrateCertFingerprints(t *testing.T) {
+	cc, stub := newTestStub(t)
+	stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+
+	// Rows as written before certificates were stored as fingerprints
+	stub.MockTransactionStart("raw rows")
+	invoiceRow, err := getInvoiceRow(stub, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoiceRow.Columns[8] = &shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("supplier")}}
+	invoiceRow.Columns[9] = &shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("buyer")}}
+	stub.ReplaceRow("Invoice", invoiceRow)
+	raw := map[string][]*shim.Column{
+		"Role": {
+			&shim.Column{Value: &shim.Column_String_{String_: roleBank}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("bank")}},
+		},
+		"BuyerApprover": {
+			&shim.Column{Value: &shim.Column_Int32{Int32: 4}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("treasurer")}},
+			&shim.Column{Value: &shim.Column_String_{String_: "treasury"}},
+		},
+		"Delegation": {
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("buyer")}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("assistant")}},
+			&shim.Column{Value: &shim.Column_String_{String_: "approveInvoice"}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: 0}},
+			&shim.Column{Value: &shim.Column_String_{String_: ""}},
+			&shim.Column{Value: &shim.Column_String_{String_: "2026-09-01"}},
+		},
+		"Statement": {
+			&shim.Column{Value: &shim.Column_String_{String_: "S1"}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("bank")}},
+		},
+	}
+	for table, columns := range raw {
+		stub.InsertRow(table, shim.Row{Columns: columns})
+	}
+	stub.MockTransactionEnd("raw rows")
+
+	stub.MockTransactionStart("not an admin")
+	_, err = cc.Invoke(stub, "migrateCertFingerprints", []string{encodeCert("buyer")})
+	stub.MockTransactionEnd("not an admin")
+	if err == nil {
+		t.Error("expected the migration by a non administrator to be rejected")
+	}
+
+	// The migration can be run again without changing anything
+	for i := 0; i < 2; i++ {
+		stub.invoke(t, cc, "migrateCertFingerprints", encodeCert("admin"))
+
+		stub.MockTransactionStart("migrated rows")
+		invoiceRow, err = getInvoiceRow(stub, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(invoiceRow.Columns[8].GetBytes(), certFingerprint([]byte("supplier"))) ||
+			!bytes.Equal(invoiceRow.Columns[9].GetBytes(), certFingerprint([]byte("buyer"))) {
+			t.Error("invoice certificates not migrated")
+		}
+		checkMigratedKey(t, stub, "Role", roleKey(roleBank, []byte("bank")),
+			roleKey(roleBank, certFingerprint([]byte("bank"))))
+		checkMigratedKey(t, stub, "BuyerApprover", approverKey(4, []byte("treasurer")),
+			approverKey(4, certFingerprint([]byte("treasurer"))))
+		checkMigratedKey(t, stub, "Delegation", delegationKey([]byte("buyer"), []byte("assistant")),
+			delegationKey(certFingerprint([]byte("buyer")), certFingerprint([]byte("assistant"))))
+		statement, err := stub.GetRow("Statement", []shim.Column{shim.Column{Value: &shim.Column_String_{String_: "S1"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(statement.Columns[1].GetBytes(), certFingerprint([]byte("bank"))) {
+			t.Error("statement bank certificate not migrated")
+		}
+		stub.MockTransactionEnd("migrated rows")
+	}
+
+	// The migrated grants keep working with the certificates
+	stub.invoke(t, cc, "depositCash", "5", settlementToken, "1000", encodeCert("funder"), encodeCert("bank"))
+	stub.invoke(t, cc, "approveInvoice", "1", encodeCert("assistant"))
+}
+
+// checkMigratedKey checks that a row keyed by a raw certificate was moved
+// to the key holding its fingerprint.
+func checkMigratedKey(t *testing.T, stub *testStub, table string, rawKey []shim.Column, key []shim.Column) {
+	row, err := stub.GetRow(table, rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row.Columns) != 0 {
+		t.Errorf("%s row still keyed by the raw certificate", table)
+	}
+	row, err = stub.GetRow(table, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(row.Columns) == 0 {
+		t.Errorf("%s row not keyed by the certificate fingerprint", table)
+	}
+}
+
+func roleKey(role string, cert []byte) []shim.Column {
+	return []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: role}},
+		shim.Column{Value: &shim.Column_Bytes{Bytes: cert}},
+	}
+}
+
+func approverKey(buyerId int32, cert []byte) []shim.Column {
+	return []shim.Column{
+		shim.Column{Value: &shim.Column_Int32{Int32: buyerId}},
+		shim.Column{Value: &shim.Column_Bytes{Bytes: cert}},
+	}
+}
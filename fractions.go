@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Most units a receivable can be split into. Repayments are distributed as
+// amount * units / total, which must stay within int64 for any invoice amount.
+const maxReceivableUnits = 1000000
+
+func createFractionTables(stub shim.ChaincodeStubInterface) error {
+	// Number of units a receivable was split into
+	err := stub.CreateTable("ReceivableUnits", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Receivable", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Units", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating ReceivableUnits table.")
+	}
+
+	err = stub.CreateTable("UnitHolding", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Receivable", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "HolderId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Units", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "HolderCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating UnitHolding table.")
+	}
+
+	// Receivables each investor holds or held units of
+	err = stub.CreateTable("HolderReceivable", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "HolderId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Receivable", Type: shim.ColumnDefinition_INT32, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating HolderReceivable table.")
+	}
+
+	// Repayment distributed to each holder when a receivable is settled
+	err = stub.CreateTable("Distribution", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Receivable", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "HolderId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Date", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Distribution table.")
+	}
+
+	return nil
+}
+
+// getReceivableUnits returns the number of units a receivable was split
+// into, or zero when it was not split.
+func getReceivableUnits(stub shim.ChaincodeStubInterface, id int32) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("ReceivableUnits", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving units of receivable [%d]: [%s]", id, err)
+	}
+	if len(row.Columns) == 0 {
+		return 0, nil
+	}
+	return row.Columns[1].GetInt64(), nil
+}
+
+func getUnitHoldingRow(stub shim.ChaincodeStubInterface, id int32, holderId int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: holderId}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow("UnitHolding", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving units of holder [%d] in receivable [%d]: [%s]", holderId, id, err)
+	}
+	return row, nil
+}
+
+// getUnitHoldings returns the unit balances of a receivable by holder id.
+func getUnitHoldings(stub shim.ChaincodeStubInterface, id int32) (map[int32]int64, []int32, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("UnitHolding", columns)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed retrieving holders of receivable [%d]: [%s]", id, err)
+	}
+	units := make(map[int32]int64)
+	var holders []int32
+	for row := range rows {
+		holderId := row.Columns[1].GetInt32()
+		if row.Columns[2].GetInt64() == 0 {
+			continue
+		}
+		units[holderId] = row.Columns[2].GetInt64()
+		holders = append(holders, holderId)
+	}
+	sortInt32s(holders)
+	return units, holders, nil
+}
+
+// setUnitHolding stores the unit balance of a holder in a receivable.
+func setUnitHolding(stub shim.ChaincodeStubInterface, id int32, holderId int32, units int64, holder []byte) error {
+	current, err := getUnitHoldingRow(stub, id, holderId)
+	if err != nil {
+		return err
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: holderId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: units}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: identityOf(holder)}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("UnitHolding", row)
+		if err == nil {
+			_, err = stub.InsertRow("HolderReceivable", shim.Row{
+				Columns: []*shim.Column{
+					&shim.Column{Value: &shim.Column_Int32{Int32: holderId}},
+					&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+				},
+			})
+		}
+	} else {
+		_, err = stub.ReplaceRow("UnitHolding", row)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed storing units of holder [%d] in receivable [%d]: [%s]", holderId, id, err)
+	}
+	return nil
+}
+
+// distributeRepayment records the share of a repayment each holder of a
+// receivable is entitled to, pro rata to the units held. The rounding
+// remainder goes to the largest holder, the lowest id on a tie. A receivable
+// that was not split pays its owner in full.
+func distributeRepayment(stub shim.ChaincodeStubInterface, id int32, amount int64, date string) error {
+	receivable, err := getReceivableRow(stub, id)
+	if err != nil || len(receivable.Columns) == 0 {
+		return err
+	}
+
+	total, err := getReceivableUnits(stub, id)
+	if err != nil {
+		return err
+	}
+	units, holders, err := getUnitHoldings(stub, id)
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		ownerId := receivable.Columns[2].GetInt32()
+		total = 1
+		units = map[int32]int64{ownerId: 1}
+		holders = []int32{ownerId}
+	}
+
+	shares := make(map[int32]int64)
+	var distributed int64
+	largest := holders[0]
+	for _, holderId := range holders {
+		shares[holderId] = amount * units[holderId] / total
+		distributed += shares[holderId]
+		if units[holderId] > units[largest] {
+			largest = holderId
+		}
+	}
+	shares[largest] += amount - distributed
+
+	for _, holderId := range holders {
+		_, err = stub.InsertRow("Distribution", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: holderId}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: shares[holderId]}},
+				&shim.Column{Value: &shim.Column_String_{String_: date}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed distributing repayment of receivable [%d]: [%s]", id, err)
+		}
+	}
+	return nil
+}
+
+// getDistribution returns the share of the repayment of a receivable each
+// holder is entitled to, with the holder ids in ascending order.
+func getDistribution(stub shim.ChaincodeStubInterface, id int32) (map[int32]int64, []int32, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("Distribution", columns)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed retrieving distribution of receivable [%d]: [%s]", id, err)
+	}
+	shares := make(map[int32]int64)
+	var holders []int32
+	for row := range rows {
+		shares[row.Columns[1].GetInt32()] = row.Columns[2].GetInt64()
+		holders = append(holders, row.Columns[1].GetInt32())
+	}
+	sortInt32s(holders)
+	return shares, holders, nil
+}
+
+// settlePayment records the buyer repayment of a payment request: the
+// request is settled, the funder exposure released, the repayment
+// distributed to the holders of its receivable and the invoice paid.
+func settlePayment(stub shim.ChaincodeStubInterface, paymentRow shim.Row, amount int64, date string) error {
+	payment := paymentRow.Columns[0].GetInt32()
+
+	err := setPaymentRequestStatus(stub, paymentRow, "Settled")
+	if err != nil {
+		return err
+	}
+	err = releaseExposure(stub, payment)
+	if err != nil {
+		return err
+	}
+	err = distributeRepayment(stub, payment, amount, date)
+	if err != nil {
+		return err
+	}
+	invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return err
+	}
+	return markInvoicePaid(stub, invoiceRow, date)
+}
+
+// settle lets the owner of the receivable of a payment request record that
+// the buyer repaid the face value outside of a reconciled bank statement.
+func (t *AssetManagementChaincode) settle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Settle payment request...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("settle", throwError), throwError
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	holderId, holder, err := receivableHolder(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireParticipantCert(stub, holderId, holder, owner)
+	if err != nil {
+		return nil, err
+	}
+	status := paymentRow.Columns[5].GetString_()
+	if status != "Assigned" && status != "Funded" {
+		return nil, fmt.Errorf("Payment request [%d] is %s", payment, status)
+	}
+
+	faceValue, _, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	err = settlePayment(stub, paymentRow, faceValue, now.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Settle payment request...done!")
+
+	return nil, nil
+}
+
+// splitReceivable lets the owner of a receivable split it into units, all
+// credited to the owner, which can then be sold to investors with
+// transferUnits. The owner keeps servicing the receivable.
+func (t *AssetManagementChaincode) splitReceivable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Split receivable...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for receivable id")
+		return errorJson("splitReceivable", throwError), throwError
+	}
+	units, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || units <= 0 || units > maxReceivableUnits {
+		throwError := fmt.Errorf("Expecting integer value for units between 1 and %d", maxReceivableUnits)
+		return errorJson("splitReceivable", throwError), throwError
+	}
+
+	receivable, err := getReceivableRow(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(receivable.Columns) == 0 {
+		return nil, fmt.Errorf("Receivable [%d] does not exist", id)
+	}
+	ok, err := t.isParticipantCaller(stub, receivable.Columns[2].GetInt32(), receivable.Columns[3].GetBytes())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Caller is not allowed to do this operation")
+	}
+
+	ok, err = stub.InsertRow("ReceivableUnits", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(id)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: units}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Receivable [%d] was already split", id)
+	}
+
+	err = setUnitHolding(stub, int32(id), receivable.Columns[2].GetInt32(), units, receivable.Columns[3].GetBytes())
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Split receivable...done!")
+
+	return nil, nil
+}
+
+// transferUnits transfers units of a split receivable between holders. Only
+// the holder of the units can call this function. The certificate of the new
+// holder is only used when it does not hold units of the receivable yet.
+func (t *AssetManagementChaincode) transferUnits(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Transfer units...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for receivable id")
+		return errorJson("transferUnits", throwError), throwError
+	}
+	fromId, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for holder id")
+		return errorJson("transferUnits", throwError), throwError
+	}
+	toId, err := strconv.Atoi(args[2])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for new holder id")
+		return errorJson("transferUnits", throwError), throwError
+	}
+	to, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding new holder")
+	}
+	if len(to) == 0 {
+		return nil, errors.New("Invalid new holder. Nil")
+	}
+	units, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || units <= 0 {
+		throwError := errors.New("Expecting positive integer value for units")
+		return errorJson("transferUnits", throwError), throwError
+	}
+	if fromId == toId {
+		return nil, errors.New("Cannot transfer units to the same holder")
+	}
+
+	from, err := getUnitHoldingRow(stub, int32(id), int32(fromId))
+	if err != nil {
+		return nil, err
+	}
+	if len(from.Columns) == 0 {
+		return nil, fmt.Errorf("Participant [%d] holds no units of receivable [%d]", fromId, id)
+	}
+	ok, err := t.isParticipantCaller(stub, int32(fromId), from.Columns[3].GetBytes())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Caller is not allowed to do this operation")
+	}
+	if from.Columns[2].GetInt64() < units {
+		return nil, fmt.Errorf("Participant [%d] holds only %d units of receivable [%d]", fromId, from.Columns[2].GetInt64(), id)
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	status := paymentRow.Columns[5].GetString_()
+	if status != "Assigned" && status != "Funded" {
+		return nil, fmt.Errorf("Units of receivable [%d] cannot be transferred, payment request is %s", id, status)
+	}
+	invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoDispute(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotFrozen(stub, invoiceRow, int32(fromId), int32(toId))
+	if err != nil {
+		return nil, err
+	}
+
+	toRow, err := getUnitHoldingRow(stub, int32(id), int32(toId))
+	if err != nil {
+		return nil, err
+	}
+	// An existing holder keeps the certificate it holds its units with; a new
+	// one must name a certificate registered for it
+	var toUnits int64
+	if len(toRow.Columns) != 0 {
+		toUnits = toRow.Columns[2].GetInt64()
+		to = toRow.Columns[3].GetBytes()
+	} else {
+		ok, err = isParticipantCert(stub, int32(toId), nil, to)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("New holder certificate is not registered for participant [%d]", toId)
+		}
+	}
+
+	err = setUnitHolding(stub, int32(id), int32(fromId), from.Columns[2].GetInt64()-units, from.Columns[3].GetBytes())
+	if err != nil {
+		return nil, err
+	}
+	err = setUnitHolding(stub, int32(id), int32(toId), toUnits+units, to)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Transfer units...done!")
+
+	return nil, nil
+}
+
+// holdings reports the receivables an investor holds units of, with the
+// share of each and the repayment distributed to the investor once settled.
+func (t *AssetManagementChaincode) holdings(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query holdings...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	holderId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for holder id")
+		return errorJson("holdings", throwError), throwError
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(holderId)}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("HolderReceivable", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving receivables of holder [%d]: [%s]", holderId, err)
+	}
+	var receivables []int32
+	for row := range rows {
+		receivables = append(receivables, row.Columns[1].GetInt32())
+	}
+	sortInt32s(receivables)
+
+	entries := `[`
+	first := true
+	for _, id := range receivables {
+		holding, err := getUnitHoldingRow(stub, id, int32(holderId))
+		if err != nil {
+			return nil, err
+		}
+		total, err := getReceivableUnits(stub, id)
+		if err != nil {
+			return nil, err
+		}
+
+		var distribution []shim.Column
+		col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+		col2 := shim.Column{Value: &shim.Column_Int32{Int32: int32(holderId)}}
+		distribution = append(distribution, col1, col2)
+		distributed, err := stub.GetRow("Distribution", distribution)
+		if err != nil {
+			return nil, fmt.Errorf("Failed retrieving distribution of receivable [%d]: [%s]", id, err)
+		}
+
+		units := holding.Columns[2].GetInt64()
+		if units == 0 && len(distributed.Columns) == 0 {
+			continue
+		}
+		if !first {
+			entries += `,`
+		}
+		first = false
+		entries += `{"receivable":"` + strconv.Itoa(int(id)) + `","units":"` + strconv.FormatInt(units, 10) +
+			`","total_units":"` + strconv.FormatInt(total, 10) + `"`
+		if len(distributed.Columns) != 0 {
+			entries += `,"distributed":"` + strconv.FormatInt(distributed.Columns[2].GetInt64(), 10) +
+				`","distributed_date":"` + distributed.Columns[3].GetString_() + `"`
+		}
+		entries += `}`
+	}
+	entries += `]`
+
+	jsonResp := `{"holderId":"` + strconv.Itoa(holderId) + `","holdings":` + entries + `}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query holdings...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestDistributeRepayment(t *testing.T) {
+	tests := []struct {
+		name   string
+		units  map[int32]int64
+		amount int64
+		shares map[int32]int64
+	}{
+		{
+			name:   "not split",
+			amount: 100000,
+			shares: map[int32]int64{5: 100000},
+		},
+		{
+			name:   "even split, remainder to the lowest id",
+			units:  map[int32]int64{5: 10, 6: 10, 8: 10},
+			amount: 100,
+			shares: map[int32]int64{5: 34, 6: 33, 8: 33},
+		},
+		{
+			name:   "remainder to the largest holder",
+			units:  map[int32]int64{5: 1, 6: 2},
+			amount: 100,
+			shares: map[int32]int64{5: 33, 6: 67},
+		},
+		{
+			name:   "holder with no units left",
+			units:  map[int32]int64{5: 0, 6: 700, 8: 300},
+			amount: 1001,
+			shares: map[int32]int64{6: 701, 8: 300},
+		},
+		{
+			name:   "most units and largest amount",
+			units:  map[int32]int64{5: maxReceivableUnits - 1, 6: 1},
+			amount: 2147483647,
+			shares: map[int32]int64{5: 2147481500, 6: 2147},
+		},
+	}
+
+	for _, test := range tests {
+		_, stub := assignedRequest(t)
+		stub.MockTransactionStart(test.name)
+		if test.units != nil {
+			var total int64
+			for holderId, units := range test.units {
+				total += units
+				err := setUnitHolding(stub, 7, holderId, units, []byte("holder"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			stub.InsertRow("ReceivableUnits", shim.Row{
+				Columns: []*shim.Column{
+					&shim.Column{Value: &shim.Column_Int32{Int32: 7}},
+					&shim.Column{Value: &shim.Column_Int64{Int64: total}},
+				},
+			})
+		}
+		err := distributeRepayment(stub, 7, test.amount, "2026-11-15")
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		shares, _, err := getDistribution(stub, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(shares, test.shares) {
+			t.Errorf("%s: got shares %v, want %v", test.name, shares, test.shares)
+		}
+	}
+}
+
+func TestFractionalSettlement(t *testing.T) {
+	cc, stub := assignedRequest(t)
+	stub.invoke(t, cc, "registerCert", "8", encodeCert("investor"), "", encodeCert("admin"))
+	stub.caller = []byte("funder")
+	stub.invoke(t, cc, "splitReceivable", "7", "100")
+	stub.invoke(t, cc, "transferUnits", "7", "5", "8", encodeCert("investor"), "30")
+
+	stub.caller = []byte("investor")
+	stub.MockTransactionStart("transfer by another holder")
+	_, err := cc.Invoke(stub, "transferUnits", []string{"7", "5", "8", encodeCert("investor"), "10"})
+	stub.MockTransactionEnd("transfer by another holder")
+	if err == nil {
+		t.Error("expected a transfer of units held by someone else to be rejected")
+	}
+
+	stub.invoke(t, cc, "settle", "7", encodeCert("funder"))
+	if status := paymentRequest(t, stub, 7).Columns[5].GetString_(); status != "Settled" {
+		t.Errorf("got payment request %s, want Settled", status)
+	}
+
+	for holderId, want := range map[string]string{
+		"5": `"units":"70","total_units":"100","distributed":"70000"`,
+		"8": `"units":"30","total_units":"100","distributed":"30000"`,
+	} {
+		stub.MockTransactionStart("holdings")
+		holdings, err := cc.Query(stub, "holdings", []string{holderId})
+		stub.MockTransactionEnd("holdings")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(holdings), want) {
+			t.Errorf("holder %s: got holdings %s, want %s", holderId, holdings, want)
+		}
+	}
+}
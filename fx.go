@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// FX rates carry six decimals and are stored scaled by 10^6: the number of
+// quote currency units one base currency unit buys.
+const (
+	fxRateScale = 6
+	fxRateUnit  = 1000000
+)
+
+func createFxTables(stub shim.ChaincodeStubInterface) error {
+	// Rates posted by FX oracles, effective from their timestamp, with the
+	// fingerprint of the oracle certificate and its signature
+	err := stub.CreateTable("FxRate", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Base", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Quote", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Timestamp", Type: shim.ColumnDefinition_INT64, Key: true},
+		&shim.ColumnDefinition{Name: "Rate", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "OracleCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Signature", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating FxRate table.")
+	}
+
+	// Currency the exposures and credit limits of a participant are kept in
+	err = stub.CreateTable("BaseCurrency", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating BaseCurrency table.")
+	}
+
+	// Conversion of the exposure of a payment request, with the rate used
+	err = stub.CreateTable("FxConversion", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Kind", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "FromCurrency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "FromAmount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "ToCurrency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "ToAmount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Rate", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "RateTimestamp", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating FxConversion table.")
+	}
+
+	return nil
+}
+
+// getBaseCurrency returns the base currency of a participant, or an empty
+// string when amounts are kept in the currency of each invoice.
+func getBaseCurrency(stub shim.ChaincodeStubInterface, participantId int32) (string, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: participantId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("BaseCurrency", columns)
+	if err != nil {
+		return "", fmt.Errorf("Failed retrieving base currency of participant [%d]: [%s]", participantId, err)
+	}
+	if len(row.Columns) == 0 {
+		return "", nil
+	}
+	return row.Columns[1].GetString_(), nil
+}
+
+// fxRateAt returns the latest rate between two currencies posted at or
+// before a timestamp, together with the timestamp of that rate.
+func fxRateAt(stub shim.ChaincodeStubInterface, base string, quote string, at int64) (int64, int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: base}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: quote}}
+	columns = append(columns, col1, col2)
+
+	rows, err := stub.GetRows("FxRate", columns)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed retrieving %s/%s rates: [%s]", base, quote, err)
+	}
+	var rate, timestamp int64
+	for row := range rows {
+		posted := row.Columns[2].GetInt64()
+		if posted <= at && posted >= timestamp {
+			rate, timestamp = row.Columns[3].GetInt64(), posted
+		}
+	}
+	if rate == 0 {
+		return 0, 0, fmt.Errorf("No %s/%s rate effective at %s", base, quote, time.Unix(at, 0).UTC().Format(time.RFC3339))
+	}
+	return rate, timestamp, nil
+}
+
+// exposureCurrency returns the base currency of the participant an exposure
+// kind is held by: the funder, the buyer, or the buyer of a program.
+func exposureCurrency(stub shim.ChaincodeStubInterface, kind string, id int32) (string, error) {
+	if kind == limitProgram || kind == limitSupplier {
+		programRow, err := getProgramRow(stub, id)
+		if err != nil {
+			return "", err
+		}
+		id = programRow.Columns[1].GetInt32()
+	}
+	return getBaseCurrency(stub, id)
+}
+
+// convertExposure converts the exposure of a payment request into the base
+// currency of the participant holding it, using the rate effective at the
+// transaction timestamp, and records the conversion so that the same amount
+// is released later. Amounts in the base currency, or held by participants
+// without one, are taken as they are.
+func convertExposure(stub shim.ChaincodeStubInterface, payment int32, kind string, id int32, amount int64, currency string) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	columns = append(columns, col1, col2)
+
+	base, err := exposureCurrency(stub, kind, id)
+	if err != nil {
+		return 0, err
+	}
+	if base == "" || base == currency {
+		err = stub.DeleteRow("FxConversion", columns)
+		if err != nil {
+			return 0, fmt.Errorf("Failed clearing %s conversion of payment request [%d]: [%s]", kind, payment, err)
+		}
+		return amount, nil
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return 0, err
+	}
+	rate, timestamp, err := fxRateAt(stub, currency, base, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	// The product of amount and rate can overflow int64 before scaling down
+	product := new(big.Int).Mul(big.NewInt(amount), big.NewInt(rate))
+	product.Quo(product, big.NewInt(fxRateUnit))
+	if product.BitLen() > 63 {
+		return 0, fmt.Errorf("Converted %s exposure of payment request [%d] is out of range", kind, payment)
+	}
+	converted := product.Int64()
+
+	fmt.Printf("Converted %s exposure of payment request [%d]: %d %s at %s = %d %s\n",
+		kind, payment, amount, currency, formatDecimal(rate, fxRateScale), converted, base)
+
+	current, err := stub.GetRow("FxConversion", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving %s conversion of payment request [%d]: [%s]", kind, payment, err)
+	}
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_String_{String_: kind}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: base}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: converted}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: rate}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: timestamp}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("FxConversion", row)
+	} else {
+		_, err = stub.ReplaceRow("FxConversion", row)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed recording %s conversion of payment request [%d]: [%s]", kind, payment, err)
+	}
+	return converted, nil
+}
+
+// convertedExposure returns the amount an exposure of a payment request was
+// recorded with, which is the given amount unless it was converted.
+func convertedExposure(stub shim.ChaincodeStubInterface, payment int32, kind string, amount int64) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow("FxConversion", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving %s conversion of payment request [%d]: [%s]", kind, payment, err)
+	}
+	if len(row.Columns) == 0 {
+		return amount, nil
+	}
+	return row.Columns[5].GetInt64(), nil
+}
+
+// conversionsJson renders the currency conversions of the exposures of a
+// payment request with the rates used.
+func conversionsJson(stub shim.ChaincodeStubInterface, payment int32) (string, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("FxConversion", columns)
+	if err != nil {
+		return "", fmt.Errorf("Failed retrieving conversions of payment request [%d]: [%s]", payment, err)
+	}
+	conversions := make(map[string]string)
+	var kinds []string
+	for row := range rows {
+		kind := row.Columns[1].GetString_()
+		conversions[kind] = `{"kind":"` + kind +
+			`","from_currency":` + jsonString(row.Columns[2].GetString_()) +
+			`,"from_amount":"` + strconv.FormatInt(row.Columns[3].GetInt64(), 10) +
+			`","to_currency":` + jsonString(row.Columns[4].GetString_()) +
+			`,"to_amount":"` + strconv.FormatInt(row.Columns[5].GetInt64(), 10) +
+			`","rate":"` + formatDecimal(row.Columns[6].GetInt64(), fxRateScale) +
+			`","rate_timestamp":"` + time.Unix(row.Columns[7].GetInt64(), 0).UTC().Format(time.RFC3339) + `"}`
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) == 0 {
+		return "", nil
+	}
+	sort.Strings(kinds)
+
+	jsonResp := `,"conversions":[`
+	for i, kind := range kinds {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += conversions[kind]
+	}
+	return jsonResp + `]`, nil
+}
+
+// postFxRate records a rate between two currencies effective from its
+// timestamp. It can only be called by a certificate holding the FX oracle
+// role, and the rate must be signed by that certificate.
+func (t *AssetManagementChaincode) postFxRate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Post FX rate...")
+
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+
+	base := args[0]
+	quote := args[1]
+	if base == "" || quote == "" || base == quote {
+		return nil, errors.New("Expecting two different currencies")
+	}
+	rate, err := parseDecimal(args[2], fxRateScale)
+	if err != nil || rate <= 0 {
+		throwError := errors.New("Expecting positive decimal value for rate")
+		return errorJson("postFxRate", throwError), throwError
+	}
+	timestamp, err := time.Parse(time.RFC3339, args[3])
+	if err != nil {
+		throwError := errors.New("Expecting RFC 3339 timestamp")
+		return errorJson("postFxRate", throwError), throwError
+	}
+	signature, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding signature")
+	}
+	oracle, err := base64.StdEncoding.DecodeString(args[5])
+	if err != nil {
+		return nil, errors.New("Failed decoding oracle")
+	}
+
+	err = requireRole(stub, roleFxOracle, oracle)
+	if err != nil {
+		return nil, err
+	}
+
+	// The oracle signs base, quote, rate and timestamp separated by '|'
+	message := []byte(base + "|" + quote + "|" + args[2] + "|" + args[3])
+	ok, err := stub.VerifySignature(oracle, signature, message)
+	if err != nil {
+		return nil, fmt.Errorf("Failed verifying FX rate signature: [%s]", err)
+	}
+	if !ok {
+		return nil, errors.New("Invalid FX rate signature")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp.After(now) {
+		return nil, errors.New("FX rate timestamp is after the transaction timestamp")
+	}
+
+	ok, err = stub.InsertRow("FxRate", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: base}},
+			&shim.Column{Value: &shim.Column_String_{String_: quote}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: timestamp.Unix()}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: rate}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(oracle)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: signature}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing %s/%s rate: [%s]", base, quote, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("A %s/%s rate was already posted for %s", base, quote, args[3])
+	}
+
+	fmt.Println("Post FX rate...done!")
+
+	return nil, nil
+}
+
+// setBaseCurrency sets the currency the exposures and credit limits of a
+// participant are kept in. It can only be set once, while the participant
+// has no outstanding exposure, by a registered certificate of the participant
+// or an administrator.
+func (t *AssetManagementChaincode) setBaseCurrency(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set base currency...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("setBaseCurrency", throwError), throwError
+	}
+	currency := args[1]
+	if currency == "" {
+		return nil, errors.New("Expecting a currency")
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	err = requireParticipantAuthority(stub, int32(participantId), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := getBaseCurrency(stub, int32(participantId))
+	if err != nil {
+		return nil, err
+	}
+	if current != "" {
+		return nil, fmt.Errorf("Base currency of participant [%d] is already %s", participantId, current)
+	}
+	for _, kind := range []string{limitFunder, exposureBuyer, exposureRecourse, exposureLoss} {
+		outstanding, err := sumExposure(stub, kind, int32(participantId))
+		if err != nil {
+			return nil, err
+		}
+		if outstanding != 0 {
+			return nil, fmt.Errorf("Participant [%d] has outstanding exposure", participantId)
+		}
+	}
+
+	_, err = stub.InsertRow("BaseCurrency", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(participantId)}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(owner)}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing base currency of participant [%d]: [%s]", participantId, err)
+	}
+
+	fmt.Println("Set base currency...done!")
+
+	return nil, nil
+}
+
+// setInvoiceCurrency sets the currency of an invoice created without one.
+// Only the supplier can call this function, while the invoice is pending.
+// Payment requests on the invoice are in the same currency.
+func (t *AssetManagementChaincode) setInvoiceCurrency(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set invoice currency...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("setInvoiceCurrency", throwError), throwError
+	}
+	currency := args[1]
+	if currency == "" {
+		return nil, errors.New("Expecting a currency")
+	}
+	supplier, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding supplier")
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, invoiceRow.Columns[6].GetInt32(), invoiceRow.Columns[8].GetBytes(), supplier)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	if invoiceRow.Columns[2].GetString_() != "Pending" {
+		return nil, fmt.Errorf("Invoice [%d] is %s", number, invoiceRow.Columns[2].GetString_())
+	}
+
+	ok, err = stub.InsertRow("InvoiceCurrency", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing currency of invoice [%d]: [%s]", number, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invoice [%d] already has a currency", number)
+	}
+
+	fmt.Println("Set invoice currency...done!")
+
+	return nil, nil
+}
+
+// fx_rate returns the rate between two currencies effective at the
+// transaction timestamp, or at the given RFC 3339 timestamp.
+func (t *AssetManagementChaincode) fx_rate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query FX rate...")
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	base := args[0]
+	quote := args[1]
+	at, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 3 {
+		at, err = time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			throwError := errors.New("Expecting RFC 3339 timestamp")
+			return errorJson("fx_rate", throwError), throwError
+		}
+	}
+
+	rate, timestamp, err := fxRateAt(stub, base, quote, at.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	jsonResp := `{"base":` + jsonString(base) + `,"quote":` + jsonString(quote) +
+		`,"rate":"` + formatDecimal(rate, fxRateScale) +
+		`","timestamp":"` + time.Unix(timestamp, 0).UTC().Format(time.RFC3339) + `"}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query FX rate...done!")
+
+	return []byte(jsonResp), nil
+}
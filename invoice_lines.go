@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Number of positional arguments describing a single invoice line:
+// description, sku, quantity, unitPrice, taxRate, taxAmount.
+const invoiceLineArgs = 6
+
+// invoiceLine is one line item of an invoice. Amounts are in the same unit
+// as the invoice Price, tax rates are expressed in basis points (1900 = 19%).
+type invoiceLine struct {
+	Description string
+	Sku         string
+	Quantity    int32
+	UnitPrice   int32
+	TaxRate     int32
+	TaxAmount   int32
+}
+
+// net returns the line amount before tax.
+func (l invoiceLine) net() int64 {
+	return int64(l.Quantity) * int64(l.UnitPrice)
+}
+
+func createInvoiceLineTable(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("InvoiceLine", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Line", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Description", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Sku", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Quantity", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "UnitPrice", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "TaxRate", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "TaxAmount", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating InvoiceLine table.")
+	}
+	return nil
+}
+
+// parseInvoiceLines reads line items given as consecutive groups of
+// invoiceLineArgs positional arguments.
+func parseInvoiceLines(args []string) ([]invoiceLine, error) {
+	if len(args)%invoiceLineArgs != 0 {
+		return nil, fmt.Errorf("Expecting %d arguments per invoice line", invoiceLineArgs)
+	}
+
+	var lines []invoiceLine
+	for i := 0; i < len(args); i += invoiceLineArgs {
+		lineNo := i/invoiceLineArgs + 1
+
+		quantity, err := strconv.Atoi(args[i+2])
+		if err != nil || quantity <= 0 {
+			return nil, fmt.Errorf("Expecting positive integer value for quantity of line %d", lineNo)
+		}
+		unitPrice, err := strconv.Atoi(args[i+3])
+		if err != nil || unitPrice < 0 {
+			return nil, fmt.Errorf("Expecting non-negative integer value for unit price of line %d", lineNo)
+		}
+		taxRate, err := strconv.Atoi(args[i+4])
+		if err != nil || taxRate < 0 {
+			return nil, fmt.Errorf("Expecting non-negative integer value for tax rate of line %d", lineNo)
+		}
+		taxAmount, err := strconv.Atoi(args[i+5])
+		if err != nil || taxAmount < 0 {
+			return nil, fmt.Errorf("Expecting non-negative integer value for tax amount of line %d", lineNo)
+		}
+
+		line := invoiceLine{
+			Description: args[i],
+			Sku:         args[i+1],
+			Quantity:    int32(quantity),
+			UnitPrice:   int32(unitPrice),
+			TaxRate:     int32(taxRate),
+			TaxAmount:   int32(taxAmount),
+		}
+
+		// Allow one unit of rounding difference between the supplied tax
+		// amount and the one computed from the rate.
+		expectedTax := (line.net()*int64(line.TaxRate) + 5000) / 10000
+		diff := expectedTax - int64(line.TaxAmount)
+		if diff > 1 || diff < -1 {
+			return nil, fmt.Errorf("Tax amount of line %d does not match its tax rate. Expected [%d], got [%d]", lineNo, expectedTax, line.TaxAmount)
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// checkInvoiceLineTotals verifies that the lines add up to the invoice price.
+func checkInvoiceLineTotals(lines []invoiceLine, price int32) error {
+	var total int64
+	for _, line := range lines {
+		total += line.net() + int64(line.TaxAmount)
+	}
+	if total != int64(price) {
+		return fmt.Errorf("Invoice lines total [%d] does not match invoice price [%d]", total, price)
+	}
+	return nil
+}
+
+func insertInvoiceLines(stub shim.ChaincodeStubInterface, number int32, lines []invoiceLine) error {
+	for i, line := range lines {
+		ok, err := stub.InsertRow("InvoiceLine", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: number}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(i + 1)}},
+				&shim.Column{Value: &shim.Column_String_{String_: line.Description}},
+				&shim.Column{Value: &shim.Column_String_{String_: line.Sku}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: line.Quantity}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: line.UnitPrice}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: line.TaxRate}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: line.TaxAmount}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed inserting line %d of invoice [%d]: [%s]", i+1, number, err)
+		}
+		if !ok {
+			return fmt.Errorf("Line %d of invoice [%d] was already created.", i+1, number)
+		}
+	}
+	return nil
+}
+
+func getInvoiceLines(stub shim.ChaincodeStubInterface, number int32) ([]invoiceLine, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("InvoiceLine", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving lines of invoice [%d]: [%s]", number, err)
+	}
+
+	byLine := make(map[int32]invoiceLine)
+	var lineNumbers []int
+	for row := range rows {
+		lineNo := row.Columns[1].GetInt32()
+		byLine[lineNo] = invoiceLine{
+			Description: row.Columns[2].GetString_(),
+			Sku:         row.Columns[3].GetString_(),
+			Quantity:    row.Columns[4].GetInt32(),
+			UnitPrice:   row.Columns[5].GetInt32(),
+			TaxRate:     row.Columns[6].GetInt32(),
+			TaxAmount:   row.Columns[7].GetInt32(),
+		}
+		lineNumbers = append(lineNumbers, int(lineNo))
+	}
+	sort.Ints(lineNumbers)
+
+	lines := make([]invoiceLine, 0, len(lineNumbers))
+	for _, lineNo := range lineNumbers {
+		lines = append(lines, byLine[int32(lineNo)])
+	}
+	return lines, nil
+}
+
+// invoiceLinesJson renders the line items and the tax summary per rate as
+// JSON object members, to be embedded in the invoice_info response.
+func invoiceLinesJson(lines []invoiceLine) string {
+	jsonResp := `"lines":[`
+	for i, line := range lines {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += `{"line":"` + strconv.Itoa(i+1) + `","description":` + jsonString(line.Description) +
+			`,"sku":` + jsonString(line.Sku) + `,"quantity":"` + strconv.Itoa(int(line.Quantity)) +
+			`","unit_price":"` + strconv.Itoa(int(line.UnitPrice)) + `","tax_rate":"` + strconv.Itoa(int(line.TaxRate)) +
+			`","tax_amount":"` + strconv.Itoa(int(line.TaxAmount)) + `"}`
+	}
+	jsonResp += `]`
+
+	taxable := make(map[int32]int64)
+	tax := make(map[int32]int64)
+	var rates []int
+	for _, line := range lines {
+		if _, ok := taxable[line.TaxRate]; !ok {
+			rates = append(rates, int(line.TaxRate))
+		}
+		taxable[line.TaxRate] += line.net()
+		tax[line.TaxRate] += int64(line.TaxAmount)
+	}
+	sort.Ints(rates)
+
+	jsonResp += `,"tax_summary":[`
+	for i, rate := range rates {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += `{"tax_rate":"` + strconv.Itoa(rate) + `","taxable_amount":"` + strconv.FormatInt(taxable[int32(rate)], 10) +
+			`","tax_amount":"` + strconv.FormatInt(tax[int32(rate)], 10) + `"}`
+	}
+	jsonResp += `]`
+
+	return jsonResp
+}
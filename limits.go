@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Kinds of credit limits and exposures. A funder limit caps what a funder
+// has outstanding on a buyer, a program limit caps the funding of a program
+// and a supplier limit caps what a single supplier has outstanding under a
+// program.
+const (
+	limitFunder   = "funder"
+	limitProgram  = "program"
+	limitSupplier = "supplier"
+	// Mirror of the funder exposures keyed by buyer first
+	exposureBuyer = "buyer"
+)
+
+func createLimitTables(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("CreditLimit", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Kind", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "CounterpartyId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Limit", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating CreditLimit table.")
+	}
+
+	err = stub.CreateTable("Exposure", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Kind", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "CounterpartyId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Outstanding", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Exposure table.")
+	}
+
+	// Exposure taken when a payment request was assigned, released when it
+	// is settled
+	err = stub.CreateTable("PaymentExposure", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "FunderId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Program", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "SupplierId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PaymentExposure table.")
+	}
+
+	return nil
+}
+
+func limitKey(kind string, id int32, counterpartyId int32) []shim.Column {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	col3 := shim.Column{Value: &shim.Column_Int32{Int32: counterpartyId}}
+	columns = append(columns, col1, col2, col3)
+	return columns
+}
+
+// getCreditLimitRow returns a credit limit, or an empty row when none is set.
+func getCreditLimitRow(stub shim.ChaincodeStubInterface, kind string, id int32, counterpartyId int32) (shim.Row, error) {
+	row, err := stub.GetRow("CreditLimit", limitKey(kind, id, counterpartyId))
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving %s limit [%d/%d]: [%s]", kind, id, counterpartyId, err)
+	}
+	return row, nil
+}
+
+func getExposureRow(stub shim.ChaincodeStubInterface, kind string, id int32, counterpartyId int32) (shim.Row, error) {
+	row, err := stub.GetRow("Exposure", limitKey(kind, id, counterpartyId))
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving %s exposure [%d/%d]: [%s]", kind, id, counterpartyId, err)
+	}
+	return row, nil
+}
+
+func getExposure(stub shim.ChaincodeStubInterface, kind string, id int32, counterpartyId int32) (int64, error) {
+	row, err := getExposureRow(stub, kind, id, counterpartyId)
+	if err != nil || len(row.Columns) == 0 {
+		return 0, err
+	}
+	return row.Columns[3].GetInt64(), nil
+}
+
+// addExposure adds an amount, negative when it is released, to an
+// outstanding exposure. It fails rather than let the exposure fall below
+// zero, which would mean more was released than was ever taken.
+func addExposure(stub shim.ChaincodeStubInterface, kind string, id int32, counterpartyId int32, amount int64) error {
+	current, err := getExposureRow(stub, kind, id, counterpartyId)
+	if err != nil {
+		return err
+	}
+	var outstanding int64
+	if len(current.Columns) != 0 {
+		outstanding = current.Columns[3].GetInt64()
+	}
+	outstanding += amount
+	if outstanding < 0 {
+		return fmt.Errorf("Releasing [%d] from %s exposure [%d/%d] would leave it negative", -amount, kind, id, counterpartyId)
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: kind}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: counterpartyId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: outstanding}},
+		},
+	}
+	if len(current.Columns) == 0 {
+		_, err = stub.InsertRow("Exposure", row)
+	} else {
+		_, err = stub.ReplaceRow("Exposure", row)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed updating %s exposure [%d/%d]: [%s]", kind, id, counterpartyId, err)
+	}
+	return nil
+}
+
+// sumExposure totals the exposures of a kind held by an id.
+func sumExposure(stub shim.ChaincodeStubInterface, kind string, id int32) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1, col2)
+
+	rows, err := stub.GetRows("Exposure", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving %s exposure [%d]: [%s]", kind, id, err)
+	}
+	var total int64
+	for row := range rows {
+		total += row.Columns[3].GetInt64()
+	}
+	return total, nil
+}
+
+// checkLimit fails when adding an amount to an exposure would breach the
+// corresponding credit limit, if one is set.
+func checkLimit(stub shim.ChaincodeStubInterface, kind string, id int32, counterpartyId int32, amount int64) error {
+	limit, err := getCreditLimitRow(stub, kind, id, counterpartyId)
+	if err != nil || len(limit.Columns) == 0 {
+		return err
+	}
+	outstanding, err := getExposure(stub, kind, id, counterpartyId)
+	if err != nil {
+		return err
+	}
+	if outstanding+amount > limit.Columns[3].GetInt64() {
+		return fmt.Errorf("Assignment breaches the %s limit [%d/%d]: outstanding %d, limit %d, requested %d",
+			kind, id, counterpartyId, outstanding, limit.Columns[3].GetInt64(), amount)
+	}
+	return nil
+}
+
+// takeExposure checks the credit limits involved in assigning a payment
+// request to a funder and records the face value as outstanding.
+func takeExposure(stub shim.ChaincodeStubInterface, paymentRow shim.Row, invoiceRow shim.Row, funderId int32) error {
+	payment := paymentRow.Columns[0].GetInt32()
+	buyerId := invoiceRow.Columns[7].GetInt32()
+	supplierId := invoiceRow.Columns[6].GetInt32()
+
+	amount, _, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return err
+	}
+	currency, err := settlementCurrency(stub, invoiceRow.Columns[0].GetInt32())
+	if err != nil {
+		return err
+	}
+
+	program := int32(0)
+	paymentProgram, err := getPaymentProgramRow(stub, payment)
+	if err != nil {
+		return err
+	}
+	if len(paymentProgram.Columns) != 0 {
+		program = paymentProgram.Columns[1].GetInt32()
+	}
+
+	// Exposures and limits are kept in the base currency of their holder
+	funderAmount, err := convertExposure(stub, payment, limitFunder, funderId, amount, currency)
+	if err != nil {
+		return err
+	}
+	buyerAmount, err := convertExposure(stub, payment, exposureBuyer, buyerId, amount, currency)
+	if err != nil {
+		return err
+	}
+	var supplierAmount int64
+	if program != 0 {
+		supplierAmount, err = convertExposure(stub, payment, limitSupplier, program, amount, currency)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkLimit(stub, limitFunder, funderId, buyerId, funderAmount)
+	if err != nil {
+		return err
+	}
+	if program != 0 {
+		err = checkLimit(stub, limitSupplier, program, supplierId, supplierAmount)
+		if err != nil {
+			return err
+		}
+	}
+
+	ok, err := stub.InsertRow("PaymentExposure", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: funderId}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: buyerId}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: program}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: supplierId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Exposure of payment request [%d] was already taken", payment)
+	}
+
+	err = addExposure(stub, limitFunder, funderId, buyerId, funderAmount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, exposureBuyer, buyerId, funderId, buyerAmount)
+	if err != nil {
+		return err
+	}
+	if program != 0 {
+		err = addExposure(stub, limitSupplier, program, supplierId, supplierAmount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseExposure removes the outstanding amount of a payment request that
+// was settled. Requests without recorded exposure are ignored.
+func releaseExposure(stub shim.ChaincodeStubInterface, payment int32) error {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentExposure", columns)
+	if err != nil {
+		return fmt.Errorf("Failed retrieving exposure of payment request [%d]: [%s]", payment, err)
+	}
+	if len(row.Columns) == 0 {
+		return nil
+	}
+
+	funderId := row.Columns[1].GetInt32()
+	buyerId := row.Columns[2].GetInt32()
+	program := row.Columns[3].GetInt32()
+	amount := row.Columns[5].GetInt64()
+
+	funderAmount, err := convertedExposure(stub, payment, limitFunder, amount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, limitFunder, funderId, buyerId, -funderAmount)
+	if err != nil {
+		return err
+	}
+	buyerAmount, err := convertedExposure(stub, payment, exposureBuyer, amount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, exposureBuyer, buyerId, funderId, -buyerAmount)
+	if err != nil {
+		return err
+	}
+	if program != 0 {
+		supplierAmount, err := convertedExposure(stub, payment, limitSupplier, amount)
+		if err != nil {
+			return err
+		}
+		err = addExposure(stub, limitSupplier, program, row.Columns[4].GetInt32(), -supplierAmount)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = stub.DeleteRow("PaymentExposure", columns)
+	if err != nil {
+		return fmt.Errorf("Failed releasing exposure of payment request [%d]: [%s]", payment, err)
+	}
+	return nil
+}
+
+// setCreditLimit sets a funder limit on a buyer, the funding limit of a
+// program or the supplier concentration limit of a program. Program and
+// supplier limits are set by the buyer of the program, funder limits by a
+// registered certificate of the funder. A negative limit removes a funder or
+// supplier limit.
+func (t *AssetManagementChaincode) setCreditLimit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Set credit limit...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	kind := args[0]
+	if kind != limitFunder && kind != limitProgram && kind != limitSupplier {
+		return nil, fmt.Errorf("Unknown credit limit kind [%s]", kind)
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for id")
+		return errorJson("setCreditLimit", throwError), throwError
+	}
+	counterpartyId, err := strconv.Atoi(args[2])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for counterparty id")
+		return errorJson("setCreditLimit", throwError), throwError
+	}
+	limit, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		throwError := errors.New("Expecting integer value for limit")
+		return errorJson("setCreditLimit", throwError), throwError
+	}
+	owner, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	if kind == limitProgram || kind == limitSupplier {
+		programRow, err := getProgramRow(stub, int32(id))
+		if err != nil {
+			return nil, err
+		}
+		err = requireParticipantCert(stub, programRow.Columns[1].GetInt32(), programRow.Columns[7].GetBytes(), owner)
+		if err != nil {
+			return nil, err
+		}
+		if kind == limitProgram {
+			if limit <= 0 {
+				return nil, errors.New("Expecting positive program funding limit")
+			}
+			programRow.Columns[2] = &shim.Column{Value: &shim.Column_Int64{Int64: limit}}
+			_, err = stub.ReplaceRow("Program", programRow)
+			if err != nil {
+				return nil, fmt.Errorf("Failed updating funding limit of program [%d]: [%s]", id, err)
+			}
+			fmt.Println("Set credit limit...done!")
+			return nil, nil
+		}
+	}
+
+	limitRow, err := getCreditLimitRow(stub, kind, int32(id), int32(counterpartyId))
+	if err != nil {
+		return nil, err
+	}
+	if kind == limitFunder {
+		err = requireParticipantCert(stub, int32(id), nil, owner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if limit < 0 {
+		err = stub.DeleteRow("CreditLimit", limitKey(kind, int32(id), int32(counterpartyId)))
+	} else {
+		row := shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: kind}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(id)}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(counterpartyId)}},
+				&shim.Column{Value: &shim.Column_Int64{Int64: limit}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(owner)}},
+			},
+		}
+		if len(limitRow.Columns) == 0 {
+			_, err = stub.InsertRow("CreditLimit", row)
+		} else {
+			_, err = stub.ReplaceRow("CreditLimit", row)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing %s limit [%d/%d]: [%s]", kind, id, counterpartyId, err)
+	}
+
+	fmt.Println("Set credit limit...done!")
+
+	return nil, nil
+}
+
+// exposure reports the outstanding amounts of a funder per buyer, or of a
+// buyer per funder, together with the funder limits that apply. Amounts are
+// in the base currency of the participant when one is set.
+func (t *AssetManagementChaincode) exposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query exposure...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	kind := args[0]
+	if kind != limitFunder && kind != exposureBuyer {
+		return nil, fmt.Errorf("Unknown exposure kind [%s]", kind)
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for id")
+		return errorJson("exposure", throwError), throwError
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: int32(id)}}
+	columns = append(columns, col1, col2)
+
+	rows, err := stub.GetRows("Exposure", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving %s exposure [%d]: [%s]", kind, id, err)
+	}
+	outstanding := make(map[int32]int64)
+	var counterparties []int32
+	for row := range rows {
+		counterparty := row.Columns[2].GetInt32()
+		outstanding[counterparty] = row.Columns[3].GetInt64()
+		counterparties = append(counterparties, counterparty)
+	}
+	sortInt32s(counterparties)
+
+	counterpartyName := "buyerId"
+	if kind == exposureBuyer {
+		counterpartyName = "funderId"
+	}
+
+	var total int64
+	entries := `[`
+	for i, counterparty := range counterparties {
+		funderId, buyerId := int32(id), counterparty
+		if kind == exposureBuyer {
+			funderId, buyerId = counterparty, int32(id)
+		}
+		limit, err := getCreditLimitRow(stub, limitFunder, funderId, buyerId)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			entries += `,`
+		}
+		entries += `{"` + counterpartyName + `":"` + strconv.Itoa(int(counterparty)) +
+			`","outstanding":"` + strconv.FormatInt(outstanding[counterparty], 10) + `"`
+		if len(limit.Columns) != 0 {
+			entries += `,"limit":"` + strconv.FormatInt(limit.Columns[3].GetInt64(), 10) + `"`
+		}
+		entries += `}`
+		total += outstanding[counterparty]
+	}
+	entries += `]`
+
+	currency, err := getBaseCurrency(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+
+	jsonResp := `{"` + kind + `Id":"` + strconv.Itoa(id) + `","outstanding":"` + strconv.FormatInt(total, 10) +
+		`","exposures":` + entries
+	if currency != "" {
+		jsonResp += `,"currency":` + jsonString(currency)
+	}
+	if kind == limitFunder {
+		recourse, err := sumExposure(stub, exposureRecourse, int32(id))
+		if err != nil {
+			return nil, err
+		}
+		losses, err := sumExposure(stub, exposureLoss, int32(id))
+		if err != nil {
+			return nil, err
+		}
+		jsonResp += `,"recourse":"` + strconv.FormatInt(recourse, 10) + `","losses":"` + strconv.FormatInt(losses, 10) + `"`
+	}
+	jsonResp += `}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query exposure...done!")
+
+	return []byte(jsonResp), nil
+}
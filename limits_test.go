@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddExposure(t *testing.T) {
+	tests := []struct {
+		name        string
+		amounts     []int64
+		outstanding int64
+		fails       bool
+	}{
+		{name: "first exposure", amounts: []int64{100000}, outstanding: 100000},
+		{name: "exposures add up", amounts: []int64{100000, 50000}, outstanding: 150000},
+		{name: "partial release", amounts: []int64{100000, -40000}, outstanding: 60000},
+		{name: "full release", amounts: []int64{100000, -100000}, outstanding: 0},
+		{name: "release of more than taken", amounts: []int64{100000, -100001}, fails: true},
+		{name: "release of nothing taken", amounts: []int64{-1}, fails: true},
+	}
+
+	for _, test := range tests {
+		_, stub := newTestStub(t)
+		stub.MockTransactionStart(test.name)
+		var err error
+		for _, amount := range test.amounts {
+			err = addExposure(stub, limitFunder, 5, 4, amount)
+			if err != nil {
+				break
+			}
+		}
+		stub.MockTransactionEnd(test.name)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		outstanding, err := getExposure(stub, limitFunder, 5, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outstanding != test.outstanding {
+			t.Errorf("%s: got outstanding %d, want %d", test.name, outstanding, test.outstanding)
+		}
+	}
+}
+
+func TestTakeAndReleaseExposure(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit string
+		fails bool
+	}{
+		{name: "no funder limit"},
+		{name: "within the funder limit", limit: "150000"},
+		{name: "at the funder limit", limit: "100000"},
+		{name: "over the funder limit", limit: "99999", fails: true},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		if test.limit != "" {
+			stub.invoke(t, cc, "setCreditLimit", limitFunder, "5", "4", test.limit, encodeCert("funder"))
+		}
+		stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+		stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+		stub.invoke(t, cc, "createPaymentRequest", "7", "1", "2", "2026-10-01", encodeCert("buyer"))
+		invoiceRow, err := getInvoiceRow(stub, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stub.MockTransactionStart(test.name)
+		err = takeExposure(stub, paymentRequest(t, stub, 7), invoiceRow, 5)
+		stub.MockTransactionEnd(test.name)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		checkExposures(t, test.name+", taken", stub, 100000)
+
+		for i := 0; i < 2; i++ {
+			stub.MockTransactionStart(test.name)
+			err = releaseExposure(stub, 7)
+			stub.MockTransactionEnd(test.name)
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			checkExposures(t, test.name+", released", stub, 0)
+		}
+	}
+}
+
+// checkExposures compares the exposure of funder 5 on buyer 4 and of buyer 4
+// to funder 5 with the amount outstanding on payment request 7.
+func checkExposures(t *testing.T, name string, stub *testStub, outstanding int64) {
+	funder, err := getExposure(stub, limitFunder, 5, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buyer, err := getExposure(stub, exposureBuyer, 4, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if funder != outstanding || buyer != outstanding {
+		t.Errorf("%s: got funder exposure %d and buyer exposure %d, want %d", name, funder, buyer, outstanding)
+	}
+}
+
+func TestAssignmentLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(cc *AssetManagementChaincode, stub *testStub)
+		fails bool
+	}{
+		{name: "no limits"},
+		{
+			name: "over the funder limit",
+			setup: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "setCreditLimit", limitFunder, "5", "4", "99999", encodeCert("funder"))
+			},
+			fails: true,
+		},
+		{
+			name: "at the supplier limit",
+			setup: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "setCreditLimit", limitSupplier, "2", "3", "100000", encodeCert("buyer"))
+			},
+		},
+		{
+			name: "over the supplier limit",
+			setup: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "setCreditLimit", limitSupplier, "2", "3", "99999", encodeCert("buyer"))
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		cc, stub := programRequest(t)
+		stub.invoke(t, cc, "updateProgramParticipant", "2", programFunder, "5", "true", encodeCert("buyer"))
+		if test.setup != nil {
+			test.setup(cc, stub)
+		}
+
+		stub.MockTransactionStart(test.name)
+		_, err := cc.Invoke(stub, "assignPaymentRequest", []string{"7", "5", encodeCert("funder")})
+		stub.MockTransactionEnd(test.name)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			if payer := paymentRequest(t, stub, 7).Columns[3].GetInt32(); payer != -1 {
+				t.Errorf("%s: got payer %d, want the request unassigned", test.name, payer)
+			}
+			checkExposures(t, test.name, stub, 0)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		checkExposures(t, test.name, stub, 100000)
+
+		stub.MockTransactionStart(test.name)
+		exposure, err := cc.Query(stub, "exposure", []string{limitFunder, "5"})
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if want := `"exposures":[{"buyerId":"4","outstanding":"100000"}]`; !strings.Contains(string(exposure), want) {
+			t.Errorf("%s: got exposure %s, want %s", test.name, exposure, want)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createNettingTables(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("NettingCycle", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "PeriodStart", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "PeriodEnd", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "RunDate", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating NettingCycle table.")
+	}
+
+	// Gross and net amounts each participant pays and receives in a cycle
+	err = stub.CreateTable("NettingPosition", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Cycle", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Pay", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Receive", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "NetPay", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "NetReceive", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating NettingPosition table.")
+	}
+
+	// Invoices and payment requests covered by a cycle
+	err = stub.CreateTable("NettingItem", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Cycle", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Entity", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "EntityId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating NettingItem table.")
+	}
+
+	// Marks an invoice or payment request as settled by a netting cycle
+	err = stub.CreateTable("NettedBy", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Entity", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "EntityId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Cycle", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating NettedBy table.")
+	}
+
+	return nil
+}
+
+// nettingPositions accumulates what each participant pays and receives in
+// a cycle, per currency and participant.
+type nettingPositions map[string]map[int32][]int64
+
+func (p nettingPositions) add(currency string, fromId int32, toId int32, amount int64) {
+	if p[currency] == nil {
+		p[currency] = make(map[int32][]int64)
+	}
+	for _, id := range []int32{fromId, toId} {
+		if p[currency][id] == nil {
+			p[currency][id] = make([]int64, 2)
+		}
+	}
+	p[currency][fromId][0] += amount
+	p[currency][toId][1] += amount
+}
+
+func insertNettingItem(stub shim.ChaincodeStubInterface, cycle int32, entity string, id int32, amount int64, currency string) error {
+	_, err := stub.InsertRow("NettingItem", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: cycle}},
+			&shim.Column{Value: &shim.Column_String_{String_: entity}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed recording %s [%d] in netting cycle [%d]: [%s]", entity, id, cycle, err)
+	}
+
+	ok, err := stub.InsertRow("NettedBy", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: entity}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: id}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: cycle}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed marking %s [%d] as netted: [%s]", entity, id, err)
+	}
+	if !ok {
+		return fmt.Errorf("The %s [%d] was already netted", entity, id)
+	}
+	return nil
+}
+
+// netInvoice adds the obligations of an approved invoice to a cycle. Funded
+// payment requests are repaid by the buyer to the holders of their
+// receivables; without one the buyer pays the supplier the invoice price.
+// Either way the obligations are marked settled by the cycle.
+func netInvoice(stub shim.ChaincodeStubInterface, cycle int32, number int32, start string, end string, date string, positions nettingPositions) error {
+	invoiceRow, err := getInvoiceRow(stub, number)
+	if err != nil {
+		return err
+	}
+	if invoiceRow.Columns[2].GetString_() != "Approved" {
+		return fmt.Errorf("Invoice [%d] is %s", number, invoiceRow.Columns[2].GetString_())
+	}
+	dueDate := invoiceRow.Columns[5].GetString_()
+	if dueDate < start || dueDate > end {
+		return fmt.Errorf("Invoice [%d] is not due in the netting period", number)
+	}
+	disputed, err := isDisputed(stub, number)
+	if err != nil {
+		return err
+	}
+	if disputed {
+		return fmt.Errorf("Invoice [%d] is under dispute", number)
+	}
+
+	payments, err := getInvoicePayments(stub, number)
+	if err != nil {
+		return err
+	}
+	var funded []shim.Row
+	for _, payment := range payments {
+		paymentRow, err := getPaymentRequestRow(stub, payment)
+		if err != nil {
+			return err
+		}
+		switch paymentRow.Columns[5].GetString_() {
+		case "Funded":
+			funded = append(funded, paymentRow)
+		case "Cancelled", "Settled":
+		default:
+			return fmt.Errorf("Payment request [%d] of invoice [%d] is %s", payment, number, paymentRow.Columns[5].GetString_())
+		}
+	}
+
+	currency, err := settlementCurrency(stub, number)
+	if err != nil {
+		return err
+	}
+	buyerId := invoiceRow.Columns[7].GetInt32()
+	price, err := invoiceAmount(stub, invoiceRow)
+	if err != nil {
+		return err
+	}
+
+	if len(funded) == 0 {
+		positions.add(currency, buyerId, invoiceRow.Columns[6].GetInt32(), price)
+		err = markInvoicePaid(stub, invoiceRow, date)
+		if err != nil {
+			return err
+		}
+		return insertNettingItem(stub, cycle, documentEntityInvoice, number, price, currency)
+	}
+
+	for _, paymentRow := range funded {
+		payment := paymentRow.Columns[0].GetInt32()
+		faceValue, _, err := paymentAmounts(stub, paymentRow)
+		if err != nil {
+			return err
+		}
+		err = settlePayment(stub, paymentRow, faceValue, date)
+		if err != nil {
+			return err
+		}
+
+		shares, holders, err := getDistribution(stub, payment)
+		if err != nil {
+			return err
+		}
+		if len(holders) == 0 {
+			positions.add(currency, buyerId, paymentRow.Columns[3].GetInt32(), faceValue)
+		}
+		for _, holderId := range holders {
+			positions.add(currency, buyerId, holderId, shares[holderId])
+		}
+
+		err = insertNettingItem(stub, cycle, documentEntityPayment, payment, faceValue, currency)
+		if err != nil {
+			return err
+		}
+	}
+	return insertNettingItem(stub, cycle, documentEntityInvoice, number, price, currency)
+}
+
+// runNettingCycle settles a set of approved invoices due in a period, and
+// the funded payment requests on them, by netting what participants owe
+// each other. The cycle records the net amount each participant pays or
+// receives per currency, to be settled in one transfer each outside of the
+// cycle. Only a bank can run a netting cycle.
+func (t *AssetManagementChaincode) runNettingCycle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Run netting cycle...")
+
+	if len(args) < 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting cycle, period, bank and at least one invoice")
+	}
+
+	cycle, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for netting cycle id")
+		return errorJson("runNettingCycle", throwError), throwError
+	}
+	start, err := parseDate(args[1])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseDate(args[2])
+	if err != nil {
+		return nil, err
+	}
+	if end.Before(start) {
+		return nil, errors.New("Netting period ends before it starts")
+	}
+	bank, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding bank")
+	}
+
+	err = requireRole(stub, roleBank, bank)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	date := now.Format(dateLayout)
+
+	ok, err := stub.InsertRow("NettingCycle", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(cycle)}},
+			&shim.Column{Value: &shim.Column_String_{String_: start.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_String_{String_: end.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_String_{String_: date}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed inserting netting cycle [%d]: [%s]", cycle, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Netting cycle [%d] already exists", cycle)
+	}
+
+	positions := make(nettingPositions)
+	for _, arg := range args[4:] {
+		number, err := strconv.Atoi(arg)
+		if err != nil {
+			throwError := errors.New("Expecting integer value for invoice number")
+			return errorJson("runNettingCycle", throwError), throwError
+		}
+		err = netInvoice(stub, int32(cycle), int32(number), start.Format(dateLayout), end.Format(dateLayout), date, positions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var currencies []string
+	for currency := range positions {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		var participants []int32
+		for participantId := range positions[currency] {
+			participants = append(participants, participantId)
+		}
+		sortInt32s(participants)
+
+		for _, participantId := range participants {
+			pay, receive := positions[currency][participantId][0], positions[currency][participantId][1]
+			var netPay, netReceive int64
+			if pay > receive {
+				netPay = pay - receive
+			} else {
+				netReceive = receive - pay
+			}
+			fmt.Printf("Netting cycle [%d]: participant [%d] pays %d %s, receives %d %s\n", cycle, participantId, netPay, currency, netReceive, currency)
+
+			_, err = stub.InsertRow("NettingPosition", shim.Row{
+				Columns: []*shim.Column{
+					&shim.Column{Value: &shim.Column_Int32{Int32: int32(cycle)}},
+					&shim.Column{Value: &shim.Column_String_{String_: currency}},
+					&shim.Column{Value: &shim.Column_Int32{Int32: participantId}},
+					&shim.Column{Value: &shim.Column_Int64{Int64: pay}},
+					&shim.Column{Value: &shim.Column_Int64{Int64: receive}},
+					&shim.Column{Value: &shim.Column_Int64{Int64: netPay}},
+					&shim.Column{Value: &shim.Column_Int64{Int64: netReceive}},
+				},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Failed recording position of participant [%d] in netting cycle [%d]: [%s]", participantId, cycle, err)
+			}
+		}
+	}
+
+	fmt.Println("Run netting cycle...done!")
+
+	return nil, nil
+}
+
+// nettingJson renders the netting cycle that settled an invoice or payment
+// request, or nothing when it was not netted.
+func nettingJson(stub shim.ChaincodeStubInterface, entity string, id int32) (string, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: entity}}
+	col2 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1, col2)
+
+	row, err := stub.GetRow("NettedBy", columns)
+	if err != nil {
+		return "", fmt.Errorf("Failed retrieving netting of %s [%d]: [%s]", entity, id, err)
+	}
+	if len(row.Columns) == 0 {
+		return "", nil
+	}
+	return `,"settled_by_netting":"` + strconv.Itoa(int(row.Columns[2].GetInt32())) + `"`, nil
+}
+
+func (t *AssetManagementChaincode) netting_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query netting cycle...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	cycle, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for netting cycle id")
+		return errorJson("netting_info", throwError), throwError
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(cycle)}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("NettingCycle", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving netting cycle [%d]: [%s]", cycle, err)
+	}
+	if len(row.Columns) == 0 {
+		return nil, fmt.Errorf("Netting cycle [%d] does not exist", cycle)
+	}
+
+	rows, err := stub.GetRows("NettingPosition", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving positions of netting cycle [%d]: [%s]", cycle, err)
+	}
+	positions := make(map[string]string)
+	var keys []string
+	for position := range rows {
+		key := position.Columns[1].GetString_() + ":" + fmt.Sprintf("%010d", position.Columns[2].GetInt32())
+		positions[key] = `{"participantId":"` + strconv.Itoa(int(position.Columns[2].GetInt32())) +
+			`","currency":` + jsonString(position.Columns[1].GetString_()) +
+			`,"pay":"` + strconv.FormatInt(position.Columns[3].GetInt64(), 10) +
+			`","receive":"` + strconv.FormatInt(position.Columns[4].GetInt64(), 10) +
+			`","net_pay":"` + strconv.FormatInt(position.Columns[5].GetInt64(), 10) +
+			`","net_receive":"` + strconv.FormatInt(position.Columns[6].GetInt64(), 10) + `"}`
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items, err := stub.GetRows("NettingItem", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving items of netting cycle [%d]: [%s]", cycle, err)
+	}
+	covered := make(map[string]string)
+	var itemKeys []string
+	for item := range items {
+		key := item.Columns[1].GetString_() + ":" + fmt.Sprintf("%010d", item.Columns[2].GetInt32())
+		covered[key] = `{"entity":"` + item.Columns[1].GetString_() +
+			`","id":"` + strconv.Itoa(int(item.Columns[2].GetInt32())) +
+			`","amount":"` + strconv.FormatInt(item.Columns[3].GetInt64(), 10) +
+			`","currency":` + jsonString(item.Columns[4].GetString_()) + `}`
+		itemKeys = append(itemKeys, key)
+	}
+	sort.Strings(itemKeys)
+
+	jsonResp := `{"cycle":"` + strconv.Itoa(cycle) + `","period_start":"` + row.Columns[1].GetString_() +
+		`","period_end":"` + row.Columns[2].GetString_() + `","run_date":"` + row.Columns[3].GetString_() + `","positions":[`
+	for i, key := range keys {
+		if i > 0 {
+			jsonResp = jsonResp + ","
+		}
+		jsonResp = jsonResp + positions[key]
+	}
+	jsonResp = jsonResp + `],"covers":[`
+	for i, key := range itemKeys {
+		if i > 0 {
+			jsonResp = jsonResp + ","
+		}
+		jsonResp = jsonResp + covered[key]
+	}
+	jsonResp = jsonResp + `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query netting cycle...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createParticipantCertTable(stub shim.ChaincodeStubInterface) error {
+	// Fingerprints of the certificates of a participant, valid from a date
+	// until the date they are revoked from, empty while not revoked
+	err := stub.CreateTable("ParticipantCert", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Fingerprint", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "ValidFrom", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "RevokedFrom", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "AddedBy", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating ParticipantCert table.")
+	}
+
+	// Participant a certificate fingerprint was first registered for
+	err = stub.CreateTable("CertParticipant", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Fingerprint", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating CertParticipant table.")
+	}
+	return nil
+}
+
+func participantCertKey(participantId int32, cert []byte) []shim.Column {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: participantId}}
+	col2 := shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(cert)}}
+	columns = append(columns, col1, col2)
+	return columns
+}
+
+// certValidOn tells whether a registry entry is valid on a date.
+func certValidOn(row shim.Row, date string) bool {
+	if row.Columns[2].GetString_() > date {
+		return false
+	}
+	revoked := row.Columns[3].GetString_()
+	return revoked == "" || date < revoked
+}
+
+// participantCerts returns the identities speaking for a participant at the
+// transaction time. Participants with certificates in the registry are
+// resolved through it only, so that a revoked certificate loses access; for
+// the others the identity stored on the row being authorized is used.
+func participantCerts(stub shim.ChaincodeStubInterface, participantId int32, stored []byte) ([][]byte, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: participantId}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("ParticipantCert", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving certificates of participant [%d]: [%s]", participantId, err)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today := now.Format(dateLayout)
+
+	registered := false
+	var certs [][]byte
+	for row := range rows {
+		registered = true
+		if certValidOn(row, today) {
+			certs = append(certs, row.Columns[1].GetBytes())
+		}
+	}
+	if !registered && len(stored) != 0 {
+		certs = append(certs, stored)
+	}
+	return certs, nil
+}
+
+// certParticipant returns the participant a certificate was first
+// registered for, and false for certificates outside the registry.
+func certParticipant(stub shim.ChaincodeStubInterface, cert []byte) (int32, bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Bytes{Bytes: identityOf(cert)}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("CertParticipant", columns)
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed retrieving participant of certificate: [%s]", err)
+	}
+	if len(row.Columns) == 0 {
+		return 0, false, nil
+	}
+	return row.Columns[1].GetInt32(), true, nil
+}
+
+// isParticipantCert tells whether a certificate speaks for a participant at
+// the transaction time. The stored identity is the one recorded on the row
+// being authorized.
+func isParticipantCert(stub shim.ChaincodeStubInterface, participantId int32, stored []byte, cert []byte) (bool, error) {
+	if len(cert) == 0 {
+		return false, nil
+	}
+	certs, err := participantCerts(stub, participantId, stored)
+	if err != nil {
+		return false, err
+	}
+	for _, valid := range certs {
+		if sameIdentity(valid, cert) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// requireParticipantCert fails unless a certificate speaks for a
+// participant at the transaction time.
+func requireParticipantCert(stub shim.ChaincodeStubInterface, participantId int32, stored []byte, cert []byte) error {
+	ok, err := isParticipantCert(stub, participantId, stored, cert)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Caller is not allowed to do this operation")
+	}
+	return nil
+}
+
+// isParticipantCaller is isCaller resolving the caller through the
+// certificates of a participant.
+func (t *AssetManagementChaincode) isParticipantCaller(stub shim.ChaincodeStubInterface, participantId int32, stored []byte) (bool, error) {
+	sigma, err := stub.GetCallerMetadata()
+	if err != nil {
+		return false, errors.New("Failed getting metadata")
+	}
+	ok, err := isParticipantCert(stub, participantId, stored, sigma)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, errors.New("Caller is not allowed to do this operation")
+	}
+	return true, nil
+}
+
+// requireParticipantAuthority checks a certificate can change the settings
+// of a participant: an administrator, or a currently valid registered
+// certificate of the participant. Settings are never owned by whoever
+// happens to set them first.
+func requireParticipantAuthority(stub shim.ChaincodeStubInterface, participantId int32, cert []byte) error {
+	ok, err := isAdministrator(stub, cert)
+	if err != nil || ok {
+		return err
+	}
+	return requireParticipantCert(stub, participantId, nil, cert)
+}
+
+// requireCertManager checks the caller can manage the certificates of a
+// participant. The first certificate of a participant is registered by an
+// administrator; afterwards a certificate of the participant can register
+// new ones, but only rotate or revoke itself.
+func requireCertManager(stub shim.ChaincodeStubInterface, participantId int32, caller []byte, cert []byte) error {
+	ok, err := isAdministrator(stub, caller)
+	if err != nil || ok {
+		return err
+	}
+	err = requireParticipantCert(stub, participantId, nil, caller)
+	if err != nil {
+		return err
+	}
+	if cert != nil && !bytes.Equal(certFingerprint(cert), certFingerprint(caller)) {
+		return errors.New("Only an administrator can rotate or revoke another certificate of a participant")
+	}
+	return nil
+}
+
+// effectiveDate returns the given date, or the transaction date when empty.
+func effectiveDate(stub shim.ChaincodeStubInterface, date string) (string, error) {
+	if date == "" {
+		now, err := txTime(stub)
+		if err != nil {
+			return "", err
+		}
+		return now.Format(dateLayout), nil
+	}
+	_, err := parseDate(date)
+	if err != nil {
+		return "", err
+	}
+	return date, nil
+}
+
+func addParticipantCert(stub shim.ChaincodeStubInterface, participantId int32, cert []byte, validFrom string, caller []byte) error {
+	current, err := stub.GetRow("ParticipantCert", participantCertKey(participantId, cert))
+	if err != nil {
+		return fmt.Errorf("Failed retrieving certificate of participant [%d]: [%s]", participantId, err)
+	}
+	if len(current.Columns) != 0 {
+		return fmt.Errorf("Certificate is already registered for participant [%d]", participantId)
+	}
+	_, err = stub.InsertRow("ParticipantCert", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: participantId}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(cert)}},
+			&shim.Column{Value: &shim.Column_String_{String_: validFrom}},
+			&shim.Column{Value: &shim.Column_String_{String_: ""}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(caller)}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed registering certificate of participant [%d]: [%s]", participantId, err)
+	}
+
+	// A certificate already known for another participant keeps that one
+	_, err = stub.InsertRow("CertParticipant", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(cert)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: participantId}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed indexing certificate of participant [%d]: [%s]", participantId, err)
+	}
+	return nil
+}
+
+func revokeParticipantCert(stub shim.ChaincodeStubInterface, participantId int32, cert []byte, revokedFrom string) error {
+	current, err := stub.GetRow("ParticipantCert", participantCertKey(participantId, cert))
+	if err != nil {
+		return fmt.Errorf("Failed retrieving certificate of participant [%d]: [%s]", participantId, err)
+	}
+	if len(current.Columns) == 0 {
+		return fmt.Errorf("Certificate is not registered for participant [%d]", participantId)
+	}
+	if current.Columns[3].GetString_() != "" {
+		return fmt.Errorf("Certificate of participant [%d] is already revoked", participantId)
+	}
+	current.Columns[3] = &shim.Column{Value: &shim.Column_String_{String_: revokedFrom}}
+	_, err = stub.ReplaceRow("ParticipantCert", current)
+	if err != nil {
+		return fmt.Errorf("Failed revoking certificate of participant [%d]: [%s]", participantId, err)
+	}
+	return nil
+}
+
+// registerCert adds a certificate to a participant, valid from a date or
+// from today when the date is empty.
+func (t *AssetManagementChaincode) registerCert(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Register certificate...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("registerCert", throwError), throwError
+	}
+	cert, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil || len(cert) == 0 {
+		return nil, errors.New("Failed decoding certificate")
+	}
+	validFrom, err := effectiveDate(stub, args[2])
+	if err != nil {
+		return errorJson("registerCert", err), err
+	}
+	caller, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	err = requireCertManager(stub, int32(participantId), caller, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = addParticipantCert(stub, int32(participantId), cert, validFrom, caller)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Register certificate...done!")
+
+	return nil, nil
+}
+
+// rotateCert replaces a certificate of a participant by a new one from an
+// effective date, or from today when the date is empty. Invoices and
+// payment requests of the participant stay accessible with the new one.
+func (t *AssetManagementChaincode) rotateCert(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Rotate certificate...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("rotateCert", throwError), throwError
+	}
+	oldCert, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding old certificate")
+	}
+	newCert, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil || len(newCert) == 0 {
+		return nil, errors.New("Failed decoding new certificate")
+	}
+	date, err := effectiveDate(stub, args[3])
+	if err != nil {
+		return errorJson("rotateCert", err), err
+	}
+	caller, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	err = requireCertManager(stub, int32(participantId), caller, oldCert)
+	if err != nil {
+		return nil, err
+	}
+	err = addParticipantCert(stub, int32(participantId), newCert, date, caller)
+	if err != nil {
+		return nil, err
+	}
+	err = revokeParticipantCert(stub, int32(participantId), oldCert, date)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Rotate certificate...done!")
+
+	return nil, nil
+}
+
+// revokeCert revokes a certificate of a participant from an effective date,
+// or from today when the date is empty.
+func (t *AssetManagementChaincode) revokeCert(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Revoke certificate...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("revokeCert", throwError), throwError
+	}
+	cert, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding certificate")
+	}
+	date, err := effectiveDate(stub, args[2])
+	if err != nil {
+		return errorJson("revokeCert", err), err
+	}
+	caller, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	err = requireCertManager(stub, int32(participantId), caller, cert)
+	if err != nil {
+		return nil, err
+	}
+	err = revokeParticipantCert(stub, int32(participantId), cert, date)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Revoke certificate...done!")
+
+	return nil, nil
+}
+
+// participant_certs lists the registered certificates of a participant and
+// whether each is valid at the transaction time.
+func (t *AssetManagementChaincode) participant_certs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query participant certificates...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("participant_certs", throwError), throwError
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(participantId)}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("ParticipantCert", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving certificates of participant [%d]: [%s]", participantId, err)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today := now.Format(dateLayout)
+
+	entries := make(map[string]string)
+	var keys []string
+	for row := range rows {
+		fingerprint := hex.EncodeToString(row.Columns[1].GetBytes())
+		key := row.Columns[2].GetString_() + fingerprint
+		entries[key] = `{"fingerprint":"` + fingerprint +
+			`","valid_from":"` + row.Columns[2].GetString_() +
+			`","revoked_from":"` + row.Columns[3].GetString_() +
+			`","valid":"` + strconv.FormatBool(certValidOn(row, today)) + `"}`
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	jsonResp := `{"participant":"` + strconv.Itoa(participantId) + `","certs":[`
+	for i, key := range keys {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += entries[key]
+	}
+	jsonResp += `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query participant certificates...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCertRotationAndRevocation(t *testing.T) {
+	type step struct {
+		function string
+		args     []string
+		on       string
+		fails    bool
+	}
+	invoice := func(number string, supplier string) []string {
+		return []string{number, "100000", "2026-11-15", "3", "4", encodeCert(supplier), encodeCert("buyer")}
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "supplier cert rotated",
+			steps: []step{
+				{function: "rotateCert", args: []string{"3", encodeCert("supplier"), encodeCert("supplier2"), "", encodeCert("supplier")}},
+				{function: "createInvoice", args: invoice("2", "supplier"), fails: true},
+				{function: "createInvoice", args: invoice("2", "supplier2")},
+				{function: "setInvoiceCurrency", args: []string{"1", "EUR", encodeCert("supplier2")}},
+			},
+		},
+		{
+			name: "rotation effective later",
+			steps: []step{
+				{function: "rotateCert", args: []string{"3", encodeCert("supplier"), encodeCert("supplier2"), "2026-10-10", encodeCert("admin")}},
+				{function: "createInvoice", args: invoice("2", "supplier")},
+				{function: "createInvoice", args: invoice("3", "supplier"), on: "2026-10-10", fails: true},
+				{function: "createInvoice", args: invoice("3", "supplier2")},
+			},
+		},
+		{
+			name: "cert rotated by another participant",
+			steps: []step{
+				{function: "rotateCert", args: []string{"3", encodeCert("supplier"), encodeCert("supplier2"), "", encodeCert("funder")}, fails: true},
+				{function: "createInvoice", args: invoice("2", "supplier")},
+			},
+		},
+		{
+			name: "funder cert revoked",
+			steps: []step{
+				{function: "approveInvoice", args: []string{"1", encodeCert("buyer")}},
+				{function: "createPaymentRequest", args: []string{"7", "1", "2", "2026-10-01", encodeCert("buyer")}},
+				{function: "revokeCert", args: []string{"5", encodeCert("funder"), "", encodeCert("admin")}},
+				{function: "assignPaymentRequest", args: []string{"7", "5", encodeCert("funder")}, fails: true},
+			},
+		},
+		{
+			name: "cert revoked by another participant",
+			steps: []step{
+				{function: "revokeCert", args: []string{"5", encodeCert("funder"), "", encodeCert("supplier")}, fails: true},
+			},
+		},
+		{
+			name: "role of a revoked cert",
+			steps: []step{
+				{function: "registerCert", args: []string{"9", encodeCert("bank"), "", encodeCert("admin")}},
+				{function: "addRole", args: []string{roleBank, encodeCert("bank"), encodeCert("admin")}},
+				{function: "depositCash", args: []string{"5", settlementToken, "1000", encodeCert("funder"), encodeCert("bank")}},
+				{function: "revokeCert", args: []string{"9", encodeCert("bank"), "", encodeCert("admin")}},
+				{function: "depositCash", args: []string{"5", settlementToken, "1000", encodeCert("funder"), encodeCert("bank")}, fails: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "createInvoice", invoice("1", "supplier")...)
+
+		for _, step := range test.steps {
+			if step.on != "" {
+				on, err := time.Parse(dateLayout, step.on)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stub.now = on.Add(12 * time.Hour)
+			}
+			stub.MockTransactionStart(test.name)
+			_, err := cc.Invoke(stub, step.function, step.args)
+			stub.MockTransactionEnd(test.name)
+			if step.fails != (err != nil) {
+				t.Errorf("%s: %s got error %v, want an error: %t", test.name, step.function, err, step.fails)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Legs of a financed payment request that can be exported for execution.
+const (
+	legDisbursement = "disbursement"
+	legRepayment    = "repayment"
+)
+
+const pain001Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.03"
+
+// ISO 20022 pain.001.001.03 customer credit transfer initiation, limited to
+// a single payment with a single transaction.
+type pain001Document struct {
+	XMLName    xml.Name          `xml:"Document"`
+	Xmlns      string            `xml:"xmlns,attr"`
+	Initiation pain001Initiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001Initiation struct {
+	MsgId           string             `xml:"GrpHdr>MsgId"`
+	CreDtTm         string             `xml:"GrpHdr>CreDtTm"`
+	NbOfTxs         int                `xml:"GrpHdr>NbOfTxs"`
+	CtrlSum         string             `xml:"GrpHdr>CtrlSum"`
+	InitiatingParty string             `xml:"GrpHdr>InitgPty>Nm"`
+	PaymentInfo     pain001PaymentInfo `xml:"PmtInf"`
+}
+
+type pain001PaymentInfo struct {
+	PmtInfId    string                `xml:"PmtInfId"`
+	PmtMtd      string                `xml:"PmtMtd"`
+	NbOfTxs     int                   `xml:"NbOfTxs"`
+	CtrlSum     string                `xml:"CtrlSum"`
+	ReqdExctnDt string                `xml:"ReqdExctnDt"`
+	Debtor      string                `xml:"Dbtr>Nm"`
+	DebtorIBAN  string                `xml:"DbtrAcct>Id>IBAN"`
+	DebtorBIC   string                `xml:"DbtrAgt>FinInstnId>BIC"`
+	Transaction pain001CreditTransfer `xml:"CdtTrfTxInf"`
+}
+
+type pain001CreditTransfer struct {
+	EndToEndId   string         `xml:"PmtId>EndToEndId"`
+	Amount       iso20022Amount `xml:"Amt>InstdAmt"`
+	CreditorBIC  string         `xml:"CdtrAgt>FinInstnId>BIC"`
+	Creditor     string         `xml:"Cdtr>Nm"`
+	CreditorIBAN string         `xml:"CdtrAcct>Id>IBAN"`
+	Remittance   string         `xml:"RmtInf>Ustrd"`
+}
+
+// iso20022Amount is an amount with its currency, as used by both the pain
+// and the camt messages.
+type iso20022Amount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+func createBankAccountTable(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("BankAccount", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Name", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Iban", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Bic", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating BankAccount table.")
+	}
+	return nil
+}
+
+func getBankAccountRow(stub shim.ChaincodeStubInterface, participantId int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: participantId}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("BankAccount", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving bank account of participant [%d]: [%s]", participantId, err)
+	}
+	return row, nil
+}
+
+// registerBankAccount stores the account a participant pays from and is paid
+// into. Only a registered certificate of the participant or an
+// administrator can register or change it.
+func (t *AssetManagementChaincode) registerBankAccount(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Register bank account...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	participantId, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("registerBankAccount", throwError), throwError
+	}
+	name := args[1]
+	iban := args[2]
+	bic := args[3]
+	if name == "" || iban == "" || bic == "" {
+		throwError := errors.New("Expecting non-empty name, IBAN and BIC")
+		return errorJson("registerBankAccount", throwError), throwError
+	}
+
+	owner, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding owner")
+	}
+
+	err = requireParticipantAuthority(stub, int32(participantId), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := getBankAccountRow(stub, int32(participantId))
+	if err != nil {
+		return nil, err
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(participantId)}},
+			&shim.Column{Value: &shim.Column_String_{String_: name}},
+			&shim.Column{Value: &shim.Column_String_{String_: iban}},
+			&shim.Column{Value: &shim.Column_String_{String_: bic}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(owner)}},
+		},
+	}
+	if len(account.Columns) == 0 {
+		_, err = stub.InsertRow("BankAccount", row)
+	} else {
+		_, err = stub.ReplaceRow("BankAccount", row)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing bank account of participant [%d]: [%s]", participantId, err)
+	}
+
+	fmt.Println("Register bank account...done!")
+
+	return nil, nil
+}
+
+// paymentInitiation renders one leg of a financed payment request as an
+// ISO 20022 pain.001 credit transfer. The disbursement pays the discounted
+// payout from the funder to the supplier and can be requested by the funder;
+// the repayment pays the face value from the buyer to the funder and can be
+// requested by the buyer. The remittance information is the invoice number.
+func (t *AssetManagementChaincode) paymentInitiation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query payment initiation...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment id")
+		return errorJson("paymentInitiation", throwError), throwError
+	}
+	leg := args[1]
+	executionDate := args[2]
+	_, err = parseDate(executionDate)
+	if err != nil {
+		return errorJson("paymentInitiation", err), err
+	}
+
+	caller, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	if paymentRow.Columns[5].GetString_() == "Pending" {
+		return nil, fmt.Errorf("Payment request [%d] is not funded yet", payment)
+	}
+
+	number := paymentRow.Columns[1].GetInt32()
+	invoiceRow, err := getInvoiceRow(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	currency, err := getInvoiceCurrency(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	if currency == "" {
+		return nil, fmt.Errorf("Invoice [%d] has no currency", number)
+	}
+
+	faceValue, payout, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+
+	var debtorId, creditorId int32
+	var amount int64
+	switch leg {
+	case legDisbursement:
+		err = requireParticipantCert(stub, paymentRow.Columns[3].GetInt32(), paymentRow.Columns[4].GetBytes(), caller)
+		if err != nil {
+			return nil, err
+		}
+		err = requireNoDispute(stub, invoiceRow)
+		if err != nil {
+			return nil, err
+		}
+		err = requireNotFrozen(stub, invoiceRow, paymentRow.Columns[3].GetInt32())
+		if err != nil {
+			return nil, err
+		}
+		debtorId = paymentRow.Columns[3].GetInt32()
+		creditorId = invoiceRow.Columns[6].GetInt32()
+		amount = payout
+	case legRepayment:
+		err = requireParticipantCert(stub, invoiceRow.Columns[7].GetInt32(), invoiceRow.Columns[9].GetBytes(), caller)
+		if err != nil {
+			return nil, err
+		}
+		debtorId = invoiceRow.Columns[7].GetInt32()
+		creditorId, _, err = receivableHolder(stub, paymentRow)
+		if err != nil {
+			return nil, err
+		}
+		amount = faceValue
+	default:
+		return nil, fmt.Errorf("Unknown payment leg [%s]", leg)
+	}
+
+	debtor, err := getBankAccountRow(stub, debtorId)
+	if err != nil {
+		return nil, err
+	}
+	if len(debtor.Columns) == 0 {
+		return nil, fmt.Errorf("Participant [%d] has no registered bank account", debtorId)
+	}
+	creditor, err := getBankAccountRow(stub, creditorId)
+	if err != nil {
+		return nil, err
+	}
+	if len(creditor.Columns) == 0 {
+		return nil, fmt.Errorf("Participant [%d] has no registered bank account", creditorId)
+	}
+
+	reference := paymentReference(int32(payment), leg)
+	sum := formatDecimal(amount, amountScale)
+	document := pain001Document{
+		Xmlns: pain001Namespace,
+		Initiation: pain001Initiation{
+			MsgId:           reference,
+			CreDtTm:         executionDate + "T00:00:00",
+			NbOfTxs:         1,
+			CtrlSum:         sum,
+			InitiatingParty: debtor.Columns[1].GetString_(),
+			PaymentInfo: pain001PaymentInfo{
+				PmtInfId:    reference,
+				PmtMtd:      "TRF",
+				NbOfTxs:     1,
+				CtrlSum:     sum,
+				ReqdExctnDt: executionDate,
+				Debtor:      debtor.Columns[1].GetString_(),
+				DebtorIBAN:  debtor.Columns[2].GetString_(),
+				DebtorBIC:   debtor.Columns[3].GetString_(),
+				Transaction: pain001CreditTransfer{
+					EndToEndId:   reference,
+					Amount:       iso20022Amount{Currency: currency, Value: sum},
+					CreditorBIC:  creditor.Columns[3].GetString_(),
+					Creditor:     creditor.Columns[1].GetString_(),
+					CreditorIBAN: creditor.Columns[2].GetString_(),
+					Remittance:   strconv.Itoa(int(number)),
+				},
+			},
+		},
+	}
+
+	out, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Failed rendering pain.001 for payment request [%d]: [%s]", payment, err)
+	}
+
+	fmt.Println("Query payment initiation...done!")
+
+	return append([]byte(xml.Header), out...), nil
+}
+
+// paymentReference is the end-to-end reference used for a leg of a payment
+// request, so that the bank statement entries can be traced back to it.
+func paymentReference(payment int32, leg string) string {
+	return "PR" + strconv.Itoa(int(payment)) + "-" + leg
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Kinds of participants of a reverse factoring program.
+const (
+	programSupplier = "supplier"
+	programFunder   = "funder"
+)
+
+func createProgramTables(stub shim.ChaincodeStubInterface) error {
+	// Rates are annual, in basis points; the tenor is in days
+	err := stub.CreateTable("Program", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "FundingLimit", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "BaseRate", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Margin", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "MaxTenor", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "LateRate", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Program table.")
+	}
+
+	err = stub.CreateTable("BuyerProgram", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Program", Type: shim.ColumnDefinition_INT32, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating BuyerProgram table.")
+	}
+
+	err = stub.CreateTable("ProgramParticipant", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Program", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Kind", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating ProgramParticipant table.")
+	}
+
+	// Payment requests financed under a program, with the discount computed
+	// from the program terms
+	err = stub.CreateTable("ProgramPayment", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Program", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating ProgramPayment table.")
+	}
+
+	err = stub.CreateTable("PaymentProgram", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Program", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Days", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "DiscountAmount", Type: shim.ColumnDefinition_INT64, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PaymentProgram table.")
+	}
+
+	return nil
+}
+
+func getProgramRow(stub shim.ChaincodeStubInterface, program int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: program}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("Program", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving program [%d]: [%s]", program, err)
+	}
+	if len(row.Columns) == 0 {
+		return row, fmt.Errorf("Program [%d] does not exist", program)
+	}
+	return row, nil
+}
+
+// getPaymentProgramRow returns the program a payment request was financed
+// under, or an empty row when it was not.
+func getPaymentProgramRow(stub shim.ChaincodeStubInterface, payment int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentProgram", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving program of payment request [%d]: [%s]", payment, err)
+	}
+	return row, nil
+}
+
+func isProgramParticipant(stub shim.ChaincodeStubInterface, program int32, kind string, participantId int32) (bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: program}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	col3 := shim.Column{Value: &shim.Column_Int32{Int32: participantId}}
+	columns = append(columns, col1, col2, col3)
+
+	row, err := stub.GetRow("ProgramParticipant", columns)
+	if err != nil {
+		return false, fmt.Errorf("Failed retrieving %s [%d] of program [%d]: [%s]", kind, participantId, program, err)
+	}
+	return len(row.Columns) != 0, nil
+}
+
+func getProgramParticipants(stub shim.ChaincodeStubInterface, program int32, kind string) ([]int32, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: program}}
+	col2 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+	columns = append(columns, col1, col2)
+
+	rows, err := stub.GetRows("ProgramParticipant", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving %s list of program [%d]: [%s]", kind, program, err)
+	}
+
+	var participants []int32
+	for row := range rows {
+		participants = append(participants, row.Columns[2].GetInt32())
+	}
+	sortInt32s(participants)
+	return participants, nil
+}
+
+// programUtilization sums the face value of the live payment requests
+// financed under a program, converted into the base currency of the buyer
+// when they were created. Requests in recourse are owed by the supplier
+// rather than the buyer, so they no longer use up the program.
+func programUtilization(stub shim.ChaincodeStubInterface, program int32) (int64, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: program}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("ProgramPayment", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving payment requests of program [%d]: [%s]", program, err)
+	}
+
+	var payments []int32
+	for row := range rows {
+		payments = append(payments, row.Columns[1].GetInt32())
+	}
+
+	var utilized int64
+	for _, payment := range payments {
+		paymentRow, err := getPaymentRequestRow(stub, payment)
+		if err != nil {
+			return 0, err
+		}
+		live, err := isLivePaymentRequest(stub, paymentRow)
+		if err != nil {
+			return 0, err
+		}
+		if !live || paymentRow.Columns[5].GetString_() == "Recourse" {
+			continue
+		}
+		faceValue, _, err := paymentAmounts(stub, paymentRow)
+		if err != nil {
+			return 0, err
+		}
+		amount, err := convertedExposure(stub, payment, limitProgram, faceValue)
+		if err != nil {
+			return 0, err
+		}
+		utilized += amount
+	}
+	return utilized, nil
+}
+
+// programCovering returns the active program of the buyer of an invoice the
+// supplier is eligible for, or zero when there is none.
+func programCovering(stub shim.ChaincodeStubInterface, invoiceRow shim.Row) (int32, error) {
+	buyerId := invoiceRow.Columns[7].GetInt32()
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: buyerId}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("BuyerProgram", columns)
+	if err != nil {
+		return 0, fmt.Errorf("Failed retrieving programs of buyer [%d]: [%s]", buyerId, err)
+	}
+	var programs []int32
+	for row := range rows {
+		programs = append(programs, row.Columns[1].GetInt32())
+	}
+	sortInt32s(programs)
+
+	for _, program := range programs {
+		programRow, err := getProgramRow(stub, program)
+		if err != nil {
+			return 0, err
+		}
+		if programRow.Columns[6].GetString_() != "Active" {
+			continue
+		}
+		eligible, err := isProgramParticipant(stub, program, programSupplier, invoiceRow.Columns[6].GetInt32())
+		if err != nil {
+			return 0, err
+		}
+		if eligible {
+			return program, nil
+		}
+	}
+	return 0, nil
+}
+
+// createProgram sets up a reverse factoring program of a buyer, which must
+// call it with one of its registered certificates. An optional eighth
+// argument sets the annual late-payment interest rate, in basis points,
+// accrued on overdue invoices and payment requests of the program.
+func (t *AssetManagementChaincode) createProgram(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Create program...")
+
+	if len(args) != 7 && len(args) != 8 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 7 or 8")
+	}
+
+	program, err := strconv.Atoi(args[0])
+	if err != nil || program <= 0 {
+		throwError := errors.New("Expecting positive integer value for program id")
+		return errorJson("createProgram", throwError), throwError
+	}
+	buyerId, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("createProgram", throwError), throwError
+	}
+	fundingLimit, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || fundingLimit <= 0 {
+		throwError := errors.New("Expecting positive integer value for funding limit")
+		return errorJson("createProgram", throwError), throwError
+	}
+	baseRate, err := strconv.Atoi(args[3])
+	if err != nil || baseRate < 0 {
+		throwError := errors.New("Expecting non-negative base rate in basis points")
+		return errorJson("createProgram", throwError), throwError
+	}
+	margin, err := strconv.Atoi(args[4])
+	if err != nil || margin < 0 {
+		throwError := errors.New("Expecting non-negative margin in basis points")
+		return errorJson("createProgram", throwError), throwError
+	}
+	maxTenor, err := strconv.Atoi(args[5])
+	if err != nil || maxTenor <= 0 {
+		throwError := errors.New("Expecting positive max tenor in days")
+		return errorJson("createProgram", throwError), throwError
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[6])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+	err = requireParticipantCert(stub, int32(buyerId), nil, buyer)
+	if err != nil {
+		return nil, err
+	}
+	lateRate := 0
+	if len(args) == 8 {
+		lateRate, err = strconv.Atoi(args[7])
+		if err != nil || lateRate < 0 {
+			throwError := errors.New("Expecting non-negative late rate in basis points")
+			return errorJson("createProgram", throwError), throwError
+		}
+	}
+
+	ok, err := stub.InsertRow("Program", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(program)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: fundingLimit}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(baseRate)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(margin)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(maxTenor)}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Active"}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(buyer)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(lateRate)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Program with this id was already created.")
+	}
+
+	_, err = stub.InsertRow("BuyerProgram", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(program)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Create program...done!")
+
+	return nil, nil
+}
+
+// updateProgramParticipant adds or removes an eligible supplier or a
+// committed funder of a program. Only the buyer of the program can do it.
+func (t *AssetManagementChaincode) updateProgramParticipant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Update program participant...")
+
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+	}
+
+	program, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for program id")
+		return errorJson("updateProgramParticipant", throwError), throwError
+	}
+	kind := args[1]
+	if kind != programSupplier && kind != programFunder {
+		return nil, fmt.Errorf("Unknown program participant kind [%s]", kind)
+	}
+	participantId, err := strconv.Atoi(args[2])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for participant id")
+		return errorJson("updateProgramParticipant", throwError), throwError
+	}
+	add, err := strconv.ParseBool(args[3])
+	if err != nil {
+		throwError := errors.New("Expecting boolean value for add")
+		return errorJson("updateProgramParticipant", throwError), throwError
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[4])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	programRow, err := getProgramRow(stub, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, programRow.Columns[1].GetInt32(), programRow.Columns[7].GetBytes(), buyer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+
+	if add {
+		_, err = stub.InsertRow("ProgramParticipant", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(program)}},
+				&shim.Column{Value: &shim.Column_String_{String_: kind}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(participantId)}},
+			},
+		})
+	} else {
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_Int32{Int32: int32(program)}}
+		col2 := shim.Column{Value: &shim.Column_String_{String_: kind}}
+		col3 := shim.Column{Value: &shim.Column_Int32{Int32: int32(participantId)}}
+		columns = append(columns, col1, col2, col3)
+		err = stub.DeleteRow("ProgramParticipant", columns)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed updating %s [%d] of program [%d]: [%s]", kind, participantId, program, err)
+	}
+
+	fmt.Println("Update program participant...done!")
+
+	return nil, nil
+}
+
+// closeProgram closes a program of a buyer. No new payment request can be
+// created under it; the requests already financed run to settlement. Only the
+// buyer of the program or an administrator can close it.
+func (t *AssetManagementChaincode) closeProgram(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Close program...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	program, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for program id")
+		return errorJson("closeProgram", throwError), throwError
+	}
+	caller, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	programRow, err := getProgramRow(stub, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, programRow.Columns[1].GetInt32(), programRow.Columns[7].GetBytes(), caller)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		ok, err = isAdministrator(stub, caller)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	if programRow.Columns[6].GetString_() != "Active" {
+		return nil, fmt.Errorf("Program [%d] is not active", program)
+	}
+
+	programRow.Columns[6] = &shim.Column{Value: &shim.Column_String_{String_: "Closed"}}
+	_, err = stub.ReplaceRow("Program", programRow)
+	if err != nil {
+		return nil, fmt.Errorf("Failed closing program [%d]: [%s]", program, err)
+	}
+
+	fmt.Println("Close program...done!")
+
+	return nil, nil
+}
+
+// createProgramPaymentRequest creates a payment request for an approved
+// invoice under a program of its buyer. The discount is computed from the
+// program base rate plus margin for the days left until the invoice payment
+// date; the tenor and the program funding limit are enforced, and invoices
+// already financed by a live payment request are rejected. Invoices in
+// another currency than the base currency of the buyer count against the
+// funding limit at the rate effective when the request is created. An
+// optional fifth argument flags the request as with recourse to the
+// supplier, which takes effect once the supplier accepts it with
+// acceptRecourse.
+func (t *AssetManagementChaincode) createProgramPaymentRequest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Create program payment request...")
+
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 or 5")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("createProgramPaymentRequest", throwError), throwError
+	}
+	program, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for program id")
+		return errorJson("createProgramPaymentRequest", throwError), throwError
+	}
+	number, err := strconv.Atoi(args[2])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("createProgramPaymentRequest", throwError), throwError
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+	recourse := false
+	if len(args) == 5 {
+		recourse, err = parseRecourse(args[4])
+		if err != nil {
+			return errorJson("createProgramPaymentRequest", err), err
+		}
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := actsFor(stub, invoiceRow.Columns[7].GetInt32(), invoiceRow.Columns[9].GetBytes(), buyer, "createProgramPaymentRequest", int64(invoiceRow.Columns[1].GetInt32()))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+	buyer = identityOf(invoiceRow.Columns[9].GetBytes())
+	if invoiceRow.Columns[2].GetString_() != "Approved" {
+		return nil, fmt.Errorf("Invoice [%d] is not approved", number)
+	}
+	err = requireDelivery(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoDispute(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotFrozen(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	live, err := livePaymentRequest(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(live.Columns) != 0 {
+		return nil, fmt.Errorf("Invoice [%d] is already financed by payment request [%d]", number, live.Columns[0].GetInt32())
+	}
+
+	programRow, err := getProgramRow(stub, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	if programRow.Columns[6].GetString_() != "Active" {
+		return nil, fmt.Errorf("Program [%d] is not active", program)
+	}
+	if programRow.Columns[1].GetInt32() != invoiceRow.Columns[7].GetInt32() {
+		return nil, fmt.Errorf("Invoice [%d] is not from the buyer of program [%d]", number, program)
+	}
+	supplierId := invoiceRow.Columns[6].GetInt32()
+	eligible, err := isProgramParticipant(stub, int32(program), programSupplier, supplierId)
+	if err != nil {
+		return nil, err
+	}
+	if !eligible {
+		return nil, fmt.Errorf("Supplier [%d] is not eligible for program [%d]", supplierId, program)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	dueDate, err := parseDate(invoiceRow.Columns[5].GetString_())
+	if err != nil {
+		return nil, err
+	}
+	days := daysBetween(now, dueDate)
+	if days <= 0 {
+		return nil, fmt.Errorf("Invoice [%d] is already due", number)
+	}
+	if days > int64(programRow.Columns[5].GetInt32()) {
+		return nil, fmt.Errorf("Tenor of %d days exceeds the max tenor of program [%d]", days, program)
+	}
+	err = checkTenor(stub, now, invoiceRow.Columns[5].GetString_())
+	if err != nil {
+		return nil, err
+	}
+
+	price, err := invoiceAmount(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	// The funding limit is in the base currency of the buyer; without one
+	// the program only finances invoices in the settlement token
+	currency, err := settlementCurrency(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+	base, err := exposureCurrency(stub, limitProgram, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	if base == "" && currency != settlementToken {
+		return nil, fmt.Errorf("Invoice [%d] is in %s but buyer [%d] has no base currency to convert it into", number, currency, programRow.Columns[1].GetInt32())
+	}
+	amount, err := convertExposure(stub, int32(payment), limitProgram, int32(program), price, currency)
+	if err != nil {
+		return nil, err
+	}
+	utilized, err := programUtilization(stub, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	if utilized+amount > programRow.Columns[2].GetInt64() {
+		return nil, fmt.Errorf("Program [%d] funding limit exceeded", program)
+	}
+
+	rate := programRow.Columns[3].GetInt32() + programRow.Columns[4].GetInt32()
+	discount := dynamicDiscount(price, rate, days)
+	requestDate := now.Format(dateLayout)
+
+	fmt.Printf("Program [%d] payment request [%d] for invoice [%d]: %d days at %d bp, discount [%d]\n", program, payment, number, days, rate, discount)
+
+	// The discount rate column is a whole percentage; the exact discount
+	// is taken from the PaymentProgram table
+	discountRate := int32(0)
+	if price > 0 {
+		discountRate = int32(discount * 100 / price)
+	}
+	ok, err = stub.InsertRow("PaymentRequest", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: discountRate}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: -1}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: buyer}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Pending"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("payment request with this id was already created.")
+	}
+
+	err = setPaymentRecourse(stub, int32(payment), recourse)
+	if err != nil {
+		return nil, err
+	}
+	err = indexInvoicePayment(stub, int32(number), int32(payment))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = stub.InsertRow("PaymentProgram", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(program)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(days)}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: discount}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = stub.InsertRow("ProgramPayment", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(program)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	invoiceRow.Columns[4] = &shim.Column{Value: &shim.Column_String_{String_: requestDate}}
+	_, err = stub.ReplaceRow("Invoice", invoiceRow)
+	if err != nil {
+		return nil, fmt.Errorf("Failed updating request date of invoice [%d]: [%s]", number, err)
+	}
+
+	fmt.Println("Create program payment request...done!")
+
+	return nil, nil
+}
+
+// checkProgramFunder fails when a payment request financed under a program
+// is assigned to a funder that is not committed to the program.
+func checkProgramFunder(stub shim.ChaincodeStubInterface, payment int32, payerId int32) error {
+	paymentProgram, err := getPaymentProgramRow(stub, payment)
+	if err != nil || len(paymentProgram.Columns) == 0 {
+		return err
+	}
+
+	program := paymentProgram.Columns[1].GetInt32()
+	committed, err := isProgramParticipant(stub, program, programFunder, payerId)
+	if err != nil {
+		return err
+	}
+	if !committed {
+		return fmt.Errorf("Funder [%d] is not committed to program [%d]", payerId, program)
+	}
+	return nil
+}
+
+func (t *AssetManagementChaincode) program_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query program...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	program, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for program id")
+		return errorJson("program_info", throwError), throwError
+	}
+
+	programRow, err := getProgramRow(stub, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	suppliers, err := getProgramParticipants(stub, int32(program), programSupplier)
+	if err != nil {
+		return nil, err
+	}
+	funders, err := getProgramParticipants(stub, int32(program), programFunder)
+	if err != nil {
+		return nil, err
+	}
+	utilized, err := programUtilization(stub, int32(program))
+	if err != nil {
+		return nil, err
+	}
+
+	jsonResp := `{"program":"` + strconv.Itoa(program) + `","buyerId":"` + strconv.Itoa(int(programRow.Columns[1].GetInt32())) +
+		`","funding_limit":"` + strconv.FormatInt(programRow.Columns[2].GetInt64(), 10) +
+		`","utilized":"` + strconv.FormatInt(utilized, 10) +
+		`","base_rate":"` + strconv.Itoa(int(programRow.Columns[3].GetInt32())) +
+		`","margin":"` + strconv.Itoa(int(programRow.Columns[4].GetInt32())) +
+		`","max_tenor":"` + strconv.Itoa(int(programRow.Columns[5].GetInt32())) +
+		`","late_rate":"` + strconv.Itoa(int(programRow.Columns[8].GetInt32())) +
+		`","status":"` + programRow.Columns[6].GetString_() +
+		`","suppliers":` + idsJson(suppliers) + `,"funders":` + idsJson(funders)
+	currency, err := exposureCurrency(stub, limitProgram, int32(program))
+	if err != nil {
+		return nil, err
+	}
+	if currency != "" {
+		jsonResp += `,"currency":` + jsonString(currency)
+	}
+	jsonResp += `}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query program...done!")
+
+	return []byte(jsonResp), nil
+}
+
+// idsJson renders a list of ids as a JSON array of strings.
+func idsJson(ids []int32) string {
+	jsonResp := `[`
+	for i, id := range ids {
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += `"` + strconv.Itoa(int(id)) + `"`
+	}
+	return jsonResp + `]`
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestProgramDiscountAmounts(t *testing.T) {
+	_, stub := assignedRequest(t)
+	stub.MockTransactionStart("program discount")
+	stub.InsertRow("PaymentProgram", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: 7}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: 2}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: 45}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: 1849}},
+		},
+	})
+	stub.MockTransactionEnd("program discount")
+
+	checkPaymentAmounts(t, "program discount", stub, 100000, 98151)
+}
+
+func TestProgramUtilization(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		expired  bool
+		utilized int64
+	}{
+		{name: "pending", status: "Pending", utilized: 100000},
+		{name: "expired before assignment", status: "Pending", expired: true, utilized: 0},
+		{name: "assigned", status: "Assigned", utilized: 100000},
+		{name: "funded", status: "Funded", utilized: 100000},
+		{name: "settled", status: "Settled", utilized: 0},
+		{name: "cancelled", status: "Cancelled", utilized: 0},
+		{name: "defaulted", status: "Defaulted", utilized: 0},
+		{name: "in recourse to the supplier", status: "Recourse", utilized: 0},
+	}
+
+	for _, test := range tests {
+		cc, stub := programRequest(t)
+		stub.MockTransactionStart(test.name)
+		err := setPaymentRequestStatus(stub, paymentRequest(t, stub, 7), test.status)
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.expired {
+			stub.invoke(t, cc, "setConfig", configPaymentRequestExpiry, "10", encodeCert("admin"))
+			stub.now = stub.now.Add(11 * 24 * time.Hour)
+		}
+
+		stub.MockTransactionStart(test.name)
+		utilized, err := programUtilization(stub, 2)
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if utilized != test.utilized {
+			t.Errorf("%s: got utilization %d, want %d", test.name, utilized, test.utilized)
+		}
+	}
+}
+
+func TestProgramPaymentRequestOnFinancedInvoice(t *testing.T) {
+	cc, stub := programRequest(t)
+
+	stub.MockTransactionStart("second request")
+	_, err := cc.Invoke(stub, "createProgramPaymentRequest", []string{"8", "2", "1", encodeCert("buyer")})
+	stub.MockTransactionEnd("second request")
+	if err == nil {
+		t.Error("expected an invoice with a live payment request to be rejected")
+	}
+
+	stub.MockTransactionStart("cancel")
+	err = setPaymentRequestStatus(stub, paymentRequest(t, stub, 7), "Cancelled")
+	stub.MockTransactionEnd("cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.invoke(t, cc, "createProgramPaymentRequest", "9", "2", "1", encodeCert("buyer"))
+}
+
+func TestProgramFundingLimitCurrency(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		currency string
+		rate     string
+		fails    bool
+		utilized int64
+	}{
+		{name: "settlement token without a base currency", utilized: 100000},
+		{name: "foreign currency without a base currency", currency: "USD", fails: true},
+		{name: "base currency", base: "EUR", currency: "EUR", utilized: 100000},
+		{name: "converted within the limit", base: "EUR", currency: "USD", rate: "0.5", utilized: 50000},
+		{name: "converted over the limit", base: "EUR", currency: "USD", rate: "2", fails: true},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+		if test.base != "" {
+			stub.invoke(t, cc, "setBaseCurrency", "4", test.base, encodeCert("buyer"))
+		}
+		if test.rate != "" {
+			stub.invoke(t, cc, "addRole", roleFxOracle, encodeCert("oracle"), encodeCert("admin"))
+			message := test.currency + "|" + test.base + "|" + test.rate + "|2026-10-01T00:00:00Z"
+			stub.invoke(t, cc, "postFxRate", test.currency, test.base, test.rate, "2026-10-01T00:00:00Z",
+				sign("oracle", message), encodeCert("oracle"))
+		}
+		stub.invoke(t, cc, "createProgram", "2", "4", "150000", "300", "100", "90", encodeCert("buyer"))
+		stub.invoke(t, cc, "updateProgramParticipant", "2", programSupplier, "3", "true", encodeCert("buyer"))
+		stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+		if test.currency != "" {
+			stub.invoke(t, cc, "setInvoiceCurrency", "1", test.currency, encodeCert("supplier"))
+		}
+		stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+
+		stub.MockTransactionStart(test.name)
+		_, err := cc.Invoke(stub, "createProgramPaymentRequest", []string{"7", "2", "1", encodeCert("buyer")})
+		stub.MockTransactionEnd(test.name)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		stub.MockTransactionStart(test.name)
+		utilized, err := programUtilization(stub, 2)
+		stub.MockTransactionEnd(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if utilized != test.utilized {
+			t.Errorf("%s: got utilization %d, want %d", test.name, utilized, test.utilized)
+		}
+	}
+}
+
+// programRequest sets up program 2 of buyer 4 with a funding limit of
+// 150000 and supplier 3 eligible, and payment request 7 under it on
+// invoice 1 of 100000, due on 15 November 2026.
+func programRequest(t *testing.T) (*AssetManagementChaincode, *testStub) {
+	cc, stub := newTestStub(t)
+	stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+	stub.invoke(t, cc, "createProgram", "2", "4", "150000", "300", "100", "90", encodeCert("buyer"))
+	stub.invoke(t, cc, "updateProgramParticipant", "2", programSupplier, "3", "true", encodeCert("buyer"))
+	stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+	stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+	stub.invoke(t, cc, "createProgramPaymentRequest", "7", "2", "1", encodeCert("buyer"))
+	return cc, stub
+}
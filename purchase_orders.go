@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Number of positional arguments per purchase order line: sku, quantity, unitPrice.
+const orderLineArgs = 3
+
+// Number of positional arguments per goods receipt line: sku, quantity.
+const receiptLineArgs = 2
+
+func createPurchaseOrderTables(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("PurchaseOrder", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Number", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "BuyerId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "SupplierId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "PriceTolerance", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "QuantityTolerance", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "BuyerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PurchaseOrder table.")
+	}
+
+	err = stub.CreateTable("PurchaseOrderLine", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Order", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Sku", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Quantity", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "UnitPrice", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Received", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PurchaseOrderLine table.")
+	}
+
+	err = stub.CreateTable("GoodsReceipt", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Order", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "ReceiptDate", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating GoodsReceipt table.")
+	}
+
+	err = stub.CreateTable("GoodsReceiptLine", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Receipt", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Sku", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Quantity", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating GoodsReceiptLine table.")
+	}
+
+	// Links an invoice to the purchase order it was raised against and
+	// keeps the outcome of the last three-way match.
+	err = stub.CreateTable("InvoiceMatch", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Order", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Discrepancies", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating InvoiceMatch table.")
+	}
+
+	err = stub.CreateTable("OrderInvoice", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Order", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating OrderInvoice table.")
+	}
+
+	return nil
+}
+
+func getPurchaseOrderRow(stub shim.ChaincodeStubInterface, order int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: order}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PurchaseOrder", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving purchase order [%d]: [%s]", order, err)
+	}
+	if len(row.Columns) == 0 {
+		return row, fmt.Errorf("Purchase order [%d] does not exist", order)
+	}
+	return row, nil
+}
+
+func getPurchaseOrderLines(stub shim.ChaincodeStubInterface, order int32) (map[string]shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: order}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("PurchaseOrderLine", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving lines of purchase order [%d]: [%s]", order, err)
+	}
+
+	lines := make(map[string]shim.Row)
+	for row := range rows {
+		lines[row.Columns[1].GetString_()] = row
+	}
+	return lines, nil
+}
+
+func (t *AssetManagementChaincode) createPurchaseOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Create purchase order...")
+
+	if len(args) < 6+orderLineArgs || (len(args)-6)%orderLineArgs != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6, plus 3 per order line")
+	}
+
+	order, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for purchase order number")
+		return errorJson("createPurchaseOrder", throwError), throwError
+	}
+	buyerId, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for buyerId")
+		return errorJson("createPurchaseOrder", throwError), throwError
+	}
+	supplierId, err := strconv.Atoi(args[2])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for supplierId")
+		return errorJson("createPurchaseOrder", throwError), throwError
+	}
+	priceTolerance, err := strconv.Atoi(args[3])
+	if err != nil || priceTolerance < 0 {
+		throwError := errors.New("Expecting non-negative integer value for price tolerance")
+		return errorJson("createPurchaseOrder", throwError), throwError
+	}
+	quantityTolerance, err := strconv.Atoi(args[4])
+	if err != nil || quantityTolerance < 0 {
+		throwError := errors.New("Expecting non-negative integer value for quantity tolerance")
+		return errorJson("createPurchaseOrder", throwError), throwError
+	}
+
+	buyer, err := base64.StdEncoding.DecodeString(args[5])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	// Only the buyer issues its purchase orders. Nothing on the ledger names
+	// its certificate yet, so it must be registered for the buyer id
+	err = requireParticipantCert(stub, int32(buyerId), nil, buyer)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Creating purchase order [%d] from buyer [%d] to supplier [%d]\n", order, buyerId, supplierId)
+
+	ok, err := stub.InsertRow("PurchaseOrder", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(order)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(buyerId)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(supplierId)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(priceTolerance)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(quantityTolerance)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(buyer)}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Open"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Purchase order with this number was already created.")
+	}
+
+	for i := 6; i < len(args); i += orderLineArgs {
+		sku := args[i]
+		quantity, err := strconv.Atoi(args[i+1])
+		if err != nil || quantity <= 0 {
+			throwError := fmt.Errorf("Expecting positive integer value for quantity of sku [%s]", sku)
+			return errorJson("createPurchaseOrder", throwError), throwError
+		}
+		unitPrice, err := strconv.Atoi(args[i+2])
+		if err != nil || unitPrice < 0 {
+			throwError := fmt.Errorf("Expecting non-negative integer value for unit price of sku [%s]", sku)
+			return errorJson("createPurchaseOrder", throwError), throwError
+		}
+
+		ok, err := stub.InsertRow("PurchaseOrderLine", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(order)}},
+				&shim.Column{Value: &shim.Column_String_{String_: sku}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(quantity)}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(unitPrice)}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: 0}},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Sku [%s] appears more than once on purchase order [%d]", sku, order)
+		}
+	}
+
+	fmt.Println("Create purchase order...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) createGoodsReceipt(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Create goods receipt...")
+
+	if len(args) < 4+receiptLineArgs || (len(args)-4)%receiptLineArgs != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4, plus 2 per receipt line")
+	}
+
+	receipt, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for goods receipt id")
+		return errorJson("createGoodsReceipt", throwError), throwError
+	}
+	order, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for purchase order number")
+		return errorJson("createGoodsReceipt", throwError), throwError
+	}
+	receiptDate := args[2]
+
+	buyer, err := base64.StdEncoding.DecodeString(args[3])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	// Only the buyer that issued the purchase order can confirm the receipt
+	orderRow, err := getPurchaseOrderRow(stub, int32(order))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, orderRow.Columns[1].GetInt32(), orderRow.Columns[5].GetBytes(), buyer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+
+	ok, err = stub.InsertRow("GoodsReceipt", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(receipt)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(order)}},
+			&shim.Column{Value: &shim.Column_String_{String_: receiptDate}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Goods receipt with this id was already created.")
+	}
+
+	orderLines, err := getPurchaseOrderLines(stub, int32(order))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 4; i < len(args); i += receiptLineArgs {
+		sku := args[i]
+		quantity, err := strconv.Atoi(args[i+1])
+		if err != nil || quantity <= 0 {
+			throwError := fmt.Errorf("Expecting positive integer value for received quantity of sku [%s]", sku)
+			return errorJson("createGoodsReceipt", throwError), throwError
+		}
+
+		orderLine, found := orderLines[sku]
+		if !found {
+			return nil, fmt.Errorf("Sku [%s] is not on purchase order [%d]", sku, order)
+		}
+
+		ok, err := stub.InsertRow("GoodsReceiptLine", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(receipt)}},
+				&shim.Column{Value: &shim.Column_String_{String_: sku}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: int32(quantity)}},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Sku [%s] appears more than once on goods receipt [%d]", sku, receipt)
+		}
+
+		received := orderLine.Columns[4].GetInt32() + int32(quantity)
+		orderLine.Columns[4] = &shim.Column{Value: &shim.Column_Int32{Int32: received}}
+		_, err = stub.ReplaceRow("PurchaseOrderLine", orderLine)
+		if err != nil {
+			return nil, fmt.Errorf("Failed updating received quantity of sku [%s]: [%s]", sku, err)
+		}
+	}
+
+	// Invoices waiting for this receipt may now match
+	invoices, err := getOrderInvoices(stub, int32(order))
+	if err != nil {
+		return nil, err
+	}
+	for _, invoice := range invoices {
+		_, err = t.matchInvoice(stub, invoice)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("Create goods receipt...done!")
+
+	return nil, nil
+}
+
+// createInvoiceForOrder creates an invoice raised against a purchase order.
+// The first argument is the purchase order number, the remaining ones are
+// the createInvoice arguments. The invoice is approved automatically when
+// the three-way match succeeds, unless a delivery or approvers are still
+// missing.
+func (t *AssetManagementChaincode) createInvoiceForOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Create invoice for purchase order...")
+
+	if len(args) < 8 {
+		return nil, errors.New("Incorrect number of arguments. Expecting at least 8")
+	}
+
+	order, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for purchase order number")
+		return errorJson("createInvoiceForOrder", throwError), throwError
+	}
+	number, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice number")
+		return errorJson("createInvoiceForOrder", throwError), throwError
+	}
+	supplierId, err := strconv.Atoi(args[4])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice supplierId")
+		return errorJson("createInvoiceForOrder", throwError), throwError
+	}
+	buyerId, err := strconv.Atoi(args[5])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for invoice buyerId")
+		return errorJson("createInvoiceForOrder", throwError), throwError
+	}
+
+	orderRow, err := getPurchaseOrderRow(stub, int32(order))
+	if err != nil {
+		return nil, err
+	}
+	if orderRow.Columns[1].GetInt32() != int32(buyerId) || orderRow.Columns[2].GetInt32() != int32(supplierId) {
+		return nil, fmt.Errorf("Invoice parties do not match purchase order [%d]", order)
+	}
+
+	resp, err := t.createInvoice(stub, args[1:])
+	if err != nil {
+		return resp, err
+	}
+
+	ok, err := stub.InsertRow("InvoiceMatch", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(order)}},
+			&shim.Column{Value: &shim.Column_String_{String_: "Unmatched"}},
+			&shim.Column{Value: &shim.Column_String_{String_: "[]"}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invoice [%d] is already linked to a purchase order", number)
+	}
+
+	_, err = stub.InsertRow("OrderInvoice", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(order)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.matchInvoice(stub, int32(number))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Create invoice for purchase order...done!")
+
+	return nil, nil
+}
+
+func getOrderInvoices(stub shim.ChaincodeStubInterface, order int32) ([]int32, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: order}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("OrderInvoice", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving invoices of purchase order [%d]: [%s]", order, err)
+	}
+
+	var invoices []int32
+	for row := range rows {
+		invoices = append(invoices, row.Columns[1].GetInt32())
+	}
+	sortInt32s(invoices)
+	return invoices, nil
+}
+
+func getInvoiceMatchRow(stub shim.ChaincodeStubInterface, number int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("InvoiceMatch", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving purchase order of invoice [%d]: [%s]", number, err)
+	}
+	return row, nil
+}
+
+// matchInvoice runs the three-way match for a pending invoice raised against
+// a purchase order, records the outcome and approves the invoice when it
+// matches. It returns the discrepancies found; invoices without a purchase
+// order or no longer pending are left untouched. A matched invoice stays
+// pending while its buyer requires a delivery not confirmed yet, or when
+// its price calls for approvers under the buyer's approval policy.
+func (t *AssetManagementChaincode) matchInvoice(stub shim.ChaincodeStubInterface, number int32) ([]string, error) {
+	matchRow, err := getInvoiceMatchRow(stub, number)
+	if err != nil || len(matchRow.Columns) == 0 {
+		return nil, err
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	if invoiceRow.Columns[2].GetString_() != "Pending" {
+		return nil, nil
+	}
+
+	discrepancies, err := threeWayMatch(stub, number, matchRow.Columns[1].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+
+	status := "Matched"
+	if len(discrepancies) > 0 {
+		status = "Discrepancy"
+	}
+	fmt.Printf("Three-way match of invoice [%d]: %s %v\n", number, status, discrepancies)
+
+	encoded, err := json.Marshal(discrepancies)
+	if err != nil {
+		return nil, err
+	}
+	matchRow.Columns[2] = &shim.Column{Value: &shim.Column_String_{String_: status}}
+	matchRow.Columns[3] = &shim.Column{Value: &shim.Column_String_{String_: string(encoded)}}
+	_, err = stub.ReplaceRow("InvoiceMatch", matchRow)
+	if err != nil {
+		return nil, fmt.Errorf("Failed recording match of invoice [%d]: [%s]", number, err)
+	}
+
+	if len(discrepancies) > 0 || requireDelivery(stub, invoiceRow) != nil {
+		return discrepancies, nil
+	}
+	policy, err := getApprovalPolicy(stub, invoiceRow.Columns[7].GetInt32(), int64(invoiceRow.Columns[1].GetInt32()))
+	if err != nil {
+		return nil, err
+	}
+	if len(policy.Columns) != 0 {
+		fmt.Printf("Invoice [%d] matched, waiting for its approvers\n", number)
+		return discrepancies, nil
+	}
+	err = setInvoiceStatus(stub, invoiceRow, "Approved")
+	if err != nil {
+		return nil, err
+	}
+
+	return discrepancies, nil
+}
+
+// threeWayMatch compares the invoice lines against the ordered and received
+// quantities and prices of the purchase order, taking into account what was
+// already invoiced on other approved invoices of the same order.
+func threeWayMatch(stub shim.ChaincodeStubInterface, number int32, order int32) ([]string, error) {
+	orderRow, err := getPurchaseOrderRow(stub, order)
+	if err != nil {
+		return nil, err
+	}
+	priceTolerance := int64(orderRow.Columns[3].GetInt32())
+	quantityTolerance := int64(orderRow.Columns[4].GetInt32())
+
+	orderLines, err := getPurchaseOrderLines(stub, order)
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := getInvoiceLines(stub, number)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return []string{"invoice has no lines to match"}, nil
+	}
+
+	// Quantities already invoiced against this order on approved invoices
+	alreadyInvoiced := make(map[string]int64)
+	invoices, err := getOrderInvoices(stub, order)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range invoices {
+		if other == number {
+			continue
+		}
+		otherRow, err := getInvoiceRow(stub, other)
+		if err != nil {
+			return nil, err
+		}
+		if otherRow.Columns[2].GetString_() != "Approved" {
+			continue
+		}
+		otherLines, err := getInvoiceLines(stub, other)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range otherLines {
+			alreadyInvoiced[line.Sku] += int64(line.Quantity)
+		}
+	}
+
+	var discrepancies []string
+	invoiced := make(map[string]int64)
+	var skus []string
+	for _, line := range lines {
+		orderLine, found := orderLines[line.Sku]
+		if !found {
+			discrepancies = append(discrepancies, fmt.Sprintf("sku %s is not on purchase order %d", line.Sku, order))
+			continue
+		}
+
+		orderPrice := int64(orderLine.Columns[3].GetInt32())
+		diff := int64(line.UnitPrice) - orderPrice
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff*10000 > orderPrice*priceTolerance {
+			discrepancies = append(discrepancies, fmt.Sprintf("sku %s unit price %d differs from ordered price %d", line.Sku, line.UnitPrice, orderPrice))
+		}
+
+		if _, seen := invoiced[line.Sku]; !seen {
+			skus = append(skus, line.Sku)
+		}
+		invoiced[line.Sku] += int64(line.Quantity)
+	}
+
+	for _, sku := range skus {
+		orderLine := orderLines[sku]
+		total := invoiced[sku] + alreadyInvoiced[sku]
+
+		ordered := int64(orderLine.Columns[2].GetInt32())
+		if total*10000 > ordered*(10000+quantityTolerance) {
+			discrepancies = append(discrepancies, fmt.Sprintf("sku %s invoiced quantity %d exceeds ordered quantity %d", sku, total, ordered))
+		}
+
+		received := int64(orderLine.Columns[4].GetInt32())
+		if total*10000 > received*(10000+quantityTolerance) {
+			discrepancies = append(discrepancies, fmt.Sprintf("sku %s invoiced quantity %d exceeds received quantity %d", sku, total, received))
+		}
+	}
+
+	return discrepancies, nil
+}
+
+// invoiceMatchJson renders the purchase order link of an invoice as JSON
+// object members, or an empty string when the invoice has none.
+func invoiceMatchJson(stub shim.ChaincodeStubInterface, number int32) (string, error) {
+	matchRow, err := getInvoiceMatchRow(stub, number)
+	if err != nil || len(matchRow.Columns) == 0 {
+		return "", err
+	}
+
+	return `,"purchase_order":"` + strconv.Itoa(int(matchRow.Columns[1].GetInt32())) +
+		`","match_status":"` + matchRow.Columns[2].GetString_() +
+		`","discrepancies":` + matchRow.Columns[3].GetString_(), nil
+}
+
+func (t *AssetManagementChaincode) order_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query purchase order...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	order, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for purchase order number")
+		return errorJson("order_info", throwError), throwError
+	}
+
+	buyer, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+
+	orderRow, err := getPurchaseOrderRow(stub, int32(order))
+	if err != nil {
+		return nil, err
+	}
+	ok, err := isParticipantCert(stub, orderRow.Columns[1].GetInt32(), orderRow.Columns[5].GetBytes(), buyer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+
+	orderLines, err := getPurchaseOrderLines(stub, int32(order))
+	if err != nil {
+		return nil, err
+	}
+	var skus []string
+	for sku := range orderLines {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+
+	jsonResp := `{"order":"` + strconv.Itoa(order) + `","buyerId":"` + strconv.Itoa(int(orderRow.Columns[1].GetInt32())) +
+		`","supplierId":"` + strconv.Itoa(int(orderRow.Columns[2].GetInt32())) +
+		`","price_tolerance":"` + strconv.Itoa(int(orderRow.Columns[3].GetInt32())) +
+		`","quantity_tolerance":"` + strconv.Itoa(int(orderRow.Columns[4].GetInt32())) +
+		`","status":"` + orderRow.Columns[6].GetString_() + `","lines":[`
+	for i, sku := range skus {
+		line := orderLines[sku]
+		if i > 0 {
+			jsonResp += `,`
+		}
+		jsonResp += `{"sku":` + jsonString(sku) + `,"quantity":"` + strconv.Itoa(int(line.Columns[2].GetInt32())) +
+			`","unit_price":"` + strconv.Itoa(int(line.Columns[3].GetInt32())) +
+			`","received":"` + strconv.Itoa(int(line.Columns[4].GetInt32())) + `"}`
+	}
+	jsonResp += `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query purchase order...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchInvoice(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(cc *AssetManagementChaincode, stub *testStub)
+		unitPrice string
+		price     string
+		match     string
+		status    string
+	}{
+		{
+			name:      "clean match",
+			unitPrice: "100",
+			price:     "1000",
+			match:     "Matched",
+			status:    "Approved",
+		},
+		{
+			name:      "price outside the tolerance",
+			unitPrice: "110",
+			price:     "1100",
+			match:     "Discrepancy",
+			status:    "Pending",
+		},
+		{
+			name: "delivery not confirmed yet",
+			setup: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "setDeliveryPolicy", "4", "true", encodeCert("buyer"))
+			},
+			unitPrice: "100",
+			price:     "1000",
+			match:     "Matched",
+			status:    "Pending",
+		},
+		{
+			name: "approvers required by the buyer policy",
+			setup: func(cc *AssetManagementChaincode, stub *testStub) {
+				stub.invoke(t, cc, "setApprovalPolicy", "4", "500", "2", "", encodeCert("buyer"))
+			},
+			unitPrice: "100",
+			price:     "1000",
+			match:     "Matched",
+			status:    "Pending",
+		},
+	}
+
+	for _, test := range tests {
+		cc, stub := newTestStub(t)
+		stub.invoke(t, cc, "registerCert", "4", encodeCert("buyer"), "", encodeCert("admin"))
+		if test.setup != nil {
+			test.setup(cc, stub)
+		}
+		stub.invoke(t, cc, "createPurchaseOrder", "9", "4", "3", "0", "0", encodeCert("buyer"), "A", "10", "100")
+		stub.invoke(t, cc, "createGoodsReceipt", "1", "9", "2026-10-01", encodeCert("buyer"), "A", "10")
+		stub.invoke(t, cc, "createInvoiceForOrder", "9", "1", test.price, "2026-12-31", "3", "4",
+			encodeCert("supplier"), encodeCert("buyer"), "widgets", "A", "10", test.unitPrice, "0", "0")
+
+		matchRow, err := getInvoiceMatchRow(stub, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := matchRow.Columns[2].GetString_(); match != test.match {
+			t.Errorf("%s: got match %s, want %s", test.name, match, test.match)
+		}
+		invoiceRow, err := getInvoiceRow(stub, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := invoiceRow.Columns[2].GetString_(); status != test.status {
+			t.Errorf("%s: got invoice %s, want %s", test.name, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func createReceivableTables(stub shim.ChaincodeStubInterface) error {
+	// Claim on the buyer payment of an assigned payment request; it has the
+	// id of the payment request and is owned by whoever the buyer repays
+	err := stub.CreateTable("Receivable", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "OwnerCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Receivable table.")
+	}
+
+	err = stub.CreateTable("ReceivableTransfer", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Receivable", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Seq", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "FromId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "ToId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Date", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating ReceivableTransfer table.")
+	}
+
+	return nil
+}
+
+// getReceivableRow returns the receivable minted for a payment request, or
+// an empty row when the request was never assigned.
+func getReceivableRow(stub shim.ChaincodeStubInterface, id int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("Receivable", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving receivable [%d]: [%s]", id, err)
+	}
+	return row, nil
+}
+
+// getReceivableTransfers returns the transfers of a receivable in the order
+// they happened.
+func getReceivableTransfers(stub shim.ChaincodeStubInterface, id int32) ([]shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: id}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("ReceivableTransfer", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving transfers of receivable [%d]: [%s]", id, err)
+	}
+	bySeq := make(map[int32]shim.Row)
+	var seqs []int32
+	for row := range rows {
+		bySeq[row.Columns[1].GetInt32()] = row
+		seqs = append(seqs, row.Columns[1].GetInt32())
+	}
+	sortInt32s(seqs)
+
+	var transfers []shim.Row
+	for _, seq := range seqs {
+		transfers = append(transfers, bySeq[seq])
+	}
+	return transfers, nil
+}
+
+// mintReceivable issues the receivable of a payment request to its payer.
+func mintReceivable(stub shim.ChaincodeStubInterface, payment int32, number int32, ownerId int32, owner []byte) error {
+	ok, err := stub.InsertRow("Receivable", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: number}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: ownerId}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: identityOf(owner)}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed minting receivable [%d]: [%s]", payment, err)
+	}
+	if !ok {
+		return fmt.Errorf("Receivable [%d] was already minted", payment)
+	}
+	return nil
+}
+
+// receivableHolder returns the participant the buyer owes the payment of a
+// request to: the owner of its receivable, or the payer when none was minted.
+func receivableHolder(stub shim.ChaincodeStubInterface, paymentRow shim.Row) (int32, []byte, error) {
+	receivable, err := getReceivableRow(stub, paymentRow.Columns[0].GetInt32())
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(receivable.Columns) == 0 {
+		return paymentRow.Columns[3].GetInt32(), paymentRow.Columns[4].GetBytes(), nil
+	}
+	return receivable.Columns[2].GetInt32(), receivable.Columns[3].GetBytes(), nil
+}
+
+// moveExposure moves the outstanding amount of a payment request from one
+// funder to another, checking the limit of the new funder on the buyer.
+func moveExposure(stub shim.ChaincodeStubInterface, payment int32, funderId int32) error {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentExposure", columns)
+	if err != nil {
+		return fmt.Errorf("Failed retrieving exposure of payment request [%d]: [%s]", payment, err)
+	}
+	if len(row.Columns) == 0 {
+		return nil
+	}
+
+	oldFunderId := row.Columns[1].GetInt32()
+	buyerId := row.Columns[2].GetInt32()
+	amount := row.Columns[5].GetInt64()
+
+	paymentRow, err := getPaymentRequestRow(stub, payment)
+	if err != nil {
+		return err
+	}
+	currency, err := settlementCurrency(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return err
+	}
+	oldAmount, err := convertedExposure(stub, payment, limitFunder, amount)
+	if err != nil {
+		return err
+	}
+	buyerAmount, err := convertedExposure(stub, payment, exposureBuyer, amount)
+	if err != nil {
+		return err
+	}
+	// The new funder takes the exposure in its own base currency
+	newAmount, err := convertExposure(stub, payment, limitFunder, funderId, amount, currency)
+	if err != nil {
+		return err
+	}
+
+	err = checkLimit(stub, limitFunder, funderId, buyerId, newAmount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, limitFunder, oldFunderId, buyerId, -oldAmount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, exposureBuyer, buyerId, oldFunderId, -buyerAmount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, limitFunder, funderId, buyerId, newAmount)
+	if err != nil {
+		return err
+	}
+	err = addExposure(stub, exposureBuyer, buyerId, funderId, buyerAmount)
+	if err != nil {
+		return err
+	}
+
+	row.Columns[1] = &shim.Column{Value: &shim.Column_Int32{Int32: funderId}}
+	_, err = stub.ReplaceRow("PaymentExposure", row)
+	if err != nil {
+		return fmt.Errorf("Failed updating exposure of payment request [%d]: [%s]", payment, err)
+	}
+	return nil
+}
+
+// transferReceivable transfers the ownership of a receivable. Only the
+// current owner can call this function, and the new owner certificate must be
+// registered for the new owner id. Receivables can be traded while the
+// payment request is assigned or funded and the invoice is not disputed; the
+// buyer then repays the new owner.
+func (t *AssetManagementChaincode) transferReceivable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Transfer receivable...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for receivable id")
+		return errorJson("transferReceivable", throwError), throwError
+	}
+	newOwnerId, err := strconv.Atoi(args[1])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for new owner id")
+		return errorJson("transferReceivable", throwError), throwError
+	}
+	newOwner, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding new owner")
+	}
+	if len(newOwner) == 0 {
+		return nil, errors.New("Invalid new owner. Nil")
+	}
+
+	receivable, err := getReceivableRow(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(receivable.Columns) == 0 {
+		return nil, fmt.Errorf("Receivable [%d] does not exist", id)
+	}
+
+	// Verify ownership
+	ok, err := t.isParticipantCaller(stub, receivable.Columns[2].GetInt32(), receivable.Columns[3].GetBytes())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Caller is not allowed to do this operation")
+	}
+	// The buyer repays whoever the new owner certificate belongs to
+	ok, err = isParticipantCert(stub, int32(newOwnerId), nil, newOwner)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("New owner certificate is not registered for participant [%d]", newOwnerId)
+	}
+	units, err := getReceivableUnits(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	if units != 0 {
+		return nil, fmt.Errorf("Receivable [%d] is split into units, use transferUnits", id)
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	status := paymentRow.Columns[5].GetString_()
+	if status != "Assigned" && status != "Funded" {
+		return nil, fmt.Errorf("Receivable [%d] cannot be transferred, payment request is %s", id, status)
+	}
+	invoiceRow, err := getInvoiceRow(stub, receivable.Columns[1].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoDispute(stub, invoiceRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotFrozen(stub, invoiceRow, receivable.Columns[2].GetInt32(), int32(newOwnerId))
+	if err != nil {
+		return nil, err
+	}
+
+	err = moveExposure(stub, int32(id), int32(newOwnerId))
+	if err != nil {
+		return nil, err
+	}
+
+	oldOwnerId := receivable.Columns[2].GetInt32()
+	receivable.Columns[2] = &shim.Column{Value: &shim.Column_Int32{Int32: int32(newOwnerId)}}
+	receivable.Columns[3] = &shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(newOwner)}}
+	_, err = stub.ReplaceRow("Receivable", receivable)
+	if err != nil {
+		return nil, fmt.Errorf("Failed transferring receivable [%d]: [%s]", id, err)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	transfers, err := getReceivableTransfers(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	_, err = stub.InsertRow("ReceivableTransfer", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(id)}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(len(transfers))}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: oldOwnerId}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(newOwnerId)}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed recording transfer of receivable [%d]: [%s]", id, err)
+	}
+
+	fmt.Println("Transfer receivable...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) receivable_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query receivable...")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for receivable id")
+		return errorJson("receivable_info", throwError), throwError
+	}
+
+	receivable, err := getReceivableRow(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(receivable.Columns) == 0 {
+		return nil, fmt.Errorf("Receivable [%d] does not exist", id)
+	}
+	paymentRow, err := getPaymentRequestRow(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+	faceValue, _, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+	units, err := getReceivableUnits(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+
+	transfers, err := getReceivableTransfers(stub, int32(id))
+	if err != nil {
+		return nil, err
+	}
+
+	history := `[`
+	for i, row := range transfers {
+		if i > 0 {
+			history += `,`
+		}
+		history += `{"from":"` + strconv.Itoa(int(row.Columns[2].GetInt32())) +
+			`","to":"` + strconv.Itoa(int(row.Columns[3].GetInt32())) +
+			`","date":"` + row.Columns[4].GetString_() + `"}`
+	}
+	history += `]`
+
+	jsonResp := `{"receivable":"` + strconv.Itoa(id) + `","invoice":"` + strconv.Itoa(int(receivable.Columns[1].GetInt32())) +
+		`","face_value":"` + strconv.FormatInt(faceValue, 10) +
+		`","ownerId":"` + strconv.Itoa(int(receivable.Columns[2].GetInt32())) +
+		`","units":"` + strconv.FormatInt(units, 10) +
+		`","status":"` + paymentRow.Columns[5].GetString_() + `","transfers":` + history + `}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query receivable...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Subset of an ISO 20022 camt.053 bank statement or camt.054 debit/credit
+// notification needed to reconcile credit entries.
+type camtDocument struct {
+	XMLName       xml.Name        `xml:"Document"`
+	Statements    []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+	Notifications []camtStatement `xml:"BkToCstmrDbtCdtNtfctn>Ntfctn"`
+}
+
+type camtStatement struct {
+	Id      string      `xml:"Id"`
+	Entries []camtEntry `xml:"Ntry"`
+}
+
+type camtEntry struct {
+	Amount       iso20022Amount    `xml:"Amt"`
+	Indicator    string            `xml:"CdtDbtInd"`
+	BookingDate  string            `xml:"BookgDt>Dt"`
+	Reference    string            `xml:"AcctSvcrRef"`
+	Information  string            `xml:"AddtlNtryInf"`
+	Transactions []camtTransaction `xml:"NtryDtls>TxDtls"`
+}
+
+type camtTransaction struct {
+	EndToEndId string          `xml:"Refs>EndToEndId"`
+	Amount     *iso20022Amount `xml:"Amt"`
+	TxAmount   *iso20022Amount `xml:"AmtDtls>TxAmt>Amt"`
+	Remittance []string        `xml:"RmtInf>Ustrd"`
+}
+
+// camtItem is a single credit to reconcile: a transaction of an entry, or
+// the entry itself when it carries no transaction details.
+type camtItem struct {
+	Reference   string
+	EndToEndId  string
+	Remittance  string
+	Amount      iso20022Amount
+	BookingDate string
+}
+
+func createReconciliationTables(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("Statement", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Id", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "BankCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating Statement table.")
+	}
+
+	err = stub.CreateTable("StatementEntry", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Statement", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Item", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Reference", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "BookingDate", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Entity", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "EntityId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Reason", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating StatementEntry table.")
+	}
+
+	return nil
+}
+
+// creditItems lists the credits of a statement entry to reconcile.
+func (e camtEntry) creditItems() []camtItem {
+	if e.Indicator != "CRDT" {
+		return nil
+	}
+	if len(e.Transactions) == 0 {
+		return []camtItem{{
+			Reference:   e.Reference,
+			Remittance:  e.Information,
+			Amount:      e.Amount,
+			BookingDate: e.BookingDate,
+		}}
+	}
+
+	var items []camtItem
+	for _, tx := range e.Transactions {
+		item := camtItem{
+			Reference:   e.Reference,
+			EndToEndId:  strings.TrimSpace(tx.EndToEndId),
+			Remittance:  strings.Join(tx.Remittance, " "),
+			Amount:      e.Amount,
+			BookingDate: e.BookingDate,
+		}
+		if tx.Amount != nil {
+			item.Amount = *tx.Amount
+		} else if tx.TxAmount != nil {
+			item.Amount = *tx.TxAmount
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// parsePaymentReference reads back a reference built by paymentReference.
+func parsePaymentReference(reference string) (int32, string, bool) {
+	if !strings.HasPrefix(reference, "PR") {
+		return 0, "", false
+	}
+	parts := strings.SplitN(reference[2:], "-", 2)
+	if len(parts) != 2 || (parts[1] != legDisbursement && parts[1] != legRepayment) {
+		return 0, "", false
+	}
+	payment, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return int32(payment), parts[1], true
+}
+
+// remittanceInvoice returns the invoice a credit pays directly. The
+// remittance information must be exactly the invoice number, as in the
+// pain.001 messages, and the invoice must be approved and not financed by a
+// payment request still outstanding, whose legs are reconciled by their own
+// reference. Otherwise it returns the reason for not matching.
+func remittanceInvoice(stub shim.ChaincodeStubInterface, remittance string) (shim.Row, string, error) {
+	number, err := strconv.ParseInt(strings.TrimSpace(remittance), 10, 32)
+	if err != nil {
+		return shim.Row{}, "no invoice or payment request reference", nil
+	}
+	invoiceRow, err := getInvoiceRow(stub, int32(number))
+	if err != nil {
+		return shim.Row{}, "unknown invoice", nil
+	}
+	status := invoiceRow.Columns[2].GetString_()
+	if status != "Approved" {
+		return invoiceRow, "invoice is " + status, nil
+	}
+	live, err := livePaymentRequest(stub, int32(number))
+	if err != nil {
+		return shim.Row{}, "", err
+	}
+	if len(live.Columns) != 0 {
+		return invoiceRow, "invoice is financed by payment request " + strconv.Itoa(int(live.Columns[0].GetInt32())), nil
+	}
+	return invoiceRow, "", nil
+}
+
+// checkCredit compares a credited amount with the expected one.
+func checkCredit(stub shim.ChaincodeStubInterface, item camtItem, number int32, expected int64) (int64, string) {
+	currency, err := getInvoiceCurrency(stub, number)
+	if err != nil {
+		return 0, err.Error()
+	}
+	if currency != "" && item.Amount.Currency != currency {
+		return 0, "currency " + item.Amount.Currency + " does not match " + currency
+	}
+	amount, err := parseDecimal(item.Amount.Value, amountScale)
+	if err != nil {
+		return 0, err.Error()
+	}
+	if amount != expected {
+		return amount, "amount " + formatDecimal(amount, amountScale) + " does not match expected " + formatDecimal(expected, amountScale)
+	}
+	return amount, ""
+}
+
+// reconcileItem matches a credit to a payment request leg, by end-to-end
+// reference, or to an invoice, by remittance information, and records the
+// payment. It returns the matched entity, or the reason for not matching.
+func reconcileItem(stub shim.ChaincodeStubInterface, item camtItem) (string, int32, string, error) {
+	if payment, leg, ok := parsePaymentReference(item.EndToEndId); ok {
+		paymentRow, err := getPaymentRequestRow(stub, payment)
+		if err != nil {
+			return "", 0, "unknown payment request", nil
+		}
+		faceValue, payout, err := paymentAmounts(stub, paymentRow)
+		if err != nil {
+			return "", 0, "", err
+		}
+
+		status := paymentRow.Columns[5].GetString_()
+		if leg == legRepayment && status == "Recourse" {
+			return reconcileRecourse(stub, item, paymentRow)
+		}
+		expected, from, to := payout, "Assigned", "Funded"
+		if leg == legRepayment {
+			expected, from, to = faceValue, "Funded", "Settled"
+		}
+		if status != from && !(leg == legRepayment && status == "Assigned") {
+			return documentEntityPayment, payment, "payment request is " + status, nil
+		}
+
+		number := paymentRow.Columns[1].GetInt32()
+		_, reason := checkCredit(stub, item, number, expected)
+		if reason != "" {
+			return documentEntityPayment, payment, reason, nil
+		}
+
+		if leg == legRepayment {
+			err = settlePayment(stub, paymentRow, expected, item.BookingDate)
+		} else {
+			err = setPaymentRequestStatus(stub, paymentRow, to)
+		}
+		if err != nil {
+			return "", 0, "", err
+		}
+		return documentEntityPayment, payment, "", nil
+	}
+
+	invoiceRow, reason, err := remittanceInvoice(stub, item.Remittance)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if len(invoiceRow.Columns) == 0 {
+		return "", 0, reason, nil
+	}
+	number := invoiceRow.Columns[0].GetInt32()
+	if reason != "" {
+		return documentEntityInvoice, number, reason, nil
+	}
+	amount, err := invoiceAmount(stub, invoiceRow)
+	if err != nil {
+		return "", 0, "", err
+	}
+	_, reason = checkCredit(stub, item, number, amount)
+	if reason != "" {
+		return documentEntityInvoice, number, reason, nil
+	}
+	err = markInvoicePaid(stub, invoiceRow, item.BookingDate)
+	if err != nil {
+		return "", 0, "", err
+	}
+	return documentEntityInvoice, number, "", nil
+}
+
+// markInvoicePaid records the payment of an invoice on its booking date.
+func markInvoicePaid(stub shim.ChaincodeStubInterface, invoiceRow shim.Row, paymentDate string) error {
+	invoiceRow.Columns[5] = &shim.Column{Value: &shim.Column_String_{String_: paymentDate}}
+	return setInvoiceStatus(stub, invoiceRow, "Paid")
+}
+
+// reconcileStatement ingests a camt.053 statement or camt.054 notification
+// posted by a bank and matches its credit entries to invoices and payment
+// requests. Every credit is recorded with its outcome and can be read back
+// with reconciliation_info.
+func (t *AssetManagementChaincode) reconcileStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Reconcile statement...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	document, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("Failed decoding statement")
+	}
+	bank, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding bank")
+	}
+
+	err = requireRole(stub, roleBank, bank)
+	if err != nil {
+		return nil, err
+	}
+
+	var camt camtDocument
+	err = xml.Unmarshal(document, &camt)
+	if err != nil {
+		throwError := fmt.Errorf("Failed parsing camt document: %s", err)
+		return errorJson("reconcileStatement", throwError), throwError
+	}
+
+	statements := append(camt.Statements, camt.Notifications...)
+	if len(statements) == 0 {
+		throwError := errors.New("Expecting a camt.053 statement or a camt.054 notification")
+		return errorJson("reconcileStatement", throwError), throwError
+	}
+
+	for _, statement := range statements {
+		if statement.Id == "" {
+			return nil, errors.New("Statement has no id")
+		}
+
+		ok, err := stub.InsertRow("Statement", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: statement.Id}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(bank)}},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Statement [%s] was already reconciled", statement.Id)
+		}
+
+		var item int32
+		for _, entry := range statement.Entries {
+			for _, credit := range entry.creditItems() {
+				item++
+
+				entity, entityId, reason, err := reconcileItem(stub, credit)
+				if err != nil {
+					return nil, err
+				}
+				status := "Matched"
+				if reason != "" {
+					status = "Unmatched"
+				}
+				fmt.Printf("Statement [%s] item [%d]: %s %s %d %s\n", statement.Id, item, status, entity, entityId, reason)
+
+				amount, err := parseDecimal(credit.Amount.Value, amountScale)
+				if err != nil {
+					amount = 0
+				}
+				reference := credit.EndToEndId
+				if reference == "" {
+					reference = credit.Reference
+				}
+
+				_, err = stub.InsertRow("StatementEntry", shim.Row{
+					Columns: []*shim.Column{
+						&shim.Column{Value: &shim.Column_String_{String_: statement.Id}},
+						&shim.Column{Value: &shim.Column_Int32{Int32: item}},
+						&shim.Column{Value: &shim.Column_String_{String_: reference}},
+						&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+						&shim.Column{Value: &shim.Column_String_{String_: credit.Amount.Currency}},
+						&shim.Column{Value: &shim.Column_String_{String_: credit.BookingDate}},
+						&shim.Column{Value: &shim.Column_String_{String_: status}},
+						&shim.Column{Value: &shim.Column_String_{String_: entity}},
+						&shim.Column{Value: &shim.Column_Int32{Int32: entityId}},
+						&shim.Column{Value: &shim.Column_String_{String_: reason}},
+					},
+				})
+				if err != nil {
+					return nil, fmt.Errorf("Failed recording item [%d] of statement [%s]: [%s]", item, statement.Id, err)
+				}
+			}
+		}
+	}
+
+	fmt.Println("Reconcile statement...done!")
+
+	return nil, nil
+}
+
+// reconciliation_info returns the outcome of every credit of a reconciled
+// statement. It can be queried by a bank or the administrator.
+func (t *AssetManagementChaincode) reconciliation_info(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Query reconciliation...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	statement := args[0]
+	caller, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding caller")
+	}
+
+	allowed, err := hasRole(stub, roleBank, caller)
+	if err == nil && !allowed {
+		allowed, err = isAdministrator(stub, caller)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Caller is not allowed to do this operation")
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: statement}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("StatementEntry", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving entries of statement [%s]: [%s]", statement, err)
+	}
+
+	entries := make(map[int32]shim.Row)
+	var items []int32
+	for row := range rows {
+		entries[row.Columns[1].GetInt32()] = row
+		items = append(items, row.Columns[1].GetInt32())
+	}
+	sortInt32s(items)
+
+	matched, unmatched := 0, 0
+	entriesJson := ""
+	for i, item := range items {
+		row := entries[item]
+		if row.Columns[6].GetString_() == "Matched" {
+			matched++
+		} else {
+			unmatched++
+		}
+		if i > 0 {
+			entriesJson += `,`
+		}
+		entriesJson += `{"item":"` + strconv.Itoa(int(item)) + `","reference":` + jsonString(row.Columns[2].GetString_()) +
+			`,"amount":"` + formatDecimal(row.Columns[3].GetInt64(), amountScale) +
+			`","currency":` + jsonString(row.Columns[4].GetString_()) +
+			`,"booking_date":` + jsonString(row.Columns[5].GetString_()) +
+			`,"status":"` + row.Columns[6].GetString_() + `","entity":"` + row.Columns[7].GetString_() +
+			`","id":"` + strconv.Itoa(int(row.Columns[8].GetInt32())) + `","reason":` + jsonString(row.Columns[9].GetString_()) + `}`
+	}
+
+	jsonResp := `{"statement":` + jsonString(statement) + `,"matched":"` + strconv.Itoa(matched) +
+		`","unmatched":"` + strconv.Itoa(unmatched) + `","entries":[` + entriesJson + `]}`
+
+	fmt.Println(jsonResp)
+	fmt.Println("Query reconciliation...done!")
+
+	return []byte(jsonResp), nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Exposure kinds taken over from the buyer on default: what suppliers owe
+// back on recourse requests and the losses funders took on non-recourse ones.
+const (
+	exposureRecourse = "recourse"
+	exposureLoss     = "loss"
+)
+
+func createRecourseTables(stub shim.ChaincodeStubInterface) error {
+	// Payment requests are non-recourse unless flagged otherwise
+	err := stub.CreateTable("PaymentRecourse", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Recourse", Type: shim.ColumnDefinition_BOOL, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating PaymentRecourse table.")
+	}
+
+	// Supplier acceptance of the recourse flag set on a payment request
+	err = stub.CreateTable("RecourseConsent", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "SupplierCert", Type: shim.ColumnDefinition_BYTES, Key: false},
+		&shim.ColumnDefinition{Name: "AcceptedDate", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating RecourseConsent table.")
+	}
+
+	// Buyer defaults declared by funders. On a recourse request the supplier
+	// owes the amount back; on a non-recourse one it is a loss of the funder.
+	err = stub.CreateTable("BuyerDefault", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Payment", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Recourse", Type: shim.ColumnDefinition_BOOL, Key: false},
+		&shim.ColumnDefinition{Name: "FunderId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "CounterpartyId", Type: shim.ColumnDefinition_INT32, Key: false},
+		&shim.ColumnDefinition{Name: "Amount", Type: shim.ColumnDefinition_INT64, Key: false},
+		&shim.ColumnDefinition{Name: "DeclaredDate", Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: "Status", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating BuyerDefault table.")
+	}
+
+	return nil
+}
+
+// parseRecourse parses the optional recourse flag of a payment request.
+func parseRecourse(value string) (bool, error) {
+	recourse, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("Expecting boolean value for recourse")
+	}
+	return recourse, nil
+}
+
+func setPaymentRecourse(stub shim.ChaincodeStubInterface, payment int32, recourse bool) error {
+	_, err := stub.InsertRow("PaymentRecourse", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: payment}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: recourse}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed storing recourse of payment request [%d]: [%s]", payment, err)
+	}
+	return nil
+}
+
+// isRecourseRequested tells whether a payment request was flagged as with
+// recourse when it was created, accepted by the supplier or not.
+func isRecourseRequested(stub shim.ChaincodeStubInterface, payment int32) (bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("PaymentRecourse", columns)
+	if err != nil {
+		return false, fmt.Errorf("Failed retrieving recourse of payment request [%d]: [%s]", payment, err)
+	}
+	return len(row.Columns) != 0 && row.Columns[1].GetBool(), nil
+}
+
+func getRecourseConsentRow(stub shim.ChaincodeStubInterface, payment int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("RecourseConsent", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving recourse consent of payment request [%d]: [%s]", payment, err)
+	}
+	return row, nil
+}
+
+// isRecourse tells whether a payment request is with recourse to the
+// supplier, which takes both the flag and the supplier acceptance.
+func isRecourse(stub shim.ChaincodeStubInterface, payment int32) (bool, error) {
+	requested, err := isRecourseRequested(stub, payment)
+	if err != nil || !requested {
+		return false, err
+	}
+	consent, err := getRecourseConsentRow(stub, payment)
+	if err != nil {
+		return false, err
+	}
+	return len(consent.Columns) != 0, nil
+}
+
+// requireRecourseConsent fails when a payment request was flagged as with
+// recourse and the supplier did not accept it yet, so that no funder takes a
+// request on terms the supplier never agreed to.
+func requireRecourseConsent(stub shim.ChaincodeStubInterface, payment int32) error {
+	requested, err := isRecourseRequested(stub, payment)
+	if err != nil || !requested {
+		return err
+	}
+	recourse, err := isRecourse(stub, payment)
+	if err != nil {
+		return err
+	}
+	if !recourse {
+		return fmt.Errorf("Supplier has not accepted the recourse of payment request [%d]", payment)
+	}
+	return nil
+}
+
+// acceptRecourse lets the supplier of the invoice accept the recourse flag
+// of a payment request before it is assigned to a funder.
+func (t *AssetManagementChaincode) acceptRecourse(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Accept recourse...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("acceptRecourse", throwError), throwError
+	}
+	supplier, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding supplier")
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+	err = requireParticipantCert(stub, invoiceRow.Columns[6].GetInt32(), invoiceRow.Columns[8].GetBytes(), supplier)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := isRecourseRequested(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	if !requested {
+		return nil, fmt.Errorf("Payment request [%d] is not flagged as with recourse", payment)
+	}
+	if paymentRow.Columns[5].GetString_() != "Pending" {
+		return nil, fmt.Errorf("Payment request [%d] is %s", payment, paymentRow.Columns[5].GetString_())
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := stub.InsertRow("RecourseConsent", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(supplier)}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Recourse of payment request [%d] was already accepted", payment)
+	}
+
+	fmt.Println("Accept recourse...done!")
+
+	return nil, nil
+}
+
+// getBuyerDefaultRow returns the default declared on a payment request, or
+// an empty row when there is none.
+func getBuyerDefaultRow(stub shim.ChaincodeStubInterface, payment int32) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: payment}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("BuyerDefault", columns)
+	if err != nil {
+		return row, fmt.Errorf("Failed retrieving default of payment request [%d]: [%s]", payment, err)
+	}
+	return row, nil
+}
+
+// declareDefault lets the funder holding a payment request declare that the
+// buyer did not pay, once the grace period after the due date has passed. A
+// recourse request moves to Recourse and the supplier owes the face value
+// plus accrued late interest back to the funder; a non-recourse request
+// moves to Defaulted and the face value is recorded as a loss of the funder.
+func (t *AssetManagementChaincode) declareDefault(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Declare buyer default...")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	payment, err := strconv.Atoi(args[0])
+	if err != nil {
+		throwError := errors.New("Expecting integer value for payment request id")
+		return errorJson("declareDefault", throwError), throwError
+	}
+	funder, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding funder")
+	}
+
+	paymentRow, err := getPaymentRequestRow(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	funderId, holder, err := receivableHolder(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+	err = requireParticipantCert(stub, funderId, holder, funder)
+	if err != nil {
+		return nil, err
+	}
+	status := paymentRow.Columns[5].GetString_()
+	if status != "Assigned" && status != "Funded" {
+		return nil, fmt.Errorf("Payment request [%d] is %s", payment, status)
+	}
+
+	invoiceRow, err := getInvoiceRow(stub, paymentRow.Columns[1].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	dueDate, err := parseDate(invoiceRow.Columns[5].GetString_())
+	if err != nil {
+		return nil, err
+	}
+	graceDays, err := configValue(stub, configDefaultGraceDays)
+	if err != nil {
+		return nil, err
+	}
+	if daysBetween(dueDate, now) <= graceDays {
+		return nil, fmt.Errorf("Grace period of payment request [%d] has not passed", payment)
+	}
+
+	recourse, err := isRecourse(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring late interest up to date before fixing the amount owed
+	err = accrueOverdue(stub, documentEntityPayment, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	amount, _, err := paymentAmounts(stub, paymentRow)
+	if err != nil {
+		return nil, err
+	}
+
+	buyerId := invoiceRow.Columns[7].GetInt32()
+	counterpartyId, newStatus, defaultStatus, kind := buyerId, "Defaulted", "Loss", exposureLoss
+	if recourse {
+		overdue, err := getOverdueRow(stub, documentEntityPayment, int32(payment))
+		if err != nil {
+			return nil, err
+		}
+		if len(overdue.Columns) != 0 {
+			amount += overdue.Columns[6].GetInt64()
+		}
+		counterpartyId, newStatus, defaultStatus, kind = invoiceRow.Columns[6].GetInt32(), "Recourse", "Open", exposureRecourse
+	}
+
+	fmt.Printf("Default of buyer [%d] on payment request [%d]: recourse [%t], amount [%d]\n", buyerId, payment, recourse, amount)
+
+	_, err = stub.InsertRow("BuyerDefault", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(payment)}},
+			&shim.Column{Value: &shim.Column_Bool{Bool: recourse}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: funderId}},
+			&shim.Column{Value: &shim.Column_Int32{Int32: counterpartyId}},
+			&shim.Column{Value: &shim.Column_Int64{Int64: amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: now.Format(dateLayout)}},
+			&shim.Column{Value: &shim.Column_String_{String_: defaultStatus}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = setPaymentRequestStatus(stub, paymentRow, newStatus)
+	if err != nil {
+		return nil, err
+	}
+	err = releaseExposure(stub, int32(payment))
+	if err != nil {
+		return nil, err
+	}
+	currency, err := settlementCurrency(stub, invoiceRow.Columns[0].GetInt32())
+	if err != nil {
+		return nil, err
+	}
+	exposureAmount, err := convertExposure(stub, int32(payment), kind, funderId, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	err = addExposure(stub, kind, funderId, counterpartyId, exposureAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Declare buyer default...done!")
+
+	return nil, nil
+}
+
+// reconcileRecourse matches a repayment credit of a payment request under
+// recourse against the amount the supplier owes and settles the request.
+func reconcileRecourse(stub shim.ChaincodeStubInterface, item camtItem, paymentRow shim.Row) (string, int32, string, error) {
+	payment := paymentRow.Columns[0].GetInt32()
+	defaultRow, err := getBuyerDefaultRow(stub, payment)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if len(defaultRow.Columns) == 0 || defaultRow.Columns[6].GetString_() != "Open" {
+		return documentEntityPayment, payment, "no open supplier repayment obligation", nil
+	}
+
+	amount := defaultRow.Columns[4].GetInt64()
+	_, reason := checkCredit(stub, item, paymentRow.Columns[1].GetInt32(), amount)
+	if reason != "" {
+		return documentEntityPayment, payment, reason, nil
+	}
+
+	err = closeDefault(stub, defaultRow, "Repaid")
+	if err != nil {
+		return "", 0, "", err
+	}
+	err = setPaymentRequestStatus(stub, paymentRow, "Settled")
+	if err != nil {
+		return "", 0, "", err
+	}
+	return documentEntityPayment, payment, "", nil
+}
+
+// closeDefault closes the open supplier repayment obligation of a default
+// with the given status and releases the recourse exposure it carried.
+func closeDefault(stub shim.ChaincodeStubInterface, defaultRow shim.Row, status string) error {
+	payment := defaultRow.Columns[0].GetInt32()
+	defaultRow.Columns[6] = &shim.Column{Value: &shim.Column_String_{String_: status}}
+	_, err := stub.ReplaceRow("BuyerDefault", defaultRow)
+	if err != nil {
+		return fmt.Errorf("Failed updating default of payment request [%d]: [%s]", payment, err)
+	}
+	exposureAmount, err := convertedExposure(stub, payment, exposureRecourse, defaultRow.Columns[4].GetInt64())
+	if err != nil {
+		return err
+	}
+	return addExposure(stub, exposureRecourse, defaultRow.Columns[2].GetInt32(), defaultRow.Columns[3].GetInt32(), -exposureAmount)
+}
+
+// defaultJson renders the recourse flag of a payment request and the
+// default declared on it, if any.
+func defaultJson(stub shim.ChaincodeStubInterface, payment int32) (string, error) {
+	recourse, err := isRecourse(stub, payment)
+	if err != nil {
+		return "", err
+	}
+	jsonResp := `,"recourse":"` + strconv.FormatBool(recourse) + `"`
+
+	row, err := getBuyerDefaultRow(stub, payment)
+	if err != nil || len(row.Columns) == 0 {
+		return jsonResp, err
+	}
+
+	counterpartyName := "buyerId"
+	if row.Columns[1].GetBool() {
+		counterpartyName = "supplierId"
+	}
+	return jsonResp + `,"default":{"declared_date":"` + row.Columns[5].GetString_() +
+		`","` + counterpartyName + `":"` + strconv.Itoa(int(row.Columns[3].GetInt32())) +
+		`","amount":"` + strconv.FormatInt(row.Columns[4].GetInt64(), 10) +
+		`","status":"` + row.Columns[6].GetString_() + `"}`, nil
+}
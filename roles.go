@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Roles that can be granted to a certificate by the administrator.
+const (
+	roleCarrier    = "carrier"
+	roleBank       = "bank"
+	roleArbitrator = "arbitrator"
+	roleFxOracle   = "fxoracle"
+	roleAdmin      = "admin"
+)
+
+func isKnownRole(role string) bool {
+	switch role {
+	case roleCarrier, roleBank, roleArbitrator, roleFxOracle, roleAdmin:
+		return true
+	}
+	return false
+}
+
+func createRoleTable(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("Role", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Role", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Cert", Type: shim.ColumnDefinition_BYTES, Key: true},
+	})
+	if err != nil {
+		return errors.New("Failed creating Role table.")
+	}
+
+	// Participant a role holder's certificate was registered for when the
+	// role was granted; the role then belongs to the participant
+	err = stub.CreateTable("RoleParticipant", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Role", Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: "Fingerprint", Type: shim.ColumnDefinition_BYTES, Key: true},
+		&shim.ColumnDefinition{Name: "ParticipantId", Type: shim.ColumnDefinition_INT32, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating RoleParticipant table.")
+	}
+	return nil
+}
+
+func roleParticipantKey(role string, holder []byte) []shim.Column {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: role}}
+	col2 := shim.Column{Value: &shim.Column_Bytes{Bytes: identityOf(holder)}}
+	columns = append(columns, col1, col2)
+	return columns
+}
+
+// isAdministrator checks a certificate against the administrator cert that
+// Init stored from the deploy transaction metadata, or the admin role.
+func isAdministrator(stub shim.ChaincodeStubInterface, cert []byte) (bool, error) {
+	admin, err := stub.GetState("supplierRole")
+	if err != nil {
+		return false, errors.New("Failed fetching administrator identity")
+	}
+	if len(admin) > 0 && bytes.Equal(admin, cert) {
+		return true, nil
+	}
+	return hasRole(stub, roleAdmin, cert)
+}
+
+// hasRole tells whether a certificate holds a role. A role granted to a
+// registered certificate belongs to its participant, so it follows the
+// participant's certificates in the registry through rotation and
+// revocation.
+func hasRole(stub shim.ChaincodeStubInterface, role string, cert []byte) (bool, error) {
+	if len(cert) == 0 {
+		return false, nil
+	}
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: role}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("Role", columns)
+	if err != nil {
+		return false, fmt.Errorf("Failed retrieving role [%s]: [%s]", role, err)
+	}
+	var holders [][]byte
+	for row := range rows {
+		holders = append(holders, row.Columns[1].GetBytes())
+	}
+
+	for _, holder := range holders {
+		participant, err := stub.GetRow("RoleParticipant", roleParticipantKey(role, holder))
+		if err != nil {
+			return false, fmt.Errorf("Failed retrieving role [%s]: [%s]", role, err)
+		}
+		if len(participant.Columns) == 0 {
+			if sameIdentity(holder, cert) {
+				return true, nil
+			}
+			continue
+		}
+		ok, err := isParticipantCert(stub, participant.Columns[2].GetInt32(), nil, cert)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// requireRole fails unless the certificate was granted the role.
+func requireRole(stub shim.ChaincodeStubInterface, role string, cert []byte) error {
+	ok, err := hasRole(stub, role, cert)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Caller does not have the [%s] role", role)
+	}
+	return nil
+}
+
+func (t *AssetManagementChaincode) addRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Add role...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	role := args[0]
+	if !isKnownRole(role) {
+		return nil, fmt.Errorf("Unknown role [%s]", role)
+	}
+
+	cert, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding cert")
+	}
+	admin, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding administrator")
+	}
+
+	ok, err := isAdministrator(stub, admin)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Caller is not allowed to do this operation")
+	}
+
+	_, err = stub.InsertRow("Role", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: role}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(cert)}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed adding role [%s]: [%s]", role, err)
+	}
+
+	participantId, registered, err := certParticipant(stub, cert)
+	if err != nil {
+		return nil, err
+	}
+	if registered {
+		_, err = stub.InsertRow("RoleParticipant", shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_String_{String_: role}},
+				&shim.Column{Value: &shim.Column_Bytes{Bytes: certFingerprint(cert)}},
+				&shim.Column{Value: &shim.Column_Int32{Int32: participantId}},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed adding role [%s]: [%s]", role, err)
+		}
+	}
+
+	fmt.Println("Add role...done!")
+
+	return nil, nil
+}
+
+func (t *AssetManagementChaincode) removeRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Remove role...")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	role := args[0]
+	cert, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding cert")
+	}
+	admin, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding administrator")
+	}
+
+	ok, err := isAdministrator(stub, admin)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Caller is not allowed to do this operation")
+	}
+
+	// Grants not migrated yet are still keyed by the raw certificate
+	for _, holder := range [][]byte{certFingerprint(cert), cert} {
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_String_{String_: role}}
+		col2 := shim.Column{Value: &shim.Column_Bytes{Bytes: holder}}
+		columns = append(columns, col1, col2)
+
+		err = stub.DeleteRow("Role", columns)
+		if err != nil {
+			return nil, fmt.Errorf("Failed removing role [%s]: [%s]", role, err)
+		}
+	}
+	err = stub.DeleteRow("RoleParticipant", roleParticipantKey(role, cert))
+	if err != nil {
+		return nil, fmt.Errorf("Failed removing role [%s]: [%s]", role, err)
+	}
+
+	fmt.Println("Remove role...done!")
+
+	return nil, nil
+}
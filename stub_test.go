@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// testStub is a MockStub with the transaction time, caller metadata and
+// signature verification the chaincode relies on, which the mock leaves out.
+type testStub struct {
+	*shim.MockStub
+	now    time.Time
+	caller []byte
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now.Unix()}, nil
+}
+
+func (stub *testStub) GetCallerMetadata() ([]byte, error) {
+	return stub.caller, nil
+}
+
+// VerifySignature accepts the signatures made by sign.
+func (stub *testStub) VerifySignature(cert []byte, signature []byte, message []byte) (bool, error) {
+	return string(signature) == string(cert)+"|"+string(message), nil
+}
+
+// sign returns a base64 encoded signature of a message by a certificate
+// that testStub accepts.
+func sign(cert string, message string) string {
+	return base64.StdEncoding.EncodeToString([]byte(cert + "|" + message))
+}
+
+// newTestStub deploys the chaincode with "admin" as the administrator
+// certificate, on 1 October 2026, and registers the "supplier" certificate
+// for supplier 3 and the "funder" certificate for funder 5.
+func newTestStub(t *testing.T) (*AssetManagementChaincode, *testStub) {
+	cc := new(AssetManagementChaincode)
+	stub := &testStub{
+		MockStub: shim.NewMockStub("asset_management", cc),
+		now:      time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		caller:   []byte("admin"),
+	}
+	stub.MockTransactionStart("init")
+	_, err := cc.Init(stub, "init", nil)
+	stub.MockTransactionEnd("init")
+	if err != nil {
+		t.Fatalf("Init failed: %s", err)
+	}
+	stub.invoke(t, cc, "registerCert", "3", encodeCert("supplier"), "", encodeCert("admin"))
+	stub.invoke(t, cc, "registerCert", "5", encodeCert("funder"), "", encodeCert("admin"))
+	return cc, stub
+}
+
+// invoke runs a chaincode function in a transaction of its own and fails
+// the test on error.
+func (stub *testStub) invoke(t *testing.T, cc *AssetManagementChaincode, function string, args ...string) {
+	stub.MockTransactionStart(function)
+	_, err := cc.Invoke(stub, function, args)
+	stub.MockTransactionEnd(function)
+	if err != nil {
+		t.Fatalf("%s failed: %s", function, err)
+	}
+}
+
+func encodeCert(cert string) string {
+	return base64.StdEncoding.EncodeToString([]byte(cert))
+}
+
+// assignedRequest sets up invoice 1 of 100000 from supplier 3 to buyer 4,
+// due on 15 November 2026, and payment request 7 on it at a 2% discount,
+// assigned to funder 5.
+func assignedRequest(t *testing.T) (*AssetManagementChaincode, *testStub) {
+	cc, stub := newTestStub(t)
+	stub.invoke(t, cc, "createInvoice", "1", "100000", "2026-11-15", "3", "4", encodeCert("supplier"), encodeCert("buyer"))
+	stub.invoke(t, cc, "approveInvoice", "1", encodeCert("buyer"))
+	stub.invoke(t, cc, "createPaymentRequest", "7", "1", "2", "2026-10-01", encodeCert("buyer"))
+	stub.invoke(t, cc, "assignPaymentRequest", "7", "5", encodeCert("funder"))
+	return cc, stub
+}
+
+func paymentRequest(t *testing.T, stub *testStub, payment int32) shim.Row {
+	row, err := getPaymentRequestRow(stub, payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row
+}
+
+func cashBalance(t *testing.T, stub *testStub, participantId int32) int64 {
+	account, err := getCashAccountRow(stub, participantId, settlementToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(account.Columns) == 0 {
+		return 0
+	}
+	return account.Columns[2].GetInt64()
+}
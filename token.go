@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// setTokenChaincode configures the token chaincode funding and repayments
+// settle through, with the function it exposes for each leg.
+func setTokenChaincode(stub shim.ChaincodeStubInterface, name string, disbursement string, repayment string) error {
+	if name == "" || disbursement == "" || repayment == "" {
+		return errors.New("Expecting token chaincode name and transfer functions")
+	}
+
+	err := stub.PutState("tokenChaincode", []byte(name))
+	if err != nil {
+		return fmt.Errorf("Failed storing token chaincode: [%s]", err)
+	}
+	err = stub.PutState("tokenFunction:"+legDisbursement, []byte(disbursement))
+	if err != nil {
+		return fmt.Errorf("Failed storing token chaincode function: [%s]", err)
+	}
+	err = stub.PutState("tokenFunction:"+legRepayment, []byte(repayment))
+	if err != nil {
+		return fmt.Errorf("Failed storing token chaincode function: [%s]", err)
+	}
+
+	fmt.Printf("Settling through token chaincode [%s]\n", name)
+	return nil
+}
+
+// getTokenChaincode returns the configured token chaincode, or an empty name
+// when payment requests settle on the cash accounts of this chaincode.
+func getTokenChaincode(stub shim.ChaincodeStubInterface) (string, error) {
+	name, err := stub.GetState("tokenChaincode")
+	if err != nil {
+		return "", fmt.Errorf("Failed retrieving token chaincode: [%s]", err)
+	}
+	return string(name), nil
+}
+
+// tokenTransfer moves an amount between two participants on the token
+// chaincode with the function mapped to the leg. The token chaincode is
+// called with the payment request as reference, followed by the from and to
+// participant, the amount and the currency. An error of the token chaincode
+// fails the transaction, so no status change is committed without the
+// transfer.
+func tokenTransfer(stub shim.ChaincodeStubInterface, name string, leg string, payment int32, fromId int32, toId int32, amount int64, currency string) error {
+	function, err := stub.GetState("tokenFunction:" + leg)
+	if err != nil {
+		return fmt.Errorf("Failed retrieving token chaincode function: [%s]", err)
+	}
+	if len(function) == 0 {
+		return fmt.Errorf("No token chaincode function for %s", leg)
+	}
+
+	args := [][]byte{
+		function,
+		[]byte(strconv.Itoa(int(payment)) + ":" + leg),
+		[]byte(strconv.Itoa(int(fromId))),
+		[]byte(strconv.Itoa(int(toId))),
+		[]byte(strconv.FormatInt(amount, 10)),
+		[]byte(currency),
+	}
+	_, err = stub.InvokeChaincode(name, args)
+	if err != nil {
+		return fmt.Errorf("Token transfer of %s of payment request [%d] failed: [%s]", leg, payment, err)
+	}
+
+	fmt.Printf("Transferred %d %s from [%d] to [%d] on [%s]\n", amount, currency, fromId, toId, name)
+	return nil
+}
+
+// payFunds pays an amount already taken from a participant to another one:
+// on the token chaincode when one is configured, otherwise by crediting the
+// cash account of the receiver.
+func payFunds(stub shim.ChaincodeStubInterface, leg string, payment int32, fromId int32, toId int32, amount int64, currency string, toCert []byte) error {
+	name, err := getTokenChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		return tokenTransfer(stub, name, leg, payment, fromId, toId, amount, currency)
+	}
+	return creditCash(stub, toId, currency, amount, toCert)
+}
+
+// takeFunds debits the cash account of the participant paying a leg. With a
+// token chaincode the funds stay there until payFunds transfers them, which
+// leaves nothing to hold while the invoice is under dispute.
+func takeFunds(stub shim.ChaincodeStubInterface, number int32, fromId int32, amount int64, currency string) error {
+	name, err := getTokenChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return debitCash(stub, fromId, currency, amount)
+	}
+
+	disputed, err := isDisputed(stub, number)
+	if err != nil {
+		return err
+	}
+	if disputed {
+		return fmt.Errorf("Invoice [%d] is under dispute", number)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Subset of a UBL 2.1 / PEPPOL BIS 3 invoice needed to create an invoice.
+// Elements are matched by local name, so the cac/cbc prefixes used by the
+// sender do not matter.
+type ublInvoice struct {
+	XMLName        xml.Name         `xml:"Invoice"`
+	ID             string           `xml:"ID"`
+	IssueDate      string           `xml:"IssueDate"`
+	DueDate        string           `xml:"DueDate"`
+	PaymentDueDate string           `xml:"PaymentMeans>PaymentDueDate"`
+	Currency       string           `xml:"DocumentCurrencyCode"`
+	Supplier       ublParty         `xml:"AccountingSupplierParty>Party"`
+	Customer       ublParty         `xml:"AccountingCustomerParty>Party"`
+	DeliveryDate   string           `xml:"Delivery>ActualDeliveryDate"`
+	TaxSubtotals   []ublTaxSubtotal `xml:"TaxTotal>TaxSubtotal"`
+	TaxInclusive   ublAmount        `xml:"LegalMonetaryTotal>TaxInclusiveAmount"`
+	Payable        ublAmount        `xml:"LegalMonetaryTotal>PayableAmount"`
+	Lines          []ublInvoiceLine `xml:"InvoiceLine"`
+}
+
+type ublParty struct {
+	EndpointID     string `xml:"EndpointID"`
+	Identification string `xml:"PartyIdentification>ID"`
+}
+
+type ublAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"currencyID,attr"`
+}
+
+type ublTaxSubtotal struct {
+	TaxableAmount ublAmount `xml:"TaxableAmount"`
+	TaxAmount     ublAmount `xml:"TaxAmount"`
+	Percent       string    `xml:"TaxCategory>Percent"`
+}
+
+type ublInvoiceLine struct {
+	ID                  string    `xml:"ID"`
+	InvoicedQuantity    string    `xml:"InvoicedQuantity"`
+	LineExtensionAmount ublAmount `xml:"LineExtensionAmount"`
+	Name                string    `xml:"Item>Name"`
+	SellersItemID       string    `xml:"Item>SellersItemIdentification>ID"`
+	Percent             string    `xml:"Item>ClassifiedTaxCategory>Percent"`
+	PriceAmount         ublAmount `xml:"Price>PriceAmount"`
+}
+
+func createInvoiceCurrencyTable(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable("InvoiceCurrency", []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: "Invoice", Type: shim.ColumnDefinition_INT32, Key: true},
+		&shim.ColumnDefinition{Name: "Currency", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		return errors.New("Failed creating InvoiceCurrency table.")
+	}
+	return nil
+}
+
+// partyId returns the numeric participant id of a UBL party, taken from its
+// party identification or, failing that, its electronic address.
+func (p ublParty) partyId() (int32, error) {
+	id := strings.TrimSpace(p.Identification)
+	if id == "" {
+		id = strings.TrimSpace(p.EndpointID)
+	}
+	value, err := strconv.ParseInt(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Expecting integer party identification, got [%s]", id)
+	}
+	return int32(value), nil
+}
+
+// amount converts a UBL amount into minor units, checking its currency.
+func (a ublAmount) amount(currency string) (int64, error) {
+	if a.Currency != "" && a.Currency != currency {
+		return 0, fmt.Errorf("Amount [%s] is in [%s], expecting document currency [%s]", a.Value, a.Currency, currency)
+	}
+	return parseDecimal(a.Value, amountScale)
+}
+
+func toInt32(value int64, name string) (int32, error) {
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return 0, fmt.Errorf("Value of %s [%d] is out of range", name, value)
+	}
+	return int32(value), nil
+}
+
+// ublInvoiceLines maps the UBL invoice lines onto invoice lines. UBL only
+// gives the tax rate per line, so the tax of each rate is taken from the
+// document tax subtotals and spread over its lines, the rounding difference
+// going to the last line of the rate.
+func ublInvoiceLines(invoice *ublInvoice) ([]invoiceLine, error) {
+	var lines []invoiceLine
+	for _, ublLine := range invoice.Lines {
+		quantity, err := parseDecimal(ublLine.InvoicedQuantity, 0)
+		if err != nil || quantity <= 0 {
+			return nil, fmt.Errorf("Expecting positive whole quantity on line [%s]", ublLine.ID)
+		}
+		unitPrice, err := ublLine.PriceAmount.amount(invoice.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid price on line [%s]: %s", ublLine.ID, err)
+		}
+		net, err := ublLine.LineExtensionAmount.amount(invoice.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid line amount on line [%s]: %s", ublLine.ID, err)
+		}
+		if net != quantity*unitPrice {
+			return nil, fmt.Errorf("Line amount of line [%s] does not equal quantity times price", ublLine.ID)
+		}
+		taxRate, err := parseDecimal(ublLine.Percent, 2)
+		if err != nil || taxRate < 0 {
+			return nil, fmt.Errorf("Invalid tax percent on line [%s]", ublLine.ID)
+		}
+
+		line := invoiceLine{
+			Description: ublLine.Name,
+			Sku:         ublLine.SellersItemID,
+		}
+		if line.Quantity, err = toInt32(quantity, "quantity"); err != nil {
+			return nil, err
+		}
+		if line.UnitPrice, err = toInt32(unitPrice, "unit price"); err != nil {
+			return nil, err
+		}
+		line.TaxRate = int32(taxRate)
+		line.TaxAmount = int32((net*taxRate + 5000) / 10000)
+		lines = append(lines, line)
+	}
+
+	for _, subtotal := range invoice.TaxSubtotals {
+		rate, err := parseDecimal(subtotal.Percent, 2)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tax subtotal percent [%s]", subtotal.Percent)
+		}
+		tax, err := subtotal.TaxAmount.amount(invoice.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		last := -1
+		var computed int64
+		for i, line := range lines {
+			if int64(line.TaxRate) == rate {
+				computed += int64(line.TaxAmount)
+				last = i
+			}
+		}
+		if last >= 0 {
+			adjusted, err := toInt32(int64(lines[last].TaxAmount)+tax-computed, "tax amount")
+			if err != nil || adjusted < 0 {
+				return nil, fmt.Errorf("Tax subtotal at [%s]%% does not match the invoice lines", subtotal.Percent)
+			}
+			lines[last].TaxAmount = adjusted
+		}
+	}
+
+	return lines, nil
+}
+
+// createInvoiceFromUBL creates an invoice from a UBL 2.1 invoice document.
+// Arguments are the base64 encoded XML, the supplier and buyer certs and the
+// off-chain location of the document, whose hash is anchored to the invoice.
+// Party identifications must be the numeric supplier and buyer ids.
+func (t *AssetManagementChaincode) createInvoiceFromUBL(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("Create invoice from UBL...")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	document, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil {
+		return nil, errors.New("Failed decoding UBL document")
+	}
+	supplier, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return nil, errors.New("Failed decoding supplier")
+	}
+	buyer, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return nil, errors.New("Failed decoding buyer")
+	}
+	uri := args[3]
+
+	var invoice ublInvoice
+	err = xml.Unmarshal(document, &invoice)
+	if err != nil {
+		throwError := fmt.Errorf("Failed parsing UBL invoice: %s", err)
+		return errorJson("createInvoiceFromUBL", throwError), throwError
+	}
+
+	number, err := strconv.ParseInt(strings.TrimSpace(invoice.ID), 10, 32)
+	if err != nil {
+		throwError := fmt.Errorf("Expecting integer UBL invoice ID, got [%s]", invoice.ID)
+		return errorJson("createInvoiceFromUBL", throwError), throwError
+	}
+	if invoice.Currency == "" {
+		throwError := errors.New("UBL invoice has no document currency")
+		return errorJson("createInvoiceFromUBL", throwError), throwError
+	}
+	supplierId, err := invoice.Supplier.partyId()
+	if err != nil {
+		return errorJson("createInvoiceFromUBL", err), err
+	}
+	buyerId, err := invoice.Customer.partyId()
+	if err != nil {
+		return errorJson("createInvoiceFromUBL", err), err
+	}
+	// As with createInvoice, the supplier cert must be registered for the
+	// supplier party
+	err = requireParticipantCert(stub, supplierId, nil, supplier)
+	if err != nil {
+		return nil, err
+	}
+
+	dueDate := invoice.DueDate
+	if dueDate == "" {
+		dueDate = invoice.PaymentDueDate
+	}
+	if dueDate == "" {
+		throwError := errors.New("UBL invoice has no due date")
+		return errorJson("createInvoiceFromUBL", throwError), throwError
+	}
+	deliveryDate := invoice.DeliveryDate
+	if deliveryDate == "" {
+		deliveryDate = invoice.IssueDate
+	}
+
+	payable, err := invoice.Payable.amount(invoice.Currency)
+	if err != nil {
+		return errorJson("createInvoiceFromUBL", err), err
+	}
+	price, err := toInt32(payable, "payable amount")
+	if err != nil {
+		return errorJson("createInvoiceFromUBL", err), err
+	}
+
+	lines, err := ublInvoiceLines(&invoice)
+	if err != nil {
+		return errorJson("createInvoiceFromUBL", err), err
+	}
+	if len(lines) > 0 {
+		taxInclusive, err := invoice.TaxInclusive.amount(invoice.Currency)
+		if err != nil {
+			return errorJson("createInvoiceFromUBL", err), err
+		}
+		taxInclusiveTotal, err := toInt32(taxInclusive, "tax inclusive amount")
+		if err != nil {
+			return errorJson("createInvoiceFromUBL", err), err
+		}
+		err = checkInvoiceLineTotals(lines, taxInclusiveTotal)
+		if err != nil {
+			return errorJson("createInvoiceFromUBL", err), err
+		}
+	}
+
+	fmt.Printf("Creating invoice [%d] from UBL, price [%d %s], due [%s]\n", number, price, invoice.Currency, dueDate)
+
+	err = insertInvoice(stub, int32(number), price, deliveryDate, dueDate, supplierId, buyerId, supplier, buyer, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = stub.InsertRow("InvoiceCurrency", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Int32{Int32: int32(number)}},
+			&shim.Column{Value: &shim.Column_String_{String_: invoice.Currency}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed storing currency of invoice [%d]: [%s]", number, err)
+	}
+
+	hash := sha256.Sum256(document)
+	err = anchorDocument(stub, documentEntityInvoice, int32(number), "ubl_invoice", hex.EncodeToString(hash[:]), uri, supplier)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Create invoice from UBL...done!")
+
+	return nil, nil
+}
+
+// getInvoiceCurrency returns the currency of an invoice, or an empty string
+// for invoices created without one.
+func getInvoiceCurrency(stub shim.ChaincodeStubInterface, number int32) (string, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_Int32{Int32: number}}
+	columns = append(columns, col1)
+
+	row, err := stub.GetRow("InvoiceCurrency", columns)
+	if err != nil {
+		return "", fmt.Errorf("Failed retrieving currency of invoice [%d]: [%s]", number, err)
+	}
+	if len(row.Columns) == 0 {
+		return "", nil
+	}
+	return row.Columns[1].GetString_(), nil
+}